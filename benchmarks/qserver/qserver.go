@@ -46,6 +46,9 @@ func main() {
 	initPosition := flag.Int("pos", -1, "Position in server list (if blank, attempts to use IP to guess)")
 	local := flag.Bool("local", false, "States the test is running on a single machine")
 	useVR := flag.Bool("vr", true, "True for using VR, False for using disk")
+	dataDir := flag.String("dir", "", "Directory for snapshots and logs (defaults to the current directory)")
+	flag.IntVar(&vr.PREPARE_WINDOW, "prepare_window", vr.PREPARE_WINDOW, "Most Prepares the master has in flight at once")
+	flag.IntVar(&vr.MAX_BATCH, "max_batch", vr.MAX_BATCH, "Most commands the master sends in one Prepare")
 	flag.Parse()
 	if *local {
 		*rawServerPaths = "127.0.0.1:9000 127.0.0.1:9001 127.0.0.1:9002 127.0.0.1:9003 127.0.0.1:9004"
@@ -78,7 +81,7 @@ func main() {
 
 	serverPaths[position] = "0.0.0.0:9000"
 	fmt.Println("Starting VR server at " + serverPaths[position] + "...")
-	newReplica := vr.RunAsReplica(uint(position), serverPaths)
+	newReplica := vr.RunAsReplicaInDir(uint(position), serverPaths, *dataDir)
 	
 	port := 1337
 	if *local {
@@ -88,7 +91,7 @@ func main() {
 	serverpath := strings.Split(serverPaths[position], ":")
 	rpcServerPath := serverpath[0] + ":" + strconv.FormatInt(int64(port), 10)
 	fmt.Println("Starting RPC server at " + rpcServerPath + "...")
-	queueRPC.StartServer(rpcServerPath, newReplica, *useVR)
+	queueRPC.StartServerInDir(rpcServerPath, newReplica, *useVR, *dataDir)
 
 	// Survive indefinitely
 	t := time.NewTicker(1 * time.Minute)
@@ -0,0 +1,94 @@
+package main
+
+// Compares pushes to the disk backed queue (which fsyncs once per group of
+// concurrent requests) with pushes to the replicated queue:
+//   go test -bench . github.com/mgentili/goPhat/benchmarks/qserver
+
+import (
+	"fmt"
+	"github.com/mgentili/goPhat/queueRPC"
+	"github.com/mgentili/goPhat/vr"
+	"github.com/mgentili/goPhat/worker"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// workers pushing at the same time
+const CONCURRENCY = 32
+
+// each mode gets its own replicas, since a replica only serves one queue
+var bench_replicas = map[bool][]string{
+	true:  {"127.0.0.1:9500", "127.0.0.1:9501", "127.0.0.1:9502"},
+	false: {"127.0.0.1:9510", "127.0.0.1:9511", "127.0.0.1:9512"},
+}
+var bench_clients = map[bool][]string{
+	true:  {"127.0.0.1:6500", "127.0.0.1:6501", "127.0.0.1:6502"},
+	false: {"127.0.0.1:6510", "127.0.0.1:6511", "127.0.0.1:6512"},
+}
+var started = make(map[bool]bool)
+
+// startServers starts the servers for a mode (once per run, since benchmarks are run repeatedly)
+func startServers(b *testing.B, useVR bool) []string {
+	if started[useVR] {
+		return bench_clients[useVR]
+	}
+	dir, err := ioutil.TempDir("", "qserver")
+	if err != nil {
+		b.Fatal(err)
+	}
+	replicas := bench_replicas[useVR]
+	for i := range replicas {
+		dataDir := filepath.Join(dir, fmt.Sprint(i))
+		os.Mkdir(dataDir, 0777)
+		r := vr.RunAsReplicaInDir(uint(i), replicas, dataDir)
+		queueRPC.StartServerInDir(bench_clients[useVR][i], r, useVR, dataDir)
+	}
+	// give the replicas time to pick a master
+	time.Sleep(3 * time.Second)
+	started[useVR] = true
+	return bench_clients[useVR]
+}
+
+func benchmarkPush(b *testing.B, useVR bool) {
+	servers := startServers(b, useVR)
+	workers := make([]*worker.Worker, CONCURRENCY)
+	for i := range workers {
+		var err error
+		workers[i], err = worker.NewWorker(servers, 0, fmt.Sprintf("bench%d", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		n := b.N / CONCURRENCY
+		if i < b.N%CONCURRENCY {
+			n++
+		}
+		wg.Add(1)
+		go func(w *worker.Worker, n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if err := w.Push("work"); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(w, n)
+	}
+	wg.Wait()
+}
+
+func BenchmarkDiskPush(b *testing.B) {
+	benchmarkPush(b, false)
+}
+
+func BenchmarkVRPush(b *testing.B) {
+	benchmarkPush(b, true)
+}
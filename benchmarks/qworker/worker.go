@@ -41,7 +41,7 @@ func NewWorker(servers []string, id uint, uid string) (*Worker, error) {
 }
 
 func (w *Worker) processCall(cmd *queue.QCommand) (*queue.QResponse, error) {
-	args := &queueRPC.ClientCommand{w.Cli.Uid, w.SeqNumber, cmd}
+	args := &queueRPC.ClientCommand{Uid: w.Cli.Uid, SeqNumber: w.SeqNumber, Command: cmd}
 	response := &queue.QResponse{}
 	w.SeqNumber++
 	err := w.Cli.RpcClient.Call("Server.Send", args, response)
@@ -57,21 +57,23 @@ func (w *Worker) processCall(cmd *queue.QCommand) (*queue.QResponse, error) {
 }
 
 func (w *Worker) Push(work string) error {
-	cmd := &queue.QCommand{"PUSH", work}
+	cmd := &queue.QCommand{Command: "PUSH", Value: work}
 	_, err := w.processCall(cmd)
 	return err
 }
 
 func (w *Worker) Pop() (*queue.QResponse, error) {
-	cmd := &queue.QCommand{"POP", ""}
+	cmd := &queue.QCommand{Command: "POP", Value: ""}
 	res, err := w.processCall(cmd)
 
 	// TODO: Make it do something with the response?
 	return res, err
 }
 
-func (w *Worker) Done() error {
-	cmd := &queue.QCommand{"DONE", ""}
+// Done acknowledges that the popped message with the given id has been
+// processed, so it won't be redelivered
+func (w *Worker) Done(mId string) error {
+	cmd := &queue.QCommand{Command: "DONE", Value: mId}
 	_, err := w.processCall(cmd)
 	return err
 }
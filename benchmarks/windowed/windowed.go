@@ -1,4 +1,9 @@
-/* Windowed latency */
+/* Windowed latency
+ * Keeps window_size requests outstanding (each from its own worker, so the
+ * server can pipeline them) and reports every request's latency plus the overall
+ * throughput. Compare servers started with qserver -prepare_window 1 -max_batch 1
+ * against the defaults to see what pipelining and batching Prepares buys
+ */
 
 package main
 
@@ -20,26 +25,29 @@ type Times struct {
 
 type WorkerRequests struct {
 	RequestTimes []Times
+	// which worker just finished its request
 	RequestChan chan int
 	NumMessages int
 	WindowSize int
-	Worker *worker.Worker
+	// one per outstanding request, since a worker only makes one call at a time
+	Workers []*worker.Worker
 }
 
 var Requests WorkerRequests
 
-func makeCall(requestNum int) {
+func makeCall(requestNum int, slot int) {
 	//log.Printf("In make call with requestNum %d", requestNum)
+	w := Requests.Workers[slot]
 	start := time.Now()
 	if requestNum % 2 == 0 {
-		Requests.Worker.Push("work")
+		w.Push("work")
 	} else {
-		Requests.Worker.Pop()
+		w.Pop()
 	}
 	
 	end := time.Since(start)
 	Requests.RequestTimes[requestNum] = Times{start, end}
-	Requests.RequestChan <- requestNum
+	Requests.RequestChan <- slot
 }
 //sends specified number of messages to server, with a designated window size
 func RunTest() {
@@ -47,9 +55,9 @@ func RunTest() {
 
 	sent := 0
 	// make initial windowSize calls
-	for i := 0 ; i < Requests.WindowSize ; i++ {
+	for i := 0 ; i < Requests.WindowSize && sent < Requests.NumMessages ; i++ {
 		curr := sent
-		go makeCall(curr)
+		go makeCall(curr, i)
 		sent++
 	}
 
@@ -57,12 +65,12 @@ func RunTest() {
 	received := 0
 	for {
 		select {
-		case <-Requests.RequestChan:
+		case slot := <-Requests.RequestChan:
 			received++
 			//log.Printf("Received response for message %d", c)
 			if (sent < Requests.NumMessages) {
 				curr := sent
-				go makeCall(curr)
+				go makeCall(curr, slot)
 				sent++	
 			}
 			if (received == Requests.NumMessages) {
@@ -125,11 +133,24 @@ func main() {
     // fmt.Printf("Num Messages: %d, Window Size: %d\n",
     //	Requests.NumMessages, Requests.WindowSize)
 
-    Requests.Worker, err = worker.NewWorker(strings.Fields(*s), *id, *uid)
-    if (err != nil) {
-    	log.Fatalf("Failed to create worker with error %v", err)
+    Requests.Workers = make([]*worker.Worker, *wS)
+    for i := range Requests.Workers {
+        Requests.Workers[i], err = worker.NewWorker(strings.Fields(*s), *id, fmt.Sprintf("%s.%d", *uid, i))
+        if (err != nil) {
+            log.Fatalf("Failed to create worker with error %v", err)
+        }
     }
+    testStart := time.Now()
     RunTest()
+    elapsed := time.Since(testStart)
+
+    var total time.Duration
+    for _, v := range(Requests.RequestTimes) {
+        total += v.Duration
+    }
+    fmt.Printf("%d requests with window %d in %v: %.0f requests/s, mean latency %v\n",
+        Requests.NumMessages, Requests.WindowSize, elapsed,
+        float64(Requests.NumMessages)/elapsed.Seconds(), total/time.Duration(Requests.NumMessages))
 
     start := Requests.RequestTimes[0].StartTime
     for i, v := range(Requests.RequestTimes) {
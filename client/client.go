@@ -1,9 +1,11 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/mgentili/goPhat/level_log"
+	"net"
 	"net/rpc"
 	"os"
 	"time"
@@ -35,6 +37,11 @@ func (c *Client) SetupClientLog() {
 // NewClient creates a new client connected to the server with given id
 // and attempts to connect to the master server
 func NewClient(servers []string, id uint, uid string) (*Client, error) {
+	return NewClientContext(context.Background(), servers, id, uid)
+}
+
+// NewClientContext is NewClient, but gives up on connecting once ctx is done
+func NewClientContext(ctx context.Context, servers []string, id uint, uid string) (*Client, error) {
 
 	c := new(Client)
 
@@ -44,13 +51,13 @@ func NewClient(servers []string, id uint, uid string) (*Client, error) {
 	c.MasterId = 0
 	c.Uid = uid
 	c.SetupClientLog()
-	err := c.ConnectToServer(id)
+	err := c.ConnectToServerContext(ctx, id)
 	if err != nil {
 		c.Log.Printf(DEBUG, "NewClient failed to connect client to server with id %d, error %s", id, err.Error())
 		return nil, err
 	}
 
-	err = c.ConnectToMaster()
+	err = c.ConnectToMasterContext(ctx)
 	if err != nil {
 		c.Log.Printf(DEBUG, "NewClient failed to connect client to the master server, error %s", err.Error())
 		return c, err
@@ -61,30 +68,47 @@ func NewClient(servers []string, id uint, uid string) (*Client, error) {
 
 // connectToAnyServer connects client to server with given index
 func (c *Client) ConnectToServer(index uint) error {
+	return c.ConnectToServerContext(context.Background(), index)
+}
+
+// ConnectToServerContext is ConnectToServer, but gives up once ctx is done
+func (c *Client) ConnectToServerContext(ctx context.Context, index uint) error {
 	c.Log.Printf(STATUS, "Trying to connect to server %d", index)
-	client, err := rpc.Dial("tcp", c.ServerLocations[index])
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.ServerLocations[index])
 	if err != nil {
 		return err
 	}
 
 	c.Id = index
-	c.RpcClient = client
+	c.RpcClient = rpc.NewClient(conn)
 	return nil
 }
 
 // connectToMaster connects client to the current master node
 func (c *Client) ConnectToMaster() error {
+	return c.ConnectToMasterContext(context.Background())
+}
+
+// ConnectToMasterContext is ConnectToMaster, but gives up once ctx is done
+func (c *Client) ConnectToMasterContext(ctx context.Context) error {
 	c.Log.Printf(STATUS, "Trying to connect to master %d", c.MasterId)
 	//connect to any server, and get the master id
 loop:
 	for i := uint(0); i < c.NumServers; i = i + 1 {
 		timer := time.NewTimer(time.Second)
-		call := c.RpcClient.Go("Server.GetMaster", new(struct{}), &c.MasterId, nil)
+		var masterId uint
+		call := c.RpcClient.Go("Server.GetMaster", new(struct{}), &masterId, nil)
 		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
 		case <-timer.C:
 			c.Log.Printf(DEBUG, "GetMaster timed out!")
 		case <-call.Done:
+			timer.Stop()
 			if call.Error == nil {
+				c.MasterId = masterId
 				c.Log.Printf(STATUS, "The master is %d", c.MasterId)
 				break loop
 			} else {
@@ -93,15 +117,17 @@ loop:
 		}
 
 		//if problem with RPC or server is in recovery, need to connect to different server
-		time.Sleep(time.Second)
-		c.ConnectToServer((c.Id + uint(i+1)) % c.NumServers)
+		if err := sleep(ctx, time.Second); err != nil {
+			return err
+		}
+		c.ConnectToServerContext(ctx, (c.Id+uint(i+1))%c.NumServers)
 	}
 
 	// If the currently connected server isn't the master, connect to master
 	if c.MasterId != c.Id {
 		c.Log.Printf(STATUS, "Called Server.GetMaster, current master id is %d, my id is %d",
 			c.MasterId, c.Id)
-		err := c.ConnectToServer(c.MasterId)
+		err := c.ConnectToServerContext(ctx, c.MasterId)
 		if err != nil {
 			return err
 		}
@@ -113,29 +139,71 @@ loop:
 
 // processCallWithRetry tries to make a client call until a timeout triggers
 // retries happen when the RPC call fails
+// args are resent unchanged on every retry, so callers that need exactly-once
+// semantics should tag them with a sequence number (see phatRPC.ClientCommand)
 func (c *Client) ProcessCallWithRetry(RPCCall string, args interface{}, reply interface{}) error {
-	timer := time.NewTimer(DefaultTimeout)
-	giveupTimer := time.NewTimer(DefaultTimeout * 10)
+	return c.ProcessCallWithTimeout(RPCCall, args, reply, DefaultTimeout)
+}
+
+// ProcessCallWithRetryContext is ProcessCallWithRetry, but gives up once ctx is done
+// (and only then, if ctx has a deadline)
+func (c *Client) ProcessCallWithRetryContext(ctx context.Context, RPCCall string, args interface{}, reply interface{}) error {
+	return c.ProcessCallWithTimeoutContext(ctx, RPCCall, args, reply, DefaultTimeout)
+}
+
+// ProcessCallWithTimeout is like ProcessCallWithRetry, but waits up to timeout for
+// each attempt, for calls the server may legitimately hold on to (e.g. long polls)
+func (c *Client) ProcessCallWithTimeout(RPCCall string, args interface{}, reply interface{}, timeout time.Duration) error {
+	return c.ProcessCallWithTimeoutContext(context.Background(), RPCCall, args, reply, timeout)
+}
+
+// ProcessCallWithTimeoutContext is ProcessCallWithTimeout, but gives up once ctx is
+// done. Without a deadline on ctx, it also gives up after 10 timeouts, as ever
+func (c *Client) ProcessCallWithTimeoutContext(ctx context.Context, RPCCall string, args interface{}, reply interface{}, timeout time.Duration) error {
+	giveup := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		giveup, cancel = context.WithTimeout(ctx, timeout*10)
+		defer cancel()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	//c.Log.Printf(DEBUG, "Type is %v, %v", reflect.TypeOf(args), reflect.TypeOf(reply))
 	for {
 		dbCall := c.RpcClient.Go(RPCCall, args, reply, nil)
 		select {
-		case <-giveupTimer.C:
+		case <-giveup.Done():
 			c.Log.Printf(DEBUG, "Client completely giving up on this call")
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return errors.New("Completely timed out")
 		case <-timer.C:
 			c.Log.Printf(DEBUG, "Single call timed out")
-			c.ConnectToMaster()
-			timer.Reset(DefaultTimeout)
+			c.ConnectToMasterContext(giveup)
+			timer.Reset(timeout)
 		case <-dbCall.Done:
 			if dbCall.Error == nil {
 				c.Log.Printf(STATUS, "Call done with no error")
 				return nil
 			}
 			c.Log.Printf(DEBUG, "Call failed with error %v", dbCall.Error)
-			time.Sleep(DefaultTimeout / 10)
-			//error possibilities 1) network failure 2) server can't process request
-			c.ConnectToMaster()
+			if sleep(giveup, DefaultTimeout/10) == nil {
+				//error possibilities 1) network failure 2) server can't process request
+				c.ConnectToMasterContext(giveup)
+			}
 		}
 	}
 }
+
+// sleep sleeps for d, unless ctx is done first, in which case it returns ctx's error
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/mgentili/goPhat/level_log"
+	"github.com/mgentili/goPhat/phatRPC"
 	"github.com/mgentili/goPhat/phatclient"
 	"github.com/mgentili/goPhat/phatdb"
 	"net/rpc"
@@ -271,7 +272,7 @@ func (t *TestMaster) EnsureEqualHash() {
 	for i, loc := range t.RPC_Locations {
 		if t.ReplicaStatus[i] == ALIVE {
 			client, _ := rpc.Dial("tcp", loc)
-			args := &phatdb.DBCommand{"SHA256", "", ""}
+			args := &phatRPC.ClientCommand{Command: &phatdb.DBCommand{Command: "SHA256"}}
 			reply := &phatdb.DBResponse{}
 			dbCall := client.Go("Server.RPCDB", args, reply, nil)
 			t.log.Printf(DEBUG, "SHA256: Requesting SHA256 from %v", loc)
@@ -0,0 +1,279 @@
+package phatRPC
+
+// Client caching. The master keeps track of which nodes each session caches, and
+// before committing a write, tells every other session caching a node the write
+// changes to drop it, then waits until they've acknowledged (or their cache lease
+// has run out). Sessions hear about invalidations by long polling
+// Server.PollInvalidations, which also renews their lease: a client must stop
+// trusting its cache CACHE_LEASE after it sent its last successful poll.
+// None of this is replicated, so a new master waits out every lease the old
+// one might have handed out before it commits any writes
+
+import (
+	"context"
+	"errors"
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+	"strings"
+	"time"
+)
+
+const (
+	CACHE_LEASE = vr.LEASE / 2
+	// longest a poll with nothing to report is held
+	POLL_INTERVAL = CACHE_LEASE / 4
+)
+
+type PollArgs struct {
+	SessionId string
+	// the session has dropped every invalidated node up to this sequence number
+	Acked uint
+}
+
+type PollReply struct {
+	// a different view means a different master, which knows nothing about
+	// what the session had cached
+	View  uint
+	Seq   uint
+	Paths []string
+}
+
+type invalidation struct {
+	Seq  uint
+	Path string
+}
+
+type cacheSession struct {
+	Paths   map[string]bool
+	Pending []invalidation
+	// sequence number of the latest invalidation, and the latest one acknowledged
+	Seq    uint
+	Acked  uint
+	Expiry time.Time
+	// wakes up the session's poll
+	Wake chan bool
+}
+
+func (sess *cacheSession) ack(seq uint) {
+	// (acks from before the session was last forgotten are meaningless)
+	if seq <= sess.Acked || seq > sess.Seq {
+		return
+	}
+	sess.Acked = seq
+	for len(sess.Pending) > 0 && sess.Pending[0].Seq <= seq {
+		sess.Pending = sess.Pending[1:]
+	}
+}
+
+// invalidate drops the node from the session's cache, and returns the
+// sequence number the session has to acknowledge
+func (sess *cacheSession) invalidate(path string) uint {
+	delete(sess.Paths, path)
+	sess.Seq++
+	sess.Pending = append(sess.Pending, invalidation{sess.Seq, path})
+	select {
+	case sess.Wake <- true:
+	default:
+	}
+	return sess.Seq
+}
+
+// CleanPath is the canonical form of a node's path, e.g. "/dev/null" for "dev//null/"
+func CleanPath(path string) string {
+	return "/" + strings.Join(phatdb.GetNodePath(path), "/")
+}
+
+// ancestors returns the paths of the (clean) path's parent, its parent and so on
+func ancestors(path string) []string {
+	var paths []string
+	for path != "/" {
+		path = path[:strings.LastIndex(path, "/")]
+		if path == "" {
+			path = "/"
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// changedBy returns the nodes a write changes directly
+func changedBy(cmd *phatdb.DBCommand) []string {
+	path := CleanPath(cmd.Path)
+	if cmd.Command == "SET" {
+		return []string{path}
+	}
+	// creating or deleting a node changes its parents' children (and
+	// creating can create the parents)
+	return append(ancestors(path), path)
+}
+
+// WriteAffects is whether a write changes what reading the node at (clean) path returns
+func WriteAffects(cmd *phatdb.DBCommand, path string) bool {
+	for _, p := range changedBy(cmd) {
+		if p == path {
+			return true
+		}
+	}
+	// (deleting a node also deletes everything under it)
+	return cmd.Command == "DELETE" && strings.HasPrefix(path, CleanPath(cmd.Path)+"/")
+}
+
+// checkCacheView forgets every session if the view has changed since we last
+// looked, i.e. we've (re)become master. The caller must hold CacheLock
+func (s *Server) checkCacheView() {
+	view := s.ReplicaServer.View()
+	if view != s.CacheView || s.CacheSince.IsZero() {
+		s.Caches = make(map[string]*cacheSession)
+		s.CacheView = view
+		s.CacheSince = s.ReplicaServer.MasterSince()
+		if s.CacheSince.IsZero() {
+			s.CacheSince = time.Now()
+		}
+	}
+}
+
+// expireCaches forgets every session whose cache lease has run out, since it's
+// stopped trusting its cache (and might never poll again), at most once every
+// CACHE_LEASE. The caller must hold CacheLock
+func (s *Server) expireCaches(now time.Time) {
+	if now.Before(s.CacheSwept.Add(CACHE_LEASE)) {
+		return
+	}
+	s.CacheSwept = now
+	for id, sess := range s.Caches {
+		if now.After(sess.Expiry) {
+			delete(s.Caches, id)
+		}
+	}
+}
+
+// cacheChanged wakes up writes waiting for acknowledgements. The caller must hold CacheLock
+func (s *Server) cacheChanged() {
+	close(s.CacheChanged)
+	s.CacheChanged = make(chan bool)
+}
+
+// PollInvalidations renews the session's cache lease, and returns the nodes it
+// has to drop from its cache, waiting up to POLL_INTERVAL for there to be some
+func (s *Server) PollInvalidations(args *PollArgs, reply *PollReply) error {
+	if !s.ReplicaServer.HasLease() {
+		return errors.New("Not master node")
+	}
+	s.CacheLock.Lock()
+	defer s.CacheLock.Unlock()
+	s.checkCacheView()
+	// (sessions are only ever added here, so this is as often as we need to look for old ones)
+	s.expireCaches(time.Now())
+	sess := s.Caches[args.SessionId]
+	if sess == nil {
+		sess = &cacheSession{Paths: make(map[string]bool), Wake: make(chan bool, 1)}
+		s.Caches[args.SessionId] = sess
+	}
+	sess.ack(args.Acked)
+	sess.Expiry = time.Now().Add(CACHE_LEASE)
+	s.cacheChanged()
+
+	if len(sess.Pending) == 0 {
+		s.CacheLock.Unlock()
+		select {
+		case <-sess.Wake:
+		case <-time.After(POLL_INTERVAL):
+		}
+		s.CacheLock.Lock()
+	}
+	reply.View = s.CacheView
+	reply.Seq = sess.Seq
+	for _, inv := range sess.Pending {
+		reply.Paths = append(reply.Paths, inv.Path)
+	}
+	return nil
+}
+
+// cacheRead registers that the session will cache the node it's reading (and so
+// must be read after this), unless a write that changes the node is underway
+func (s *Server) cacheRead(sessionId string, path string) bool {
+	path = CleanPath(path)
+	s.CacheLock.Lock()
+	defer s.CacheLock.Unlock()
+	s.checkCacheView()
+	sess := s.Caches[sessionId]
+	if sess == nil || time.Now().After(sess.Expiry) {
+		return false
+	}
+	// (the write might be deleting one of its parents)
+	for _, p := range append(ancestors(path), path) {
+		if s.Writing[p] > 0 {
+			return false
+		}
+	}
+	sess.Paths[path] = true
+	return true
+}
+
+// invalidate tells every session but the writer's that caches a node the write
+// changes to drop it, and waits until they all have (or ctx is done, which is
+// an error). The returned func must be called once the write has committed (or failed)
+func (s *Server) invalidate(ctx context.Context, writer string, cmd *phatdb.DBCommand) (func(), error) {
+	changed := changedBy(cmd)
+	done := func() {
+		s.CacheLock.Lock()
+		for _, p := range changed {
+			s.Writing[p]--
+			if s.Writing[p] == 0 {
+				delete(s.Writing, p)
+			}
+		}
+		s.CacheLock.Unlock()
+	}
+	s.CacheLock.Lock()
+	s.checkCacheView()
+	for _, p := range changed {
+		s.Writing[p]++
+	}
+	waiting := make(map[string]uint)
+	for id, sess := range s.Caches {
+		if id == writer {
+			continue
+		}
+		for p := range sess.Paths {
+			if WriteAffects(cmd, p) {
+				waiting[id] = sess.invalidate(p)
+			}
+		}
+	}
+
+	for {
+		// (and right after an election, clients might still trust leases
+		// from the last master)
+		deadline := s.CacheSince.Add(CACHE_LEASE)
+		for id, seq := range waiting {
+			sess := s.Caches[id]
+			if sess == nil || sess.Acked >= seq {
+				delete(waiting, id)
+			} else if time.Now().After(sess.Expiry) {
+				// it's stopped trusting its cache, so we can forget it
+				delete(s.Caches, id)
+				delete(waiting, id)
+			} else if sess.Expiry.After(deadline) {
+				deadline = sess.Expiry
+			}
+		}
+		wait := deadline.Sub(time.Now())
+		if len(waiting) == 0 && wait <= 0 {
+			break
+		}
+		changes := s.CacheChanged
+		s.CacheLock.Unlock()
+		select {
+		case <-changes:
+		case <-time.After(wait):
+		case <-ctx.Done():
+			// the writer has given up on the write, so nothing's waiting for it to go ahead
+			done()
+			return nil, ctx.Err()
+		}
+		s.CacheLock.Lock()
+	}
+	s.CacheLock.Unlock()
+	return done, nil
+}
@@ -0,0 +1,33 @@
+package phatRPC
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireCaches(t *testing.T) {
+	s := new(Server)
+	now := time.Now()
+	s.Caches = map[string]*cacheSession{
+		"gone":   {Paths: map[string]bool{"/dev/null": true}, Expiry: now.Add(-time.Second)},
+		"active": {Paths: map[string]bool{"/dev/null": true}, Expiry: now.Add(CACHE_LEASE)},
+	}
+	// a session that's stopped polling is forgotten even though nothing writes what it cached
+	s.expireCaches(now)
+	if _, ok := s.Caches["gone"]; ok {
+		t.Error("Session whose lease ran out wasn't forgotten")
+	}
+	if _, ok := s.Caches["active"]; !ok {
+		t.Error("Session with a lease was forgotten")
+	}
+	// (sweeps are spaced out)
+	s.Caches["active"].Expiry = now
+	s.expireCaches(now.Add(CACHE_LEASE / 2))
+	if _, ok := s.Caches["active"]; !ok {
+		t.Error("Sessions swept again straight away")
+	}
+	s.expireCaches(now.Add(CACHE_LEASE))
+	if _, ok := s.Caches["active"]; ok {
+		t.Error("Session whose lease ran out wasn't forgotten at the next sweep")
+	}
+}
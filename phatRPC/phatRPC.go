@@ -1,6 +1,8 @@
 package phatRPC
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -10,9 +12,19 @@ import (
 	"net"
 	"net/rpc"
 	"os"
+	"sync"
+	"time"
 )
 
-const DEBUG = 0
+const (
+	DEBUG = 0
+	// longest a replica holds a read waiting to commit up to the read's MinCommit
+	// (followers hear about commits at least every heartbeat, LEASE/RENEW_FACTOR)
+	MAX_COMMIT_WAIT = vr.LEASE
+	// sessions we haven't heard from for this long are dropped from the client
+	// table, so a retry of one of their writes after that would be applied again
+	CLIENT_EXPIRY = time.Hour
+)
 
 var RPC_log *level_log.Logger
 
@@ -24,31 +36,135 @@ var RPC_log *level_log.Logger
 }*/
 
 type Server struct {
-	ReplicaServer   *vr.Replica
-	InputChan       chan phatdb.DBCommandWithChannel
+	ReplicaServer *vr.Replica
+	DB            vr.StateMachine
+	// commits ClientCommands to the DB
+	Replicated      *vr.ReplicatedStateMachine
 	ClientListeners map[int](chan int)
+	// most recent committed request (and its result) for each client session.
+	// it's only ever updated by commits, so every replica ends up with the same table
+	ClientTable map[string]ClientTableEntry
+	// earliest commit time at which we next look for sessions to expire
+	NextExpiry      time.Time
+	ClientTableLock sync.Mutex
+	// which sessions cache which nodes, while we're master (see cache.go)
+	Caches     map[string]*cacheSession
+	CacheView  uint
+	CacheSince time.Time
+	// when we last forgot the sessions whose cache lease had run out
+	CacheSwept time.Time
+	// nodes with writes underway, which mustn't be cached until they're done
+	Writing      map[string]int
+	CacheChanged chan bool
+	CacheLock    sync.Mutex
+}
+
+type ClientTableEntry struct {
+	SeqNumber uint
+	Response  *phatdb.DBResponse
+	// time of the session's latest write
+	LastSeen time.Time
+}
+
+// ClientCommand is what clients send to RPCDB. A client session should only
+// have one outstanding request at a time, and retries of a request must reuse
+// its SeqNumber so the server can recognize them as duplicates.
+// An empty SessionId opts out of duplicate detection.
+type ClientCommand struct {
+	SessionId string
+	SeqNumber uint
+	Command   *phatdb.DBCommand
+	// if set, a read may be answered by a replica other than the master
+	Read *ReadOptions
+	// the session wants to cache the result of a GET or CHILDREN
+	Cache bool
+	// when the client gives up on the request (zero for never), after which
+	// we stop waiting on its behalf
+	Deadline time.Time
+	// when the master logged the request (clients leave it unset). Every replica
+	// expires sessions by this, so they all keep the same client table
+	Time time.Time
+}
+
+// ReadOptions opts a read (GET, CHILDREN, EXISTS or STAT) in to being answered by any
+// replica in normal status. The replica refuses unless it has committed at least
+// MinCommit (e.g. a session token), waiting up to MAX_COMMIT_WAIT for it, and if
+// MaxStaleness isn't 0, was up to date with the master at most MaxStaleness ago
+type ReadOptions struct {
+	MinCommit    uint
+	MaxStaleness time.Duration
 }
 
 type Null struct{}
 
-// wraps a DB command to conform to the vr.Command interface
-type CommandFunctor struct {
-	Command phatdb.DBCommandWithChannel
+// committedDB is the state VR replicates: the DB, plus the client table so
+// that a retry which was logged after the original committed isn't applied twice
+type committedDB struct {
+	s *Server
+}
+
+func (c committedDB) Apply(command interface{}) interface{} {
+	cmd, ok := command.(ClientCommand)
+	if !ok {
+		return &phatdb.DBResponse{Error: "Not a ClientCommand"}
+	}
+	result, err := c.s.checkClientTable(cmd.SessionId, cmd.SeqNumber)
+	if err != nil {
+		return &phatdb.DBResponse{Error: err.Error()}
+	}
+	if result == nil {
+		result = c.s.DB.Apply(cmd.Command).(*phatdb.DBResponse)
+		c.s.updateClientTable(cmd.SessionId, cmd.SeqNumber, result, cmd.Time)
+	}
+	return result
+}
+
+// what a committedDB snapshot holds
+type committedSnapshot struct {
+	DB          []byte
+	ClientTable map[string]ClientTableEntry
+	NextExpiry  time.Time
 }
 
-func (c CommandFunctor) CommitFunc(context interface{}) {
-	server := context.(*Server)
-	argsWithChannel := c.Command
-	// we make our own DBCommandWithChannel so we (VR) can make sure the DB has committed before continuing on
-	newArgsWithChannel := phatdb.DBCommandWithChannel{argsWithChannel.Cmd, make(chan *phatdb.DBResponse)}
-	server.InputChan <- newArgsWithChannel
-	// wait til the DB has actually committed the transaction
-	result := <-newArgsWithChannel.Done
-	// and pass the result along to the server-side RPC
-	// (if we're not master .Done will be nil since channels aren't passed over RPC)
-	if argsWithChannel.Done != nil {
-		argsWithChannel.Done <- result
+// Snapshot snapshots the DB and the client table together (VR doesn't commit anything
+// while it takes a snapshot, so they're from the same commit)
+func (c committedDB) Snapshot(index func() uint) ([]byte, uint, error) {
+	db, i, err := c.s.DB.Snapshot(index)
+	if err != nil {
+		return nil, 0, err
+	}
+	snapshot := committedSnapshot{DB: db, ClientTable: make(map[string]ClientTableEntry)}
+	c.s.ClientTableLock.Lock()
+	for k, v := range c.s.ClientTable {
+		snapshot.ClientTable[k] = v
+	}
+	snapshot.NextExpiry = c.s.NextExpiry
+	c.s.ClientTableLock.Unlock()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), i, nil
+}
+
+// Restore replaces the DB and the client table with a snapshot's (leaving both
+// as they were if it can't be decoded)
+func (c committedDB) Restore(data []byte) error {
+	var snapshot committedSnapshot
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&snapshot); err != nil {
+		return err
+	}
+	if err := c.s.DB.Restore(snapshot.DB); err != nil {
+		return err
+	}
+	// (gob leaves out empty maps)
+	if snapshot.ClientTable == nil {
+		snapshot.ClientTable = make(map[string]ClientTableEntry)
 	}
+	c.s.ClientTableLock.Lock()
+	c.s.ClientTable, c.s.NextExpiry = snapshot.ClientTable, snapshot.NextExpiry
+	c.s.ClientTableLock.Unlock()
+	return nil
 }
 
 func (s *Server) debug(level int, format string, args ...interface{}) {
@@ -58,9 +174,7 @@ func (s *Server) debug(level int, format string, args ...interface{}) {
 
 // startDB starts the database for the server
 func (s *Server) startDB() {
-	input := make(chan phatdb.DBCommandWithChannel)
-	s.InputChan = input
-	go phatdb.DatabaseServer(input)
+	s.DB = phatdb.NewStateMachine()
 }
 
 func SetupRPCLog() {
@@ -82,8 +196,11 @@ func StartServer(address string, replica *vr.Replica) (*rpc.Server, error) {
 
 	serve := new(Server)
 	serve.ReplicaServer = replica
+	serve.ClientTable = make(map[string]ClientTableEntry)
+	serve.Writing = make(map[string]int)
+	serve.CacheChanged = make(chan bool)
 	serve.startDB()
-	replica.Context = serve
+	serve.Replicated = vr.Replicate(replica, committedDB{serve})
 
 	newServer := rpc.NewServer()
 	err = newServer.Register(serve)
@@ -91,25 +208,31 @@ func StartServer(address string, replica *vr.Replica) (*rpc.Server, error) {
 		return nil, err
 	}
 
+	registerTypes()
+
+	serve.debug(DEBUG, "Server at %s trying to accept new client connections\n", address)
+	go newServer.Accept(listener)
+	//log.Println("Accepted new connection?")
+	return newServer, nil
+}
+
+func registerTypes() {
 	// have to gob.Register this struct so we can pass it through RPC
 	// as a generic interface{} (I don't understand the details that well,
 	// see http://stackoverflow.com/questions/21934730/gob-type-not-registered-for-interface-mapstringinterface)
-	gob.Register(CommandFunctor{})
-	gob.Register(phatdb.DBCommandWithChannel{})
+	gob.Register(ClientCommand{})
 	// Need to register all types that are returned within the DBResponse
+	// (which includes the ones in snapshots of the client table), and the
+	// DBResponse itself, which a follower gets back from the master as an interface{}
+	gob.Register(phatdb.DBResponse{})
 	gob.Register(phatdb.DataNode{})
 	gob.Register(phatdb.StatNode{})
-
-	serve.debug(DEBUG, "Server at %s trying to accept new client connections\n", address)
-	go newServer.Accept(listener)
-	//log.Println("Accepted new connection?")
-	return newServer, nil
 }
 
 // GetMaster returns the address of the current master replica
 func (s *Server) GetMaster(args *Null, reply *uint) error {
 	//if in recovery state, error
-	if s.ReplicaServer.Rstate.Status != vr.Normal {
+	if s.ReplicaServer.Status() != vr.Normal {
 		return errors.New("Master Failover")
 	}
 
@@ -117,9 +240,64 @@ func (s *Server) GetMaster(args *Null, reply *uint) error {
 	return nil
 }
 
+// checkClientTable returns the cached response if the given request has already
+// been committed, or an error if the client has since moved on to a newer request
+func (s *Server) checkClientTable(sessionId string, seqNumber uint) (*phatdb.DBResponse, error) {
+	if sessionId == "" {
+		return nil, nil
+	}
+	s.ClientTableLock.Lock()
+	defer s.ClientTableLock.Unlock()
+	if res, ok := s.ClientTable[sessionId]; ok {
+		if seqNumber < res.SeqNumber {
+			return nil, errors.New("Old Request")
+		}
+		if seqNumber == res.SeqNumber {
+			return res.Response, nil
+		}
+	}
+	return nil, nil
+}
+
+// updateClientTable records the response to a session's request, committed at now
+func (s *Server) updateClientTable(sessionId string, seqNumber uint, response *phatdb.DBResponse, now time.Time) {
+	if sessionId == "" {
+		return
+	}
+	s.ClientTableLock.Lock()
+	defer s.ClientTableLock.Unlock()
+	entry := ClientTableEntry{SeqNumber: seqNumber, Response: response, LastSeen: now}
+	// (a retry logged earlier by an old master mustn't make the session look older)
+	if old, ok := s.ClientTable[sessionId]; ok && old.LastSeen.After(now) {
+		entry.LastSeen = old.LastSeen
+	}
+	s.ClientTable[sessionId] = entry
+	s.expireClients(now)
+}
+
+// expireClients forgets sessions we haven't heard from for CLIENT_EXPIRY. It only looks
+// every CLIENT_EXPIRY/10, and must be called with the ClientTableLock held
+func (s *Server) expireClients(now time.Time) {
+	if now.IsZero() || now.Before(s.NextExpiry) {
+		return
+	}
+	for id, entry := range s.ClientTable {
+		if now.Sub(entry.LastSeen) > CLIENT_EXPIRY {
+			delete(s.ClientTable, id)
+		}
+	}
+	s.NextExpiry = now.Add(CLIENT_EXPIRY / 10)
+}
+
 // RPCDB processes an RPC call sent by client
-func (s *Server) RPCDB(args *phatdb.DBCommand, reply *phatdb.DBResponse) error {
-	if s.ReplicaServer.Rstate.Status != vr.Normal {
+func (s *Server) RPCDB(clientArgs *ClientCommand, reply *phatdb.DBResponse) error {
+	ctx, cancel := vr.DeadlineContext(clientArgs.Deadline)
+	defer cancel()
+	args := clientArgs.Command
+	if clientArgs.Read != nil && isRead(args.Command) {
+		return s.followerRead(ctx, clientArgs, reply)
+	}
+	if s.ReplicaServer.Status() != vr.Normal {
 		return errors.New("Master Failover")
 	}
 
@@ -134,28 +312,92 @@ func (s *Server) RPCDB(args *phatdb.DBCommand, reply *phatdb.DBResponse) error {
 		reply.Reply = MasterId
 		return errors.New("Not master node")
 	} else {
-		argsWithChannel := phatdb.DBCommandWithChannel{args, make(chan *phatdb.DBResponse, 1)}
 		switch args.Command {
 		//if the command is a write, then we need to go through paxos
-		case "CREATE", "DELETE", "SET", "GET":
-			s.ReplicaServer.RunVR(CommandFunctor{argsWithChannel})
-			s.debug(DEBUG, "Command committed, waiting for DB response")
-			result := <-argsWithChannel.Done
-			*reply = *result
+		case "CREATE", "DELETE", "SET":
+			// if this is a retry of a request that already committed, reply with the original outcome
+			cached, err := s.checkClientTable(clientArgs.SessionId, clientArgs.SeqNumber)
+			if err != nil {
+				return err
+			}
+			if cached != nil {
+				s.debug(DEBUG, "Duplicate request %d from %s", clientArgs.SeqNumber, clientArgs.SessionId)
+				// (like a read: until we hold the lease, the last master might still
+				// be answering reads that don't reflect the write)
+				if !s.ReplicaServer.HasLease() {
+					return errors.New("No master lease")
+				}
+				*reply = *cached
+				// (it must have committed by now)
+				reply.CommitNumber, _ = s.ReplicaServer.Freshness()
+				return nil
+			}
+			done, err := s.invalidate(ctx, clientArgs.SessionId, args)
+			if err != nil {
+				return err
+			}
+			clientArgs.Time = time.Now()
+			result, opNumber, err := s.Replicated.SubmitOpContext(ctx, *clientArgs)
+			done()
+			if err != nil {
+				return err
+			}
+			s.debug(DEBUG, "Command committed")
+			*reply = *result.(*phatdb.DBResponse)
+			reply.CommitNumber = opNumber
 			s.debug(DEBUG, "Finished write-only")
 			//paxos(args)
 		default:
-			//for reads we can go directly to the DB
-			//TODO: make sure we have the master lease?
-			// (probably just requires making sure Rstate.Status==Normal because otherwise we wouldn't
-			// be considered master anymore)
+			//for reads we can go directly to the DB, as long as we have the master lease
+			// (otherwise a new master might have committed writes we haven't seen)
+			if args.Command != "SHA256" && !s.ReplicaServer.HasLease() {
+				s.debug(DEBUG, "No master lease, can't read")
+				return errors.New("No master lease")
+			}
 			s.debug(DEBUG, "Read-only command skips Paxos")
-			s.InputChan <- argsWithChannel
-			result := <-argsWithChannel.Done
+			// (our state is at least as new as the commit number from before the read)
+			cacheable := clientArgs.Cache && (args.Command == "GET" || args.Command == "CHILDREN") &&
+				s.cacheRead(clientArgs.SessionId, args.Path)
+			commitNumber, _ := s.ReplicaServer.Freshness()
+			result := s.DB.Apply(args).(*phatdb.DBResponse)
 			*reply = *result
+			reply.CommitNumber = commitNumber
+			reply.Cacheable = cacheable && reply.Error == ""
 
 			s.debug(DEBUG, "Finished read-only")
 		}
 	}
 	return nil
 }
+
+func isRead(command string) bool {
+	switch command {
+	case "GET", "CHILDREN", "EXISTS", "STAT":
+		return true
+	}
+	return false
+}
+
+// followerRead answers a read from our own copy of the DB, if it's fresh enough
+func (s *Server) followerRead(ctx context.Context, clientArgs *ClientCommand, reply *phatdb.DBResponse) error {
+	opts := clientArgs.Read
+	ctx, cancel := context.WithTimeout(ctx, MAX_COMMIT_WAIT)
+	defer cancel()
+	if !s.ReplicaServer.WaitForCommitContext(ctx, opts.MinCommit) {
+		s.debug(DEBUG, "Gave up waiting to commit %d", opts.MinCommit)
+	}
+	commitNumber, upToDate := s.ReplicaServer.Freshness()
+	if upToDate.IsZero() {
+		return errors.New("Not up to date with master")
+	}
+	if commitNumber < opts.MinCommit {
+		return fmt.Errorf("Only committed up to %d", commitNumber)
+	}
+	if opts.MaxStaleness > 0 && time.Since(upToDate) > opts.MaxStaleness {
+		return errors.New("Too stale")
+	}
+	s.debug(DEBUG, "Follower read at commit %d", commitNumber)
+	*reply = *s.DB.Apply(clientArgs.Command).(*phatdb.DBResponse)
+	reply.CommitNumber = commitNumber
+	return nil
+}
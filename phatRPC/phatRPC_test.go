@@ -0,0 +1,122 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/phatdb"
+	"testing"
+	"time"
+)
+
+func commit(s *Server, cmd *phatdb.DBCommand, sessionId string, seqNumber uint) *phatdb.DBResponse {
+	return commitAt(s, cmd, sessionId, seqNumber, time.Time{})
+}
+
+// commitAt commits cmd as if the master logged it at now
+func commitAt(s *Server, cmd *phatdb.DBCommand, sessionId string, seqNumber uint, now time.Time) *phatdb.DBResponse {
+	args := ClientCommand{SessionId: sessionId, SeqNumber: seqNumber, Command: cmd, Time: now}
+	return committedDB{s}.Apply(args).(*phatdb.DBResponse)
+}
+
+func TestDuplicateCommit(t *testing.T) {
+	s := new(Server)
+	s.ClientTable = make(map[string]ClientTableEntry)
+	s.startDB()
+	//
+	createCmd := &phatdb.DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"}
+	if resp := commit(s, createCmd, "c1", 1); resp.Error != "" {
+		t.Errorf("CREATE that should work has failed: %s", resp.Error)
+	}
+	// A retry of the same request should get the original outcome
+	if resp := commit(s, createCmd, "c1", 1); resp.Error != "" || resp.Reply.(*phatdb.DataNode).Value != "empty" {
+		t.Errorf("Retried CREATE returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// ...even if the node has changed since then
+	if resp := commit(s, &phatdb.DBCommand{Command: "SET", Path: "/dev/null", Value: "full"}, "c2", 1); resp.Error != "" {
+		t.Errorf("SET fails with %s", resp.Error)
+	}
+	if resp := commit(s, createCmd, "c1", 1); resp.Error != "" || resp.Reply.(*phatdb.DataNode).Value != "empty" {
+		t.Errorf("Retried CREATE returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// A new request from the same session is applied as normal
+	if resp := commit(s, createCmd, "c1", 2); resp.Error == "" {
+		t.Errorf("CREATE has succeeded even though file already exists")
+	}
+	// Requests older than the latest one are rejected
+	if resp := commit(s, createCmd, "c1", 1); resp.Error == "" {
+		t.Errorf("Old request was not rejected")
+	}
+	// Requests without a session are never deduplicated
+	if resp := commit(s, createCmd, "", 0); resp.Error == "" {
+		t.Errorf("CREATE has succeeded even though file already exists")
+	}
+}
+
+func TestDuplicateAfterRestore(t *testing.T) {
+	registerTypes()
+	s := new(Server)
+	s.ClientTable = make(map[string]ClientTableEntry)
+	s.startDB()
+	createCmd := &phatdb.DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"}
+	commit(s, createCmd, "c1", 1)
+	data, _, err := committedDB{s}.Snapshot(func() uint { return 1 })
+	if err != nil {
+		t.Fatalf("Snapshot fails with %s", err)
+	}
+	// a replica that gets the DB by state transfer gets the client table with it
+	restored := new(Server)
+	restored.ClientTable = make(map[string]ClientTableEntry)
+	restored.startDB()
+	if err := (committedDB{restored}).Restore(data); err != nil {
+		t.Fatalf("Restore fails with %s", err)
+	}
+	commit(restored, &phatdb.DBCommand{Command: "SET", Path: "/dev/null", Value: "full"}, "c2", 1)
+	// so a retry isn't applied again, and gets the original outcome
+	if resp := commit(restored, createCmd, "c1", 1); resp.Error != "" {
+		t.Errorf("Retried CREATE returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	if resp := commit(restored, &phatdb.DBCommand{Command: "GET", Path: "/dev/null"}, "", 0); resp.Reply.(*phatdb.DataNode).Value != "full" {
+		t.Errorf("Retried CREATE was applied again: %v", resp.Reply)
+	}
+	if err := (committedDB{restored}).Restore(data[:len(data)-1]); err == nil {
+		t.Errorf("Restoring a truncated snapshot should fail")
+	}
+}
+
+func TestClientTableExpiry(t *testing.T) {
+	registerTypes()
+	s := new(Server)
+	s.ClientTable = make(map[string]ClientTableEntry)
+	s.startDB()
+	start := time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC)
+	createCmd := &phatdb.DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"}
+	commitAt(s, createCmd, "idle", 1, start)
+	commitAt(s, &phatdb.DBCommand{Command: "CREATE", Path: "/dev/zero"}, "busy", 1, start)
+	// a session that keeps writing stays in the table
+	for i := uint(2); i <= 10; i++ {
+		now := start.Add(time.Duration(i) * CLIENT_EXPIRY / 8)
+		commitAt(s, &phatdb.DBCommand{Command: "SET", Path: "/dev/zero", Value: "x"}, "busy", i, now)
+	}
+	if _, ok := s.ClientTable["busy"]; !ok {
+		t.Errorf("Session that's still writing was expired")
+	}
+	if _, ok := s.ClientTable["idle"]; ok {
+		t.Errorf("Session not seen for %v is still in the client table", 10*CLIENT_EXPIRY/8)
+	}
+	// so a retry from the forgotten session is applied again
+	if resp := commitAt(s, createCmd, "idle", 1, start.Add(2*CLIENT_EXPIRY)); resp.Error == "" {
+		t.Errorf("Retry from an expired session got the original outcome")
+	}
+	// replicas restored from a snapshot expire sessions at the same times
+	data, _, err := committedDB{s}.Snapshot(func() uint { return 1 })
+	if err != nil {
+		t.Fatalf("Snapshot fails with %s", err)
+	}
+	restored := new(Server)
+	restored.startDB()
+	if err := (committedDB{restored}).Restore(data); err != nil {
+		t.Fatalf("Restore fails with %s", err)
+	}
+	if !restored.NextExpiry.Equal(s.NextExpiry) || len(restored.ClientTable) != len(s.ClientTable) {
+		t.Errorf("Restored client table %v (next expiry %v), expected %v (next expiry %v)",
+			restored.ClientTable, restored.NextExpiry, s.ClientTable, s.NextExpiry)
+	}
+}
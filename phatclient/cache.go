@@ -0,0 +1,165 @@
+package phatclient
+
+import (
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatRPC"
+	"github.com/mgentili/goPhat/phatdb"
+	"sync"
+	"time"
+)
+
+// nodeCache holds GET and CHILDREN replies from the master, for as long as the
+// master has promised to tell us before they change (see phatRPC/cache.go)
+type nodeCache struct {
+	lock    sync.Mutex
+	replies map[cacheKey]phatdb.DBResponse
+	// bumped by every invalidation, so a read that raced with one doesn't cache its result
+	epoch uint
+	// we can only trust the cache until then
+	expiry time.Time
+	view   uint
+	acked  uint
+	stop   chan bool
+}
+
+type cacheKey struct {
+	Command string
+	Path    string
+}
+
+func cacheable(cmd *phatdb.DBCommand) bool {
+	return cmd.Command == "GET" || cmd.Command == "CHILDREN"
+}
+
+// EnableCache makes GetData and GetChildren cache what they read from the master
+func (c *PhatClient) EnableCache() error {
+	if c.cache != nil {
+		return nil
+	}
+	// invalidations get a connection of their own, since they're long polled
+	cli, err := client.NewClient(c.Cli.ServerLocations, c.Cli.MasterId, c.Cli.Uid+".cache")
+	if err != nil {
+		return err
+	}
+	c.cache = &nodeCache{replies: make(map[cacheKey]phatdb.DBResponse), stop: make(chan bool)}
+	go c.cache.poll(cli, c.SessionId)
+	return nil
+}
+
+func (c *PhatClient) DisableCache() {
+	if c.cache != nil {
+		close(c.cache.stop)
+		c.cache = nil
+	}
+}
+
+// poll keeps asking the master for invalidations (which renews our lease on the cache)
+func (nc *nodeCache) poll(cli *client.Client, sessionId string) {
+	defer func() { cli.RpcClient.Close() }()
+	for {
+		nc.lock.Lock()
+		args := &phatRPC.PollArgs{SessionId: sessionId, Acked: nc.acked}
+		nc.lock.Unlock()
+		reply := &phatRPC.PollReply{}
+		sent := time.Now()
+		call := cli.RpcClient.Go("Server.PollInvalidations", args, reply, nil)
+		select {
+		case <-nc.stop:
+			return
+		case <-call.Done:
+			if call.Error == nil {
+				nc.update(sent, reply)
+				continue
+			}
+			cli.Log.Printf(client.DEBUG, "Polling for invalidations failed with %v", call.Error)
+		case <-time.After(phatRPC.POLL_INTERVAL + ServerTimeout):
+			cli.Log.Printf(client.DEBUG, "Polling for invalidations timed out")
+		}
+		nc.flush()
+		time.Sleep(phatRPC.POLL_INTERVAL)
+		cli.ConnectToMaster()
+	}
+}
+
+func (nc *nodeCache) update(sent time.Time, reply *phatRPC.PollReply) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if reply.View != nc.view || time.Now().After(nc.expiry) {
+		// a new master (which doesn't know what we've cached), or we went
+		// long enough without hearing from this one that it's forgotten
+		nc.flushLocked()
+		nc.view = reply.View
+	}
+	for _, path := range reply.Paths {
+		nc.dropLocked(func(key cacheKey) bool { return key.Path == path })
+	}
+	nc.acked = reply.Seq
+	nc.expiry = sent.Add(phatRPC.CACHE_LEASE)
+}
+
+func (nc *nodeCache) flush() {
+	nc.lock.Lock()
+	nc.flushLocked()
+	nc.lock.Unlock()
+}
+
+func (nc *nodeCache) flushLocked() {
+	nc.dropLocked(func(key cacheKey) bool { return true })
+}
+
+func (nc *nodeCache) dropLocked(matches func(cacheKey) bool) {
+	for key := range nc.replies {
+		if matches(key) {
+			delete(nc.replies, key)
+		}
+	}
+	nc.epoch++
+}
+
+// dropWrite drops everything one of our own writes changes (the master
+// doesn't send us invalidations for them)
+func (nc *nodeCache) dropWrite(cmd *phatdb.DBCommand) {
+	nc.lock.Lock()
+	nc.dropLocked(func(key cacheKey) bool { return phatRPC.WriteAffects(cmd, key.Path) })
+	nc.lock.Unlock()
+}
+
+func (nc *nodeCache) get(cmd *phatdb.DBCommand) (*phatdb.DBResponse, bool) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if time.Now().After(nc.expiry) {
+		nc.flushLocked()
+		return nil, false
+	}
+	reply, ok := nc.replies[cacheKey{cmd.Command, phatRPC.CleanPath(cmd.Path)}]
+	if !ok {
+		return nil, false
+	}
+	return copyReply(reply), true
+}
+
+// copyReply copies a reply deeply enough that callers can't change what's cached
+func copyReply(reply phatdb.DBResponse) *phatdb.DBResponse {
+	switch v := reply.Reply.(type) {
+	case phatdb.DataNode:
+		reply.Reply = *v.Copy()
+	case []string:
+		reply.Reply = append([]string{}, v...)
+	}
+	return &reply
+}
+
+// startRead returns what to pass to put once the read's done
+func (nc *nodeCache) startRead() uint {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	return nc.epoch
+}
+
+func (nc *nodeCache) put(cmd *phatdb.DBCommand, reply *phatdb.DBResponse, epoch uint) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if epoch == nc.epoch && time.Now().Before(nc.expiry) {
+		nc.replies[cacheKey{cmd.Command, phatRPC.CleanPath(cmd.Path)}] = *copyReply(*reply)
+	}
+}
@@ -1,10 +1,15 @@
 package phatclient
 
 import (
+	"context"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatRPC"
 	"github.com/mgentili/goPhat/phatdb"
+	"net"
+	"net/rpc"
 	"time"
 )
 
@@ -18,7 +23,17 @@ const (
 )
 
 type PhatClient struct {
-	Cli *client.Client
+	Cli       *client.Client
+	SessionId string // identifies this client's requests to the server's client table
+	SeqNumber uint   // sequence number of the most recently sent request
+	// highest op number any reply has reflected (i.e. at least our latest write).
+	// Replicas other than the master wait until they've committed it before answering reads
+	SessionToken uint
+	// if set by ReadFrom, reads go to this replica first (and to the master if it refuses)
+	Reader      *rpc.Client
+	ReadOptions phatRPC.ReadOptions
+	// nil unless EnableCache has been called
+	cache *nodeCache
 }
 
 func (c *PhatClient) debug(level int, format string, args ...interface{}) {
@@ -35,9 +50,18 @@ func StringToError(s string) error {
 // NewClient creates a new client connected to the server with given id
 // and attempts to connect to the master server
 func NewClient(servers []string, id uint, uid string) (*PhatClient, error) {
+	return NewClientContext(context.Background(), servers, id, uid)
+}
+
+// NewClientContext is NewClient, but gives up on connecting once ctx is done.
+// Each of the client's calls has a ...Context variant too, which gives up (and
+// tells the server to stop waiting on its behalf) once the context is done
+func NewClientContext(ctx context.Context, servers []string, id uint, uid string) (*PhatClient, error) {
 	var err error
 	c := new(PhatClient)
-	c.Cli, err = client.NewClient(servers, id, uid)
+	// the uid alone isn't enough, since a restarted client would reuse old sequence numbers
+	c.SessionId = fmt.Sprintf("%s.%d", uid, time.Now().UnixNano())
+	c.Cli, err = client.NewClientContext(ctx, servers, id, uid)
 	if err != nil {
 		return nil, err
 	}
@@ -50,51 +74,129 @@ func NewClient(servers []string, id uint, uid string) (*PhatClient, error) {
 	return c, nil
 }
 
-// processCallWithRetry tries to make a client call until a timeout triggers
-// retries happen when the RPC call fails
-func (c *PhatClient) processCallWithRetry(args *phatdb.DBCommand) (*phatdb.DBResponse, error) {
-	reply := &phatdb.DBResponse{}
-	timer := time.NewTimer(DefaultTimeout)
-	giveupTimer := time.NewTimer(DefaultTimeout * 10)
+// newRequest tags a command with the next sequence number for this session (and
+// ctx's deadline). Retries must resend the returned request as-is so the server
+// can detect duplicates
+func (c *PhatClient) newRequest(ctx context.Context, cmd *phatdb.DBCommand) *phatRPC.ClientCommand {
+	c.SeqNumber++
+	deadline, _ := ctx.Deadline()
+	return &phatRPC.ClientCommand{SessionId: c.SessionId, SeqNumber: c.SeqNumber, Command: cmd, Deadline: deadline}
+}
+
+// newWrite is newRequest for writes, which also drop what they change from our cache
+func (c *PhatClient) newWrite(ctx context.Context, cmd *phatdb.DBCommand) *phatRPC.ClientCommand {
+	if c.cache != nil {
+		c.cache.dropWrite(cmd)
+	}
+	return c.newRequest(ctx, cmd)
+}
+
+// ReadFrom sends GetData, GetChildren, GetStats and Exists to the given replica,
+// which answers them as long as it's within the bounds of opts
+func (c *PhatClient) ReadFrom(id uint, opts phatRPC.ReadOptions) error {
+	return c.ReadFromContext(context.Background(), id, opts)
+}
+
+// ReadFromContext is ReadFrom, but gives up on connecting to the replica once ctx is done
+func (c *PhatClient) ReadFromContext(ctx context.Context, id uint, opts phatRPC.ReadOptions) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Cli.ServerLocations[id])
+	if err != nil {
+		return err
+	}
+	if c.Reader != nil {
+		c.Reader.Close()
+	}
+	c.Reader = rpc.NewClient(conn)
+	c.ReadOptions = opts
+	return nil
+}
 
-	var replyErr error
+// sawCommit keeps track of the session token
+func (c *PhatClient) sawCommit(reply *phatdb.DBResponse) {
+	if reply.CommitNumber > c.SessionToken {
+		c.SessionToken = reply.CommitNumber
+	}
+}
 
-	for {
-		dbCall := c.Cli.RpcClient.Go("Server.RPCDB", args, reply, nil)
+// read tries the replica we're reading from, if any, and otherwise (or if it's too
+// far behind) asks the master like any other call
+func (c *PhatClient) read(ctx context.Context, cmd *phatdb.DBCommand) (*phatdb.DBResponse, error) {
+	if c.cache != nil && cacheable(cmd) {
+		// (only the master can tell us when what we've cached changes)
+		if reply, ok := c.cache.get(cmd); ok {
+			return reply, nil
+		}
+		epoch := c.cache.startRead()
+		args := c.newRequest(ctx, cmd)
+		args.Cache = true
+		reply, err := c.processRequest(ctx, args)
+		if err == nil && reply.Cacheable {
+			c.cache.put(cmd, reply, epoch)
+		}
+		return reply, err
+	}
+	if c.Reader != nil {
+		args := c.newRequest(ctx, cmd)
+		opts := c.ReadOptions
+		if c.SessionToken > opts.MinCommit {
+			opts.MinCommit = c.SessionToken
+		}
+		args.Read = &opts
+		reply := &phatdb.DBResponse{}
+		call := c.Reader.Go("Server.RPCDB", args, reply, nil)
 		select {
-		case <-giveupTimer.C:
-			c.debug(DEBUG, "Client completely giving up on this call")
-			return nil, errors.New("Completely timed out")
-		case <-timer.C:
-			c.debug(DEBUG, "Single call timed out")
-			c.Cli.ConnectToMaster()
-			timer.Reset(DefaultTimeout)
-		case <-dbCall.Done:
-			if dbCall.Error == nil {
-				c.debug(STATUS, "Call done with no error")
-				replyErr = StringToError(reply.Error)
-				if replyErr != nil {
-					return nil, replyErr
+		case <-call.Done:
+			if call.Error == nil {
+				c.sawCommit(reply)
+				if err := StringToError(reply.Error); err != nil {
+					return nil, err
 				}
 				return reply, nil
 			}
-			c.debug(DEBUG, "Call failed with error %v", dbCall.Error)
-			time.Sleep(DefaultTimeout / 10)
-			//error possibilities 1) network failure 2) server can't process request
-			c.Cli.ConnectToMaster()
+			c.debug(DEBUG, "Replica couldn't answer read: %v", call.Error)
+		case <-time.After(ServerTimeout + phatRPC.MAX_COMMIT_WAIT):
+			c.debug(DEBUG, "Read from replica timed out")
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
+	return c.processCallWithRetry(ctx, cmd)
+}
+
+// processCallWithRetry tries to make a client call until a timeout triggers
+// retries happen when the RPC call fails
+func (c *PhatClient) processCallWithRetry(ctx context.Context, cmd *phatdb.DBCommand) (*phatdb.DBResponse, error) {
+	return c.processRequest(ctx, c.newRequest(ctx, cmd))
+}
+
+func (c *PhatClient) processRequest(ctx context.Context, args *phatRPC.ClientCommand) (*phatdb.DBResponse, error) {
+	reply := &phatdb.DBResponse{}
+	err := c.Cli.ProcessCallWithTimeoutContext(ctx, "Server.RPCDB", args, reply, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.sawCommit(reply)
+	if replyErr := StringToError(reply.Error); replyErr != nil {
+		return nil, replyErr
+	}
+	return reply, nil
 }
 
 func (c *PhatClient) Create(subpath string, initialdata string) (*phatdb.DataNode, error) {
+	return c.CreateContext(context.Background(), subpath, initialdata)
+}
+
+func (c *PhatClient) CreateContext(ctx context.Context, subpath string, initialdata string) (*phatdb.DataNode, error) {
 	c.debug(STATUS, "Creating file %s with data %s", subpath, initialdata)
-	args := &phatdb.DBCommand{"CREATE", subpath, initialdata}
+	args := c.newWrite(ctx, &phatdb.DBCommand{Command: "CREATE", Path: subpath, Value: initialdata})
 	reply := &phatdb.DBResponse{}
-	err := c.Cli.ProcessCallWithRetry("Server.RPCDB", args, reply)
+	err := c.Cli.ProcessCallWithRetryContext(ctx, "Server.RPCDB", args, reply)
 	if err != nil {
 		c.debug(DEBUG, "Create file %s errored %s", subpath, err)
 		return nil, err
 	}
+	c.sawCommit(reply)
 	replyErr := StringToError(reply.Error)
 	if replyErr != nil {
 		c.debug(DEBUG, "Create file %s errored %s", subpath, replyErr)
@@ -106,30 +208,33 @@ func (c *PhatClient) Create(subpath string, initialdata string) (*phatdb.DataNod
 }
 
 func (c *PhatClient) GetData(subpath string) (*phatdb.DataNode, error) {
-	args := &phatdb.DBCommand{"GET", subpath, ""}
-	reply := &phatdb.DBResponse{}
-	err := c.Cli.ProcessCallWithRetry("Server.RPCDB", args, reply)
+	return c.GetDataContext(context.Background(), subpath)
+}
+
+func (c *PhatClient) GetDataContext(ctx context.Context, subpath string) (*phatdb.DataNode, error) {
+	reply, err := c.read(ctx, &phatdb.DBCommand{Command: "GET", Path: subpath})
 	if err != nil {
+		c.debug(DEBUG, "Get file %s errored %s", subpath, err)
 		return nil, err
 	}
-	replyErr := StringToError(reply.Error)
-	if replyErr != nil {
-		c.debug(DEBUG, "Get file %s errored %s", subpath, replyErr)
-		return nil, replyErr
-	}
 	n := reply.Reply.(phatdb.DataNode)
 
 	return &n, err
 }
 
 func (c *PhatClient) SetData(subpath string, data string) error {
+	return c.SetDataContext(context.Background(), subpath, data)
+}
+
+func (c *PhatClient) SetDataContext(ctx context.Context, subpath string, data string) error {
 	c.debug(STATUS, "Setting Data")
-	args := &phatdb.DBCommand{"SET", subpath, data}
+	args := c.newWrite(ctx, &phatdb.DBCommand{Command: "SET", Path: subpath, Value: data})
 	reply := &phatdb.DBResponse{}
-	err := c.Cli.ProcessCallWithRetry("Server.RPCDB", args, reply)
+	err := c.Cli.ProcessCallWithRetryContext(ctx, "Server.RPCDB", args, reply)
 	if err != nil {
 		return err
 	}
+	c.sawCommit(reply)
 	replyErr := StringToError(reply.Error)
 	if replyErr != nil {
 		c.debug(DEBUG, "Set file %s errored %s", subpath, replyErr)
@@ -139,8 +244,12 @@ func (c *PhatClient) SetData(subpath string, data string) error {
 }
 
 func (c *PhatClient) GetChildren(subpath string) ([]string, error) {
-	args := &phatdb.DBCommand{"CHILDREN", subpath, ""}
-	reply, err := c.processCallWithRetry(args)
+	return c.GetChildrenContext(context.Background(), subpath)
+}
+
+func (c *PhatClient) GetChildrenContext(ctx context.Context, subpath string) ([]string, error) {
+	args := &phatdb.DBCommand{Command: "CHILDREN", Path: subpath}
+	reply, err := c.read(ctx, args)
 	if err != nil {
 		return nil, err
 	}
@@ -148,8 +257,12 @@ func (c *PhatClient) GetChildren(subpath string) ([]string, error) {
 }
 
 func (c *PhatClient) GetStats(subpath string) (*phatdb.StatNode, error) {
-	args := &phatdb.DBCommand{"STAT", subpath, ""}
-	reply, err := c.processCallWithRetry(args)
+	return c.GetStatsContext(context.Background(), subpath)
+}
+
+func (c *PhatClient) GetStatsContext(ctx context.Context, subpath string) (*phatdb.StatNode, error) {
+	args := &phatdb.DBCommand{Command: "STAT", Path: subpath}
+	reply, err := c.read(ctx, args)
 	if err != nil {
 		return nil, err
 	}
@@ -157,16 +270,37 @@ func (c *PhatClient) GetStats(subpath string) (*phatdb.StatNode, error) {
 	return &n, err
 }
 
+func (c *PhatClient) Exists(subpath string) (bool, error) {
+	return c.ExistsContext(context.Background(), subpath)
+}
+
+func (c *PhatClient) ExistsContext(ctx context.Context, subpath string) (bool, error) {
+	args := &phatdb.DBCommand{Command: "EXISTS", Path: subpath}
+	reply, err := c.read(ctx, args)
+	if err != nil {
+		return false, err
+	}
+	return reply.Reply.(bool), err
+}
+
 // Delete deletes a node if it doesn't have any children
 func (c *PhatClient) Delete(subpath string) error {
-	args := &phatdb.DBCommand{"DELETE", subpath, ""}
-	_, err := c.processCallWithRetry(args)
+	return c.DeleteContext(context.Background(), subpath)
+}
+
+func (c *PhatClient) DeleteContext(ctx context.Context, subpath string) error {
+	args := &phatdb.DBCommand{Command: "DELETE", Path: subpath}
+	_, err := c.processRequest(ctx, c.newWrite(ctx, args))
 	return err
 }
 
 func (c *PhatClient) GetHash() (string, error) {
-	args := &phatdb.DBCommand{"SHA256", "", ""}
-	reply, err := c.processCallWithRetry(args)
+	return c.GetHashContext(context.Background())
+}
+
+func (c *PhatClient) GetHashContext(ctx context.Context) (string, error) {
+	args := &phatdb.DBCommand{Command: "SHA256"}
+	reply, err := c.processCallWithRetry(ctx, args)
 	if err != nil {
 		return "", err
 	}
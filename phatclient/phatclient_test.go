@@ -1,11 +1,15 @@
 package phatclient
 
 import (
+	"context"
 	"fmt"
 	"github.com/mgentili/goPhat/phatRPC"
+	"github.com/mgentili/goPhat/phatdb"
 	"github.com/mgentili/goPhat/vr"
 	"log"
+	"sync"
 	"testing"
+	"time"
 )
 
 const BASE = 9000
@@ -13,11 +17,19 @@ const BASE = 9000
 var replica_config = []string{"127.0.0.1:9000", "127.0.0.1:9001", "127.0.0.1:9002"}
 var client_config = []string{"127.0.0.1:6000", "127.0.0.1:6001", "127.0.0.1:6002"}
 
+var startOnce sync.Once
+
+func startServers() {
+	startOnce.Do(func() {
+		for i := 0; i < 3; i = i + 1 {
+			newReplica := vr.RunAsReplica(uint(i), replica_config)
+			phatRPC.StartServer(client_config[i], newReplica)
+		}
+	})
+}
+
 func TestClientConnection(t *testing.T) {
-	for i := 0; i < 3; i = i + 1 {
-		newReplica := vr.RunAsReplica(uint(i), replica_config)
-		phatRPC.StartServer(client_config[i], newReplica)
-	}
+	startServers()
 
 	cli, err := NewClient(client_config, 1, "1unique")
 	if err != nil {
@@ -64,3 +76,154 @@ func TestClientConnection(t *testing.T) {
 		t.Errorf(fmt.Sprintf("Expected %s, got %s", "something", n.Value))
 	}
 }
+
+func TestFollowerReads(t *testing.T) {
+	startServers()
+	cli, err := NewClient(client_config, 0, "followerReads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.Create("/follow", "x"); err != nil {
+		t.Fatalf("Create fails with %s", err)
+	}
+	follower := (cli.Cli.MasterId + 1) % 3
+	if err = cli.ReadFrom(follower, phatRPC.ReadOptions{MaxStaleness: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	// the session token keeps us from reading from before our own write,
+	// even if the follower hasn't heard about the commit yet
+	if n, err := cli.GetData("/follow"); err != nil || n.Value != "x" {
+		t.Errorf("GetData returned %v (err: %v), expected x", n, err)
+	}
+	if ok, err := cli.Exists("/follow"); err != nil || !ok {
+		t.Errorf("Exists returned %v (err: %v)", ok, err)
+	}
+
+	read := func(opts phatRPC.ReadOptions) (*phatdb.DBResponse, error) {
+		reply := &phatdb.DBResponse{}
+		args := &phatRPC.ClientCommand{Command: &phatdb.DBCommand{Command: "GET", Path: "/follow"}, Read: &opts}
+		return reply, cli.Reader.Call("Server.RPCDB", args, reply)
+	}
+	// the follower itself waits until it has committed our write
+	if err = cli.SetData("/follow", "y"); err != nil {
+		t.Fatalf("SetData fails with %s", err)
+	}
+	if reply, err := read(phatRPC.ReadOptions{MinCommit: cli.SessionToken}); err != nil || reply.Reply.(phatdb.DataNode).Value != "y" {
+		t.Errorf("Follower read returned %v (err: %v), expected y", reply.Reply, err)
+	}
+
+	// and refuses reads it can't answer within the bounds
+	if _, err := read(phatRPC.ReadOptions{MinCommit: cli.SessionToken + 100}); err == nil {
+		t.Errorf("Follower answered a read from a commit it hasn't reached")
+	}
+	if _, err := read(phatRPC.ReadOptions{MaxStaleness: time.Nanosecond}); err == nil {
+		t.Errorf("Follower answered a read staler than allowed")
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	startServers()
+	a, err := NewClient(client_config, 0, "cacheA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewClient(client_config, 0, "cacheB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Create("/cached", "1"); err != nil {
+		t.Fatalf("Create fails with %s", err)
+	}
+	if err = a.EnableCache(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.DisableCache()
+	// wait for the master to answer our first poll
+	time.Sleep(phatRPC.POLL_INTERVAL + 100*time.Millisecond)
+	//
+	get := func(want string) {
+		if n, err := a.GetData("/cached"); err != nil || n.Value != want {
+			t.Errorf("GetData returned %v (err: %v), expected %s", n, err, want)
+		}
+	}
+	get("1")
+	if _, ok := a.cache.get(&phatdb.DBCommand{Command: "GET", Path: "/cached"}); !ok {
+		t.Errorf("GetData didn't cache /cached")
+	}
+	if _, err = a.GetChildren("/"); err != nil {
+		t.Errorf("GetChildren fails with %s", err)
+	}
+	// another client's write doesn't commit until we've dropped what it changes
+	if err = b.SetData("/cached", "2"); err != nil {
+		t.Fatalf("SetData fails with %s", err)
+	}
+	get("2")
+	if _, err = b.Create("/cached/child", ""); err != nil {
+		t.Fatalf("Create fails with %s", err)
+	}
+	if children, err := a.GetChildren("/cached"); err != nil || len(children) != 1 {
+		t.Errorf("GetChildren returned %v (err: %v), expected [child]", children, err)
+	}
+	// a client that stops polling holds up writes until its lease runs out
+	a.GetData("/cached")
+	a.DisableCache()
+	start := time.Now()
+	if err = b.SetData("/cached", "3"); err != nil {
+		t.Fatalf("SetData fails with %s", err)
+	}
+	if waited := time.Since(start); waited > phatRPC.CACHE_LEASE+time.Second {
+		t.Errorf("SetData waited %v for a client that stopped polling", waited)
+	}
+}
+
+func TestContext(t *testing.T) {
+	startServers()
+	a, err := NewClient(client_config, 0, "contextA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewClient(client_config, 0, "contextB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Create("/context", "1"); err != nil {
+		t.Fatalf("Create fails with %s", err)
+	}
+
+	// a follower waiting for a commit that isn't coming doesn't hold us up
+	reader, err := NewClient(client_config, 0, "contextReader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reader.ReadFrom((reader.Cli.MasterId+1)%3, phatRPC.ReadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	reader.SessionToken += 1000
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = reader.GetDataContext(ctx, "/context"); err != context.DeadlineExceeded {
+		t.Errorf("GetDataContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("GetDataContext took %v", waited)
+	}
+
+	// nor does a write waiting for a client that's stopped polling to drop its
+	// cache, and the master gives up on the write too
+	if err = a.EnableCache(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(phatRPC.POLL_INTERVAL + 100*time.Millisecond)
+	a.GetData("/context")
+	a.DisableCache()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err = b.SetDataContext(ctx, "/context", "2"); err == nil {
+		t.Errorf("SetDataContext succeeded while another client held the node in its cache")
+	}
+	time.Sleep(phatRPC.CACHE_LEASE)
+	if n, err := b.GetData("/context"); err != nil || n.Value != "1" {
+		t.Errorf("GetData returned %v (err: %v), expected the abandoned write not to have happened", n, err)
+	}
+}
@@ -1,6 +1,8 @@
 package phatdb
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"os"
 	"strings"
@@ -29,6 +31,12 @@ func (d *DataNode) GoString() string {
 	return fmt.Sprintf("<DN V=%#v Stats=%#v>", d.Value, d.Stats)
 }
 
+// Copy returns a snapshot of the node that later writes won't affect
+func (d *DataNode) Copy() *DataNode {
+	stats := *d.Stats
+	return &DataNode{d.Value, &stats}
+}
+
 type FileNode struct {
 	//Parent   *FileNode
 	Children map[string]*FileNode
@@ -137,3 +145,34 @@ func _setNode(n *FileNode, val string) {
 func hashNode(root *FileNode) string {
 	return fmt.Sprintf("%#v", root)
 }
+
+// encodeTree serializes the whole file system under root
+func encodeTree(root *FileNode) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(root)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeTree is the inverse of encodeTree
+func decodeTree(data []byte) (*FileNode, error) {
+	root := &FileNode{}
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(root)
+	if err != nil {
+		return nil, err
+	}
+	fillChildren(root)
+	return root, nil
+}
+
+// gob leaves out empty maps, but every node needs one (and the hash shows them)
+func fillChildren(n *FileNode) {
+	if n.Children == nil {
+		n.Children = make(map[string]*FileNode)
+	}
+	for _, child := range n.Children {
+		fillChildren(child)
+	}
+}
@@ -1,5 +1,9 @@
 package phatdb
 
+import (
+	"sync"
+)
+
 type DBCommand struct {
 	Command string
 	Path    string
@@ -9,6 +13,12 @@ type DBCommand struct {
 type DBResponse struct {
 	Reply interface{}
 	Error string
+	// filled in by phatRPC: a write's op number, or the commit number a read reflects
+	// at least. Clients pass the highest they've seen back as a session token,
+	// so they never read anything older than their own writes
+	CommitNumber uint
+	// filled in by phatRPC: the master will tell the client before the result changes
+	Cacheable bool
 }
 
 type DBCommandWithChannel struct {
@@ -18,60 +28,109 @@ type DBCommandWithChannel struct {
 
 func DatabaseServer(input chan DBCommandWithChannel) {
 	// Set up the root of the pseudo file system
-	root := &FileNode{}
-	root.Children = make(map[string]*FileNode)
+	root := newRoot()
 	// Enter the command loop
 	for {
 		request := <-input
-		req := request.Cmd
-		resp := &DBResponse{}
-		switch req.Command {
-		case "CHILDREN":
-			kids, err := getChildren(root, req.Path)
-			if err == nil {
-				resp.Reply = kids
-			} else {
-				resp.Error = err.Error()
-			}
-		case "CREATE":
-			n, err := createNode(root, req.Path, req.Value)
-			if err == nil {
-				resp.Reply = n
-			} else {
-				resp.Error = err.Error()
-			}
-		case "DELETE":
-			n, err := deleteNode(root, req.Path)
-			if err == nil {
-				resp.Reply = n
-			} else {
-				resp.Error = err.Error()
-			}
-		case "EXISTS":
-			n, err := existsNode(root, req.Path)
-			if err == nil {
-				resp.Reply = n
-			} else {
-				resp.Error = err.Error()
-			}
-		case "GET":
-			n, err := getNode(root, req.Path)
-			if err == nil {
-				resp.Reply = n
-			} else {
-				resp.Error = err.Error()
-			}
-		case "SET":
-			_, err := setNode(root, req.Path, req.Value)
-			// SET doesn't return any results on success
-			if err != nil {
-				resp.Error = err.Error()
-			}
-		case "SHA256":
-			resp.Reply = hashNode(root)
-		default:
-			resp.Error = "Unknown command"
+		request.Done <- apply(root, request.Cmd)
+	}
+}
+
+func newRoot() *FileNode {
+	root := &FileNode{}
+	root.Children = make(map[string]*FileNode)
+	return root
+}
+
+// apply runs a single command against the file system rooted at root
+func apply(root *FileNode, req *DBCommand) *DBResponse {
+	resp := &DBResponse{}
+	switch req.Command {
+	case "CHILDREN":
+		kids, err := getChildren(root, req.Path)
+		if err == nil {
+			resp.Reply = kids
+		} else {
+			resp.Error = err.Error()
+		}
+	case "CREATE":
+		n, err := createNode(root, req.Path, req.Value)
+		if err == nil {
+			resp.Reply = n.Copy()
+		} else {
+			resp.Error = err.Error()
+		}
+	case "DELETE":
+		n, err := deleteNode(root, req.Path)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "EXISTS":
+		n, err := existsNode(root, req.Path)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "GET":
+		n, err := getNode(root, req.Path)
+		if err == nil {
+			resp.Reply = n.Copy()
+		} else {
+			resp.Error = err.Error()
 		}
-		request.Done <- resp
+	case "SET":
+		_, err := setNode(root, req.Path, req.Value)
+		// SET doesn't return any results on success
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case "SHA256":
+		resp.Reply = hashNode(root)
+	default:
+		resp.Error = "Unknown command"
+	}
+	return resp
+}
+
+// StateMachine is the database as a vr.StateMachine. Apply takes a *DBCommand
+// and returns a *DBResponse
+type StateMachine struct {
+	root *FileNode
+	lock sync.Mutex
+}
+
+func NewStateMachine() *StateMachine {
+	return &StateMachine{root: newRoot()}
+}
+
+func (sm *StateMachine) Apply(command interface{}) interface{} {
+	req, ok := command.(*DBCommand)
+	if !ok {
+		return &DBResponse{Error: "Not a DBCommand"}
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return apply(sm.root, req)
+}
+
+func (sm *StateMachine) Snapshot(index func() uint) ([]byte, uint, error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	i := index()
+	data, err := encodeTree(sm.root)
+	return data, i, err
+}
+
+func (sm *StateMachine) Restore(data []byte) error {
+	root, err := decodeTree(data)
+	if err != nil {
+		return err
 	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.root = root
+	return nil
 }
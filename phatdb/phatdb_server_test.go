@@ -80,3 +80,30 @@ func TestDatabaseServer(t *testing.T) {
 		}
 	}
 }
+
+func TestStateMachineSnapshot(t *testing.T) {
+	sm := NewStateMachine()
+	sm.Apply(&DBCommand{"CREATE", "/dev/null", "empty"})
+	sm.Apply(&DBCommand{"CREATE", "/dev/random", "4"})
+	sm.Apply(&DBCommand{"SET", "/dev/random", "5"})
+	hash := sm.Apply(&DBCommand{"SHA256", "", ""}).(*DBResponse).Reply
+	//
+	data, index, err := sm.Snapshot(func() uint { return 7 })
+	if err != nil || index != 7 {
+		t.Fatalf("Snapshot returned index %d (err: %v)", index, err)
+	}
+	restored := NewStateMachine()
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("Restore fails with %s", err)
+	}
+	if resp := restored.Apply(&DBCommand{"SHA256", "", ""}).(*DBResponse); resp.Reply != hash {
+		t.Errorf("Restored hash %v doesn't match %v", resp.Reply, hash)
+	}
+	// the restored tree can still be written to, even where it was empty
+	if resp := restored.Apply(&DBCommand{"CREATE", "/dev/null/child", "x"}).(*DBResponse); resp.Error != "" {
+		t.Errorf("CREATE after restore fails with %s", resp.Error)
+	}
+	if resp := restored.Apply(&DBCommand{"GET", "/dev/random", ""}).(*DBResponse); resp.Reply.(*DataNode).Stats.Version != 2 {
+		t.Errorf("Restored node is %#v", resp.Reply)
+	}
+}
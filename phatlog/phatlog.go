@@ -44,6 +44,17 @@ func (l *Log) Add(index uint, command interface{}) {
 
 }
 
+// Copy returns a copy of the log, which can be changed (or sent) independently
+func (l *Log) Copy() *Log {
+	newLog := EmptyLog()
+	newLog.MaxIndex = l.MaxIndex
+	newLog.MinIndex = l.MinIndex
+	for i, command := range l.Commits {
+		newLog.Commits[i] = command
+	}
+	return newLog
+}
+
 func (l *Log) Suffix(newBegin uint) *Log {
     newLog := EmptyLog()
     newLog.MinIndex = newBegin
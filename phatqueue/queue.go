@@ -3,10 +3,88 @@ package phatqueue
 import "strconv"
 import "bytes"
 import "encoding/gob"
+import "errors"
+import "time"
+import "sort"
+
+const (
+	// how long a popped message stays in progress if the POP doesn't ask for a
+	// specific visibility timeout
+	DEFAULT_VISIBILITY_TIMEOUT = 30 * time.Second
+	// messages that expire after this many deliveries go to the dead letter queue
+	DEFAULT_MAX_DELIVERIES = 5
+)
 
 type QMessage struct {
 	MessageID string
 	Value     interface{}
+	// when an in progress message's lease runs out (zero while it's still queued)
+	Deadline time.Time
+	// number of times the message has been popped
+	Deliveries int
+	// higher priority messages are popped first
+	Priority int
+	// the message isn't handed out before this (master) time
+	NotBefore time.Time
+	// optional metadata for the consumer, e.g. "application/json" for a []byte Value
+	ContentType string
+	Headers     map[string]string
+	// when the message was pushed (master time)
+	EnqueueTime time.Time
+	// the client session the message is currently delivered to (empty while it's queued)
+	Owner string
+}
+
+// argument to PUSH, for messages that need a priority or a delay
+// (PUSH also takes a plain value, for a priority 0 message that's ready straight away)
+type QPush struct {
+	Value    interface{}
+	Priority int
+	// the message is ready at the later of NotBefore and the command's time plus Delay
+	NotBefore time.Time
+	Delay     time.Duration
+	// copied onto the message as is
+	ContentType string
+	Headers     map[string]string
+}
+
+// argument to POP_BATCH
+type QPopBatch struct {
+	Max     int
+	Timeout time.Duration // visibility timeout for every popped message
+	Wait    time.Duration // how long the server may hold the request if nothing is ready
+}
+
+// QPop is the optional argument to POP
+type QPop struct {
+	Timeout time.Duration // visibility timeout for the popped message
+	Wait    time.Duration // how long the server may hold the request if nothing is ready
+}
+
+// which messages LIST pages through
+const (
+	LIST_QUEUED      = "queued"
+	LIST_IN_PROGRESS = "in_progress"
+	LIST_DEAD_LETTER = "dead_letter"
+)
+
+// argument to LIST
+type QList struct {
+	Which  string // LIST_QUEUED (the default), LIST_IN_PROGRESS or LIST_DEAD_LETTER
+	Offset int
+	Limit  int
+}
+
+// reply to LIST
+type QListResult struct {
+	Messages []QMessage
+	Total    int // how many messages there are altogether, to page through the rest
+}
+
+// argument to the EXTEND command
+type QExtend struct {
+	MessageID string
+	Timeout   time.Duration
 }
 
 type LogEntry struct {
@@ -15,13 +93,22 @@ type LogEntry struct {
 }
 
 type MessageQueue struct {
+	// sorted by priority (highest first), and in FIFO order within a priority
 	Queue           []QMessage
 	InProgress      map[string]QMessage
 	Id              int
+	// messages that were never marked done after MaxDeliveries attempts
+	DeadLetter    []QMessage
+	MaxDeliveries int // 0 means retry forever
+	// lifetime counters, for stats
+	Pushed    uint64
+	Delivered uint64
+	Completed uint64
 }
 
 func (mq *MessageQueue) Init() {
 	mq.InProgress = make(map[string]QMessage)
+	mq.MaxDeliveries = DEFAULT_MAX_DELIVERIES
 }
 
 func (mq *MessageQueue) NextID() int {
@@ -29,35 +116,256 @@ func (mq *MessageQueue) NextID() int {
 	return mq.Id
 }
 
+// Copy returns a deep copy of the queue, which doesn't share anything with mq
+// that either of them modifies in place (message values and headers are never modified)
 func (mq *MessageQueue) Copy() (newmq *MessageQueue) {
-    newmq = new(MessageQueue)
-    newmq.Init()
+	newmq = new(MessageQueue)
+	newmq.Init()
 
-    // newmq.queue is initially empty so this effectively copies mq.queue to it
-    copy(newmq.Queue, mq.Queue)
-    for k, v := range mq.InProgress {
-        newmq.InProgress[k] = v
-    }
-    newmq.Id = mq.Id
-    return
+	newmq.Queue = append([]QMessage{}, mq.Queue...)
+	for k, v := range mq.InProgress {
+		newmq.InProgress[k] = v
+	}
+	newmq.Id = mq.Id
+	newmq.DeadLetter = append([]QMessage{}, mq.DeadLetter...)
+	newmq.MaxDeliveries = mq.MaxDeliveries
+	newmq.Pushed, newmq.Delivered, newmq.Completed = mq.Pushed, mq.Delivered, mq.Completed
+	return
 }
 
 func (mq *MessageQueue) Push(v interface{}) {
-	qm := QMessage{strconv.Itoa(mq.NextID()), v}
-	mq.Queue = append(mq.Queue, qm)
+	mq.PushWithOptions(v, 0, time.Time{})
 }
 
-func (mq *MessageQueue) Pop() *QMessage {
-	if mq.Len() == 0 {
+// PushWithOptions queues a message that won't be popped before notBefore, and is popped
+// ahead of any lower priority messages
+func (mq *MessageQueue) PushWithOptions(v interface{}, priority int, notBefore time.Time) {
+	mq.PushMessage(QMessage{Value: v, Priority: priority, NotBefore: notBefore})
+}
+
+// PushMessage queues a new message, giving it the next id
+func (mq *MessageQueue) PushMessage(qm QMessage) {
+	qm.MessageID = strconv.Itoa(mq.NextID())
+	mq.enqueue(qm)
+	mq.Pushed++
+}
+
+// enqueue inserts a message behind everything of the same or higher priority
+func (mq *MessageQueue) enqueue(qm QMessage) {
+	i := len(mq.Queue)
+	// in the common case everything has the same priority, so this doesn't loop at all
+	for i > 0 && mq.Queue[i-1].Priority < qm.Priority {
+		i--
+	}
+	mq.insert(i, qm)
+}
+
+// enqueueFront inserts a message ahead of everything of the same or lower priority
+func (mq *MessageQueue) enqueueFront(qm QMessage) {
+	i := 0
+	for i < len(mq.Queue) && mq.Queue[i].Priority > qm.Priority {
+		i++
+	}
+	mq.insert(i, qm)
+}
+
+func (mq *MessageQueue) insert(i int, qm QMessage) {
+	mq.Queue = append(mq.Queue, QMessage{})
+	copy(mq.Queue[i+1:], mq.Queue[i:])
+	mq.Queue[i] = qm
+}
+
+// Pop hands out the highest priority message that's ready at time now (the oldest
+// one, if there's a tie), and marks it in progress until now+timeout.
+// now should come from the command, not the local clock, so that every replica
+// makes the same choice and computes the same deadline
+func (mq *MessageQueue) Pop(now time.Time, timeout time.Duration) *QMessage {
+	i := mq.next(now)
+	if i < 0 {
 		return nil
 	}
-    var qm QMessage
-    qm, mq.Queue = mq.Queue[len(mq.Queue)-1], mq.Queue[:len(mq.Queue)-1]
+	qm := mq.Queue[i]
+	if i == 0 {
+		mq.Queue = mq.Queue[1:]
+	} else {
+		mq.Queue = append(mq.Queue[:i], mq.Queue[i+1:]...)
+	}
+	qm.Deadline = now.Add(timeout)
+	qm.Deliveries++
+	mq.Delivered++
+	mq.InProgress[qm.MessageID] = qm
 	return &qm
 }
 
-func (mq *MessageQueue) Done(mId string) {
+// Peek returns the message Pop would hand out at time now, without popping it
+func (mq *MessageQueue) Peek(now time.Time) *QMessage {
+	i := mq.next(now)
+	if i < 0 {
+		return nil
+	}
+	qm := mq.Queue[i]
+	return &qm
+}
+
+// next is the index of the first message that's ready at time now, or -1
+func (mq *MessageQueue) next(now time.Time) int {
+	for i, qm := range mq.Queue {
+		if !qm.NotBefore.After(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// setOwner records which client an in progress message was delivered to
+func (mq *MessageQueue) setOwner(qm *QMessage, owner string) {
+	qm.Owner = owner
+	mq.InProgress[qm.MessageID] = *qm
+}
+
+// PopBatch pops up to max ready messages, in the same order repeated Pops would
+func (mq *MessageQueue) PopBatch(now time.Time, timeout time.Duration, max int) []QMessage {
+	popped := []QMessage{}
+	for len(popped) < max {
+		qm := mq.Pop(now, timeout)
+		if qm == nil {
+			break
+		}
+		popped = append(popped, *qm)
+	}
+	return popped
+}
+
+// Extend pushes back the deadline of an in progress message to now+timeout
+func (mq *MessageQueue) Extend(mId string, now time.Time, timeout time.Duration) error {
+	qm, ok := mq.InProgress[mId]
+	if !ok {
+		return errors.New("Message not in progress")
+	}
+	qm.Deadline = now.Add(timeout)
+	mq.InProgress[mId] = qm
+	return nil
+}
+
+// HasExpired reports whether any in progress message's lease has run out by now
+func (mq *MessageQueue) HasExpired(now time.Time) bool {
+	for _, v := range mq.InProgress {
+		if !v.Deadline.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequeueExpired moves every in progress message whose lease has run out by now
+// back to the front of the queue (oldest deadline first, within each priority), and returns their ids.
+// Messages that have used up all their deliveries go to the dead letter queue instead
+func (mq *MessageQueue) RequeueExpired(now time.Time) []string {
+	var expired []QMessage
+	for _, v := range mq.InProgress {
+		if !v.Deadline.After(now) {
+			expired = append(expired, v)
+		}
+	}
+	// sort so the order doesn't depend on map iteration
+	sort.Sort(ByDeadline(expired))
+	ids := make([]string, len(expired))
+	var requeued []QMessage
+	for i, qm := range expired {
+		ids[i] = qm.MessageID
+		delete(mq.InProgress, qm.MessageID)
+		qm.Deadline = time.Time{}
+		qm.Owner = ""
+		if mq.MaxDeliveries > 0 && qm.Deliveries >= mq.MaxDeliveries {
+			mq.DeadLetter = append(mq.DeadLetter, qm)
+		} else {
+			requeued = append(requeued, qm)
+		}
+	}
+	// go backwards so the oldest ends up first among its priority
+	for i := len(requeued) - 1; i >= 0; i-- {
+		mq.enqueueFront(requeued[i])
+	}
+	return ids
+}
+
+// ReplayDeadLetter puts the dead letter with the given id (or all of them if mId
+// is empty) back on the end of the queue with a fresh delivery count
+func (mq *MessageQueue) ReplayDeadLetter(mId string) int {
+	replayed := mq.removeDeadLetter(mId)
+	for _, qm := range replayed {
+		qm.Deliveries = 0
+		mq.enqueue(qm)
+	}
+	return len(replayed)
+}
+
+// PurgeDeadLetter drops the dead letter with the given id (or all of them if mId is empty)
+func (mq *MessageQueue) PurgeDeadLetter(mId string) int {
+	return len(mq.removeDeadLetter(mId))
+}
+
+func (mq *MessageQueue) removeDeadLetter(mId string) []QMessage {
+	removed := []QMessage{}
+	kept := []QMessage{}
+	for _, qm := range mq.DeadLetter {
+		if mId == "" || qm.MessageID == mId {
+			removed = append(removed, qm)
+		} else {
+			kept = append(kept, qm)
+		}
+	}
+	mq.DeadLetter = kept
+	return removed
+}
+
+// List returns up to limit of the queued, in progress or dead letter messages, starting
+// at offset, along with how many there are in total. Queued messages are in the order
+// they'll be popped, and the rest in the order they were pushed
+func (mq *MessageQueue) List(which string, offset int, limit int) ([]QMessage, int, error) {
+	var all []QMessage
+	switch which {
+	case LIST_QUEUED, "":
+		all = mq.Queue
+	case LIST_IN_PROGRESS:
+		for _, v := range mq.InProgress {
+			all = append(all, v)
+		}
+		sort.Sort(ByID(all))
+	case LIST_DEAD_LETTER:
+		all = mq.DeadLetter
+	default:
+		return nil, 0, errors.New("Unknown message list")
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(all) {
+		offset = len(all)
+	}
+	end := offset + limit
+	if limit < 0 || end > len(all) {
+		end = len(all)
+	}
+	return append([]QMessage{}, all[offset:end]...), len(all), nil
+}
+
+// Purge drops every queued and in progress message (but not dead letters) and
+// returns how many there were
+func (mq *MessageQueue) Purge() int {
+	n := len(mq.Queue) + len(mq.InProgress)
+	mq.Queue = []QMessage{}
+	mq.InProgress = make(map[string]QMessage)
+	return n
+}
+
+func (mq *MessageQueue) Done(mId string) error {
+	if _, ok := mq.InProgress[mId]; !ok {
+		return errors.New("Message not in progress")
+	}
 	delete(mq.InProgress, mId)
+	mq.Completed++
+	return nil
 }
 
 func (mq *MessageQueue) Len() int {
@@ -68,28 +376,60 @@ func (mq *MessageQueue) LenInProgress() int {
 	return len(mq.InProgress)
 }
 
-//recover the snapshot from disk
-func (mq *MessageQueue) RecoverSnapshot(snapshotBytes []byte) error {
-    dec := gob.NewDecoder(bytes.NewBuffer(snapshotBytes))
-	err := dec.Decode(&mq.Queue)
-	err = dec.Decode(&mq.InProgress)
-	err = dec.Decode(&mq.Id)
-	if err != nil {
-		return err
-    }
+func (mq *MessageQueue) LenDeadLetter() int {
+	return len(mq.DeadLetter)
+}
 
-    return nil
+// snapshotFields is what a snapshot of the queue holds, in order
+func (mq *MessageQueue) snapshotFields() []interface{} {
+	return []interface{}{&mq.Queue, &mq.InProgress, &mq.Id, &mq.DeadLetter,
+		&mq.MaxDeliveries, &mq.Pushed, &mq.Delivered, &mq.Completed}
+}
+
+//recover the snapshot from disk (leaving the queue as it was if that fails)
+func (mq *MessageQueue) RecoverSnapshot(snapshotBytes []byte) error {
+	restored := new(MessageQueue)
+	restored.Init()
+	dec := gob.NewDecoder(bytes.NewBuffer(snapshotBytes))
+	for _, field := range restored.snapshotFields() {
+		if err := dec.Decode(field); err != nil {
+			return err
+		}
+	}
+	*mq = *restored
+	return nil
 }
 
 //convert the queue to a byte slice
 func (mq *MessageQueue) Bytes() ([]byte, error) {
 	var queueState bytes.Buffer
 	enc := gob.NewEncoder(&queueState)
-	err := enc.Encode(mq.Queue)
-	err = enc.Encode(mq.InProgress)
-	err = enc.Encode(mq.Id)
-	if err != nil {
-		return nil, err
+	for _, field := range mq.snapshotFields() {
+		if err := enc.Encode(field); err != nil {
+			return nil, err
+		}
 	}
 	return queueState.Bytes(), nil
 }
+
+type ByDeadline []QMessage
+
+func (a ByDeadline) Len() int      { return len(a) }
+func (a ByDeadline) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByDeadline) Less(i, j int) bool {
+	if !a[i].Deadline.Equal(a[j].Deadline) {
+		return a[i].Deadline.Before(a[j].Deadline)
+	}
+	return lessID(a[i].MessageID, a[j].MessageID)
+}
+
+type ByID []QMessage
+
+func (a ByID) Len() int           { return len(a) }
+func (a ByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByID) Less(i, j int) bool { return lessID(a[i].MessageID, a[j].MessageID) }
+
+// ids are increasing integers, so a shorter one is always older
+func lessID(x, y string) bool {
+	return len(x) < len(y) || (len(x) == len(y) && x < y)
+}
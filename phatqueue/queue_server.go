@@ -1,16 +1,29 @@
 package phatqueue
 
 import (
-//	"fmt"
+	//	"fmt"
+	"errors"
+	"time"
 )
 
 const (
 	USE_COPY_ON_WRITE = true
+	// most messages a single PUSH_BATCH or POP_BATCH can handle
+	MAX_BATCH = 1000
 )
 
 type QCommand struct {
 	Command string
 	Value   interface{}
+	// the queue the command applies to (DEFAULT_QUEUE if empty)
+	Queue string
+	// set by the master when the command is submitted, so replicas agree on
+	// lease deadlines and which messages are ready (commands that need it fail without it)
+	Time time.Time
+	// the client session that sent the command and its sequence number, used to
+	// detect retries of commands that were already applied (no detection if Client is empty)
+	Client    string
+	SeqNumber uint
 }
 
 type QResponse struct {
@@ -28,75 +41,380 @@ type QSnapshot struct {
 	SnapshotIndex uint
 }
 
+// usesTime reports whether the command's result depends on its Time
+func usesTime(command string) bool {
+	switch command {
+	case "PUSH", "PUSH_BATCH", "POP", "POP_BATCH", "PEEK", "EXTEND", "HAS_EXPIRED", "REQUEUE_EXPIRED":
+		return true
+	}
+	return false
+}
+
+// IsWrite reports whether the command modifies the queues
+func IsWrite(command string) bool {
+	switch command {
+	case "PUSH", "PUSH_BATCH", "POP", "POP_BATCH", "PURGE", "DONE", "EXTEND", "REQUEUE_EXPIRED",
+		"DLQ_REPLAY", "DLQ_PURGE", "CREATE_QUEUE", "DELETE_QUEUE", "LOAD_SNAPSHOT":
+		return true
+	}
+	return false
+}
+
+// ValidPayload reports whether v can be stored as a message's value
+// (text as a string, or binary data as a []byte)
+func ValidPayload(v interface{}) bool {
+	switch v.(type) {
+	case string, []byte:
+		return true
+	}
+	return false
+}
+
+// NewMessage builds the (not yet numbered) message for a PUSH value, which is either
+// a plain payload or a QPush. now is the time the PUSH was submitted
+func NewMessage(value interface{}, now time.Time) (QMessage, error) {
+	switch v := value.(type) {
+	case QPush:
+		if !ValidPayload(v.Value) {
+			return QMessage{}, errors.New("Unsupported PUSH value")
+		}
+		notBefore := now.Add(v.Delay)
+		if v.NotBefore.After(notBefore) {
+			notBefore = v.NotBefore
+		}
+		return QMessage{Value: v.Value, Priority: v.Priority, NotBefore: notBefore,
+			ContentType: v.ContentType, Headers: v.Headers, EnqueueTime: now}, nil
+	default:
+		if !ValidPayload(v) {
+			return QMessage{}, errors.New("Unsupported PUSH value")
+		}
+		return QMessage{Value: v, EnqueueTime: now}, nil
+	}
+}
+
+// pushValue pushes a PUSH value, which is either a plain payload or a QPush
+func pushValue(mq *MessageQueue, req *QCommand, value interface{}) error {
+	qm, err := NewMessage(value, req.Time)
+	if err != nil {
+		return err
+	}
+	mq.PushMessage(qm)
+	return nil
+}
+
+// Apply runs a command on the set and returns the response. SNAPSHOT isn't handled
+// here, since how to take one depends on how the set is kept
+func (qs *QueueSet) Apply(req *QCommand) *QResponse {
+	resp := &QResponse{}
+
+	// a retry of something we've already done just gets the original response
+	if cached, err := qs.CheckClient(req); cached != nil || err != nil {
+		if err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		return cached
+	}
+
+	// (every replica has to use the same time, and the local clock isn't it)
+	if usesTime(req.Command) && req.Time.IsZero() {
+		resp.Error = "Command has no time"
+		return resp
+	}
+
+	// commands that deal with a single queue
+	var mq *MessageQueue
+	switch req.Command {
+	case "PUSH", "PUSH_BATCH", "POP", "POP_BATCH", "PEEK", "LIST", "PURGE", "DONE", "EXTEND",
+		"DLQ_LIST", "DLQ_REPLAY", "DLQ_PURGE", "LEN", "LEN_IN_PROGRESS", "LEN_DEAD_LETTER":
+		var err error
+		mq, err = qs.Get(req.Queue)
+		if err != nil {
+			resp.Error = err.Error()
+			qs.UpdateClient(req, resp)
+			return resp
+		}
+	}
+
+	waiting := false
+	switch req.Command {
+	case "CREATE_QUEUE":
+		newmq, err := qs.Create(req.Queue)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if maxDeliveries, ok := req.Value.(int); ok {
+			// the value is an optional limit on deliveries before dead lettering
+			newmq.MaxDeliveries = maxDeliveries
+		}
+	case "DELETE_QUEUE":
+		err := qs.Delete(req.Queue)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case "LIST_QUEUES":
+		resp.Reply = qs.Names()
+	case "STATS":
+		stats, err := qs.Stats(req.Queue)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Reply = stats
+		}
+	case "PUSH":
+		err := pushValue(mq, req, req.Value)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case "PUSH_BATCH":
+		// the whole batch is checked first, so it's pushed all or nothing
+		values, ok := req.Value.([]QPush)
+		if !ok || len(values) > MAX_BATCH {
+			resp.Error = "PUSH_BATCH takes a []QPush of at most MAX_BATCH messages"
+			break
+		}
+		for _, v := range values {
+			if !ValidPayload(v.Value) {
+				resp.Error = "Unsupported PUSH value"
+				break
+			}
+		}
+		if resp.Error != "" {
+			break
+		}
+		for _, v := range values {
+			pushValue(mq, req, v)
+		}
+	case "POP":
+		// the value is an optional visibility timeout or QPop
+		var args QPop
+		switch v := req.Value.(type) {
+		case time.Duration:
+			args.Timeout = v
+		case QPop:
+			args = v
+		}
+		timeout := args.Timeout
+		if timeout <= 0 {
+			timeout = DEFAULT_VISIBILITY_TIMEOUT
+		}
+		v := mq.Pop(req.Time, timeout)
+		if v != nil {
+			mq.setOwner(v, req.Client)
+			resp.Reply = v
+		} else {
+			resp.Error = "Nothing to pop"
+			waiting = args.Wait > 0
+		}
+	case "POP_BATCH":
+		args, ok := req.Value.(QPopBatch)
+		if !ok || args.Max <= 0 || args.Max > MAX_BATCH {
+			resp.Error = "POP_BATCH needs a QPopBatch with 0 < Max <= MAX_BATCH"
+			break
+		}
+		timeout := args.Timeout
+		if timeout <= 0 {
+			timeout = DEFAULT_VISIBILITY_TIMEOUT
+		}
+		popped := mq.PopBatch(req.Time, timeout, args.Max)
+		for i := range popped {
+			mq.setOwner(&popped[i], req.Client)
+		}
+		if len(popped) > 0 {
+			resp.Reply = popped
+		} else {
+			resp.Error = "Nothing to pop"
+			waiting = args.Wait > 0
+		}
+	case "PEEK":
+		v := mq.Peek(req.Time)
+		if v != nil {
+			resp.Reply = v
+		} else {
+			resp.Error = "Nothing to peek"
+		}
+	case "LIST":
+		// the value is an optional QList (by default, the first MAX_BATCH queued messages)
+		args, _ := req.Value.(QList)
+		if args.Limit <= 0 || args.Limit > MAX_BATCH {
+			args.Limit = MAX_BATCH
+		}
+		messages, total, err := mq.List(args.Which, args.Offset, args.Limit)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Reply = QListResult{messages, total}
+		}
+	case "PURGE":
+		resp.Reply = mq.Purge()
+	case "DONE":
+		mId, ok := req.Value.(string)
+		if !ok {
+			resp.Error = "DONE takes a message id"
+			break
+		}
+		err := mq.Done(mId)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case "EXTEND":
+		args, ok := req.Value.(QExtend)
+		if !ok {
+			resp.Error = "EXTEND takes a QExtend"
+			break
+		}
+		err := mq.Extend(args.MessageID, req.Time, args.Timeout)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case "HAS_EXPIRED":
+		resp.Reply = qs.HasExpired(req.Time)
+	case "REQUEUE_EXPIRED":
+		resp.Reply = qs.RequeueExpired(req.Time)
+	case "DLQ_LIST":
+		resp.Reply = append([]QMessage{}, mq.DeadLetter...)
+	case "DLQ_REPLAY":
+		// the value is the message to replay, or "" for all of them
+		mId, ok := req.Value.(string)
+		if !ok {
+			resp.Error = "DLQ_REPLAY takes a message id"
+			break
+		}
+		resp.Reply = mq.ReplayDeadLetter(mId)
+	case "DLQ_PURGE":
+		mId, ok := req.Value.(string)
+		if !ok {
+			resp.Error = "DLQ_PURGE takes a message id"
+			break
+		}
+		resp.Reply = mq.PurgeDeadLetter(mId)
+	case "LEN":
+		resp.Reply = mq.Len()
+	case "LEN_IN_PROGRESS":
+		resp.Reply = mq.LenInProgress()
+	case "LEN_DEAD_LETTER":
+		resp.Reply = mq.LenDeadLetter()
+	case "LOAD_SNAPSHOT":
+		data, ok := req.Value.([]byte)
+		if !ok {
+			resp.Error = "LOAD_SNAPSHOT takes a []byte"
+			break
+		}
+		err := qs.RecoverSnapshot(data)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	default:
+		resp.Error = "Unknown command"
+	}
+
+	// a waiting pop that found nothing will be retried with the same
+	// sequence number, so it mustn't be remembered as answered
+	if !waiting {
+		qs.UpdateClient(req, resp)
+	}
+	return resp
+}
+
 func QueueServer(input chan QCommandWithChannel) {
-	// Set up the queue
-	mq := new(MessageQueue)
-	mq.Init()
+	// the client table holds responses, so gob needs to know what can be in them
+	RegisterTypes()
+	// Set up the queues
+	qs := new(QueueSet)
+	qs.Init()
+	// set while a snapshot might still be encoding qs, so the next write has to work
+	// on a copy instead. Only this goroutine touches it (or reassigns qs)
 	copyOnWrite := false
-	// Enter the command loop
-	for {
-		request := <-input
+	// Enter the command loop (until input is closed)
+	for request := range input {
 		req := request.Cmd
-		resp := &QResponse{}
 
-		if copyOnWrite {
-			switch req.Command {
-			case "PUSH", "POP", "DONE":
-				// we're writing, so we need to do a copy
-				//fmt.Printf("copying the queue because copy on write")
-				mq = mq.Copy()
-				copyOnWrite = false
-			}
+		// (writes from clients also write to the client table)
+		if copyOnWrite && IsWrite(req.Command) {
+			// we're writing, so we need to do a copy
+			//fmt.Printf("copying the queue because copy on write")
+			qs = qs.Copy()
+			copyOnWrite = false
 		}
 
-		switch req.Command {
-		case "PUSH":
-			mq.Push(req.Value.(string))
-		case "POP":
-			v := mq.Pop()
-			if v != nil {
-				resp.Reply = v
-			} else {
-				resp.Error = "Nothing to pop"
-			}
-		case "DONE":
-			mq.Done(req.Value.(string))
-		case "LEN":
-			resp.Reply = mq.Len()
-		case "LEN_IN_PROGRESS":
-			resp.Reply = mq.LenInProgress()
-		case "SNAPSHOT":
-			// need to ask for the index here, to guarantee it's the current one
-			index := req.Value.(func() uint)()
-
-			encodeFunc := func() {
-				mq_snap := mq
-				bytes, err := mq_snap.Bytes()
-				if err != nil {
-					resp.Error = err.Error()
-				} else {
-					resp.Reply = QSnapshot{bytes, index}
-				}
-				request.Done <- resp
-				copyOnWrite = false
-			}
+		if req.Command != "SNAPSHOT" {
+			request.Done <- qs.Apply(req)
+			continue
+		}
+		resp := &QResponse{}
+		// need to ask for the index here, to guarantee it's the current one
+		// (clients can't send a func over RPC, so this only comes from the replica)
+		snapshotIndex, ok := req.Value.(func() uint)
+		if !ok {
+			resp.Error = "SNAPSHOT takes a func() uint"
+			request.Done <- resp
+			continue
+		}
+		index := snapshotIndex()
 
-			if USE_COPY_ON_WRITE {
-				copyOnWrite = true
-				go encodeFunc()
+		// the encoder gets its own reference, since qs is replaced by the next write.
+		// Nothing modifies the frozen set after that, so it's safe to read concurrently
+		frozen := qs
+		encodeFunc := func() {
+			bytes, err := frozen.Bytes()
+			if err != nil {
+				resp.Error = err.Error()
 			} else {
-				encodeFunc()
+				resp.Reply = QSnapshot{bytes, index}
 			}
-			continue
-        case "LOAD_SNAPSHOT":
-            err := mq.RecoverSnapshot(req.Value.([]byte))
-            if err != nil {
-                resp.Error = err.Error()
-            }
-		default:
-			resp.Error = "Unknown command"
+			request.Done <- resp
 		}
 
-		request.Done <- resp
+		if USE_COPY_ON_WRITE {
+			copyOnWrite = true
+			go encodeFunc()
+		} else {
+			encodeFunc()
+		}
+	}
+}
+
+// StateMachine runs a queue server goroutine (e.g. QueueServer) as a vr.StateMachine.
+// Apply takes a *QCommand and returns a *QResponse
+type StateMachine struct {
+	input chan QCommandWithChannel
+}
+
+func NewStateMachine(server func(chan QCommandWithChannel)) *StateMachine {
+	input := make(chan QCommandWithChannel, 1000)
+	go server(input)
+	return &StateMachine{input}
+}
+
+func (sm *StateMachine) send(cmd *QCommand) *QResponse {
+	request := QCommandWithChannel{cmd, make(chan *QResponse, 1)}
+	sm.input <- request
+	return <-request.Done
+}
+
+func (sm *StateMachine) Apply(command interface{}) interface{} {
+	// commands replicated through the log arrive as values
+	switch req := command.(type) {
+	case *QCommand:
+		return sm.send(req)
+	case QCommand:
+		return sm.send(&req)
+	}
+	return &QResponse{Error: "Not a QCommand"}
+}
+
+func (sm *StateMachine) Snapshot(index func() uint) ([]byte, uint, error) {
+	result := sm.send(&QCommand{Command: "SNAPSHOT", Value: index})
+	if result.Error != "" {
+		return nil, 0, errors.New(result.Error)
+	}
+	snapshot := result.Reply.(QSnapshot)
+	return snapshot.Data, snapshot.SnapshotIndex, nil
+}
+
+func (sm *StateMachine) Restore(data []byte) error {
+	result := sm.send(&QCommand{Command: "LOAD_SNAPSHOT", Value: data})
+	if result.Error != "" {
+		return errors.New(result.Error)
 	}
+	return nil
 }
@@ -1,17 +1,37 @@
 package phatqueue
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
+	"time"
 )
 
-func TestQServer(t *testing.T) {
+// startQueueServer starts a QueueServer that's stopped when the test ends, and returns
+// its input along with a func that sends it a command and waits for the response
+func startQueueServer(t *testing.T) (chan QCommandWithChannel, func(*QCommand) *QResponse) {
 	input := make(chan QCommandWithChannel)
 	go QueueServer(input)
+	t.Cleanup(func() { close(input) })
+	send := func(cmd *QCommand) *QResponse {
+		// (as the master would)
+		if cmd.Time.IsZero() {
+			cmd.Time = time.Now()
+		}
+		request := QCommandWithChannel{cmd, make(chan *QResponse)}
+		input <- request
+		return <-request.Done
+	}
+	return input, send
+}
+
+func TestQServer(t *testing.T) {
+	input, _ := startQueueServer(t)
 	//
-	popCmd := QCommandWithChannel{&QCommand{"POP", ""}, make(chan *QResponse)}
-	lenCmd := QCommandWithChannel{&QCommand{"LEN", ""}, make(chan *QResponse)}
+	popCmd := QCommandWithChannel{&QCommand{Command: "POP", Value: "", Time: time.Now()}, make(chan *QResponse)}
+	lenCmd := QCommandWithChannel{&QCommand{Command: "LEN", Value: ""}, make(chan *QResponse)}
 	// A bad command should fail
-	badCmd := QCommandWithChannel{&QCommand{"HAMMERTIME", ""}, make(chan *QResponse)}
+	badCmd := QCommandWithChannel{&QCommand{Command: "HAMMERTIME", Value: ""}, make(chan *QResponse)}
 	input <- badCmd
 	// TODO: Ensure it's the expected error
 	if resp := <-badCmd.Done; resp.Reply != nil || resp.Error == "" {
@@ -26,7 +46,7 @@ func TestQServer(t *testing.T) {
 	elems := []string{"/dev/nulled", "/dev/random", "/dev/urandom"}
 	for _, val := range elems {
 		// Place an object on the queue
-		pushCmd := QCommandWithChannel{&QCommand{"PUSH", val}, make(chan *QResponse)}
+		pushCmd := QCommandWithChannel{&QCommand{Command: "PUSH", Value: val, Time: time.Now()}, make(chan *QResponse)}
 		input <- pushCmd
 		<-pushCmd.Done
 	}
@@ -44,8 +64,11 @@ func TestQServer(t *testing.T) {
 			t.Errorf("POP fails with %v", resp.Reply)
 		}
 		//
-		//doneCmd := QCommandWithChannel{&QCommand{"DONE", resp.Reply.(QMessage).MessageID}, make(chan *QResponse)}
-		//<-doneCmd.Done
+		doneCmd := QCommandWithChannel{&QCommand{Command: "DONE", Value: resp.Reply.(*QMessage).MessageID}, make(chan *QResponse)}
+		input <- doneCmd
+		if resp := <-doneCmd.Done; resp.Error != "" {
+			t.Errorf("DONE fails with %s", resp.Error)
+		}
 		//
 		input <- lenCmd
 		resp = <-lenCmd.Done
@@ -54,3 +77,273 @@ func TestQServer(t *testing.T) {
 		}
 	}
 }
+
+func TestNamedQueues(t *testing.T) {
+	_, send := startQueueServer(t)
+	//
+	if resp := send(&QCommand{Command: "PUSH", Value: "x", Queue: "jobs"}); resp.Error == "" {
+		t.Errorf("PUSH to a missing queue should fail")
+	}
+	if resp := send(&QCommand{Command: "CREATE_QUEUE", Queue: "jobs"}); resp.Error != "" {
+		t.Errorf("CREATE_QUEUE fails with %s", resp.Error)
+	}
+	if resp := send(&QCommand{Command: "CREATE_QUEUE", Queue: "jobs"}); resp.Error == "" {
+		t.Errorf("CREATE_QUEUE should fail for an existing queue")
+	}
+	send(&QCommand{Command: "PUSH", Value: "a", Queue: "jobs"})
+	send(&QCommand{Command: "PUSH", Value: "b", Queue: "jobs"})
+	send(&QCommand{Command: "PUSH", Value: "c"})
+	// Queues are independent
+	if resp := send(&QCommand{Command: "POP", Queue: "jobs"}); resp.Error != "" || resp.Reply.(*QMessage).Value != "a" {
+		t.Errorf("POP from jobs returned %v", resp.Reply)
+	}
+	if resp := send(&QCommand{Command: "LEN"}); resp.Reply != 1 {
+		t.Errorf("Default queue length was %v instead of 1", resp.Reply)
+	}
+	resp := send(&QCommand{Command: "STATS", Queue: "jobs"})
+	stats := resp.Reply.(*QStats)
+	if resp.Error != "" || stats.Len != 1 || stats.InProgress != 1 || stats.Pushed != 2 || stats.Delivered != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	// Every queue is in the snapshot
+	resp = send(&QCommand{Command: "SNAPSHOT", Value: func() uint { return 1 }})
+	data := resp.Reply.(QSnapshot).Data
+	send(&QCommand{Command: "DELETE_QUEUE", Queue: "jobs"})
+	if resp := send(&QCommand{Command: "LIST_QUEUES"}); len(resp.Reply.([]string)) != 1 {
+		t.Errorf("Queue wasn't deleted: %v", resp.Reply)
+	}
+	if resp := send(&QCommand{Command: "DELETE_QUEUE"}); resp.Error == "" {
+		t.Errorf("Deleting the default queue should fail")
+	}
+	send(&QCommand{Command: "LOAD_SNAPSHOT", Value: data})
+	if resp := send(&QCommand{Command: "LIST_QUEUES"}); len(resp.Reply.([]string)) != 2 || resp.Reply.([]string)[1] != "jobs" {
+		t.Errorf("Snapshot didn't restore all the queues: %v", resp.Reply)
+	}
+	if resp := send(&QCommand{Command: "LEN_IN_PROGRESS", Queue: "jobs"}); resp.Reply != 1 {
+		t.Errorf("Restored queue has %v messages in progress instead of 1", resp.Reply)
+	}
+}
+
+func TestDelayedPush(t *testing.T) {
+	input, send := startQueueServer(t)
+	now := time.Now()
+	//
+	send(&QCommand{Command: "PUSH", Value: QPush{Value: "a", Delay: time.Minute}, Time: now})
+	// Readiness is decided by the command's time, not the local clock
+	if resp := send(&QCommand{Command: "POP", Time: now.Add(time.Second)}); resp.Error == "" {
+		t.Errorf("POP returned a message that isn't ready yet: %v", resp.Reply)
+	}
+	if resp := send(&QCommand{Command: "POP", Time: now.Add(time.Minute)}); resp.Error != "" || resp.Reply.(*QMessage).Value != "a" {
+		t.Errorf("POP fails with %v", resp.Error)
+	}
+	if resp := send(&QCommand{Command: "PUSH", Value: 42}); resp.Error == "" {
+		t.Errorf("PUSH of an unsupported value should fail")
+	}
+	// Without a time from the master, replicas could disagree, so it's an error
+	pop := QCommandWithChannel{&QCommand{Command: "POP"}, make(chan *QResponse)}
+	input <- pop
+	if resp := <-pop.Done; resp.Error != "Command has no time" {
+		t.Errorf("POP without a time returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+}
+
+func TestBatchAndRetries(t *testing.T) {
+	_, send := startQueueServer(t)
+	//
+	batch := []QPush{{Value: "a"}, {Value: "b"}, {Value: "c"}}
+	pushCmd := &QCommand{Command: "PUSH_BATCH", Value: batch, Client: "w1", SeqNumber: 0}
+	if resp := send(pushCmd); resp.Error != "" {
+		t.Errorf("PUSH_BATCH fails with %s", resp.Error)
+	}
+	// A retried batch isn't pushed twice
+	send(pushCmd)
+	if resp := send(&QCommand{Command: "LEN"}); resp.Reply != 3 {
+		t.Errorf("Length of %v didn't match expectation of 3", resp.Reply)
+	}
+	// A batch with a bad message isn't pushed at all
+	badBatch := []QPush{{Value: "d"}, {Value: 42}}
+	if resp := send(&QCommand{Command: "PUSH_BATCH", Value: badBatch, Client: "w1", SeqNumber: 1}); resp.Error == "" {
+		t.Errorf("PUSH_BATCH with an unsupported value should fail")
+	}
+	if resp := send(&QCommand{Command: "LEN"}); resp.Reply != 3 {
+		t.Errorf("Length of %v didn't match expectation of 3", resp.Reply)
+	}
+	//
+	popCmd := &QCommand{Command: "POP_BATCH", Value: QPopBatch{Max: 2}, Client: "w1", SeqNumber: 3}
+	resp := send(popCmd)
+	if resp.Error != "" || len(resp.Reply.([]QMessage)) != 2 || resp.Reply.([]QMessage)[1].Value != "b" {
+		t.Errorf("POP_BATCH returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// Commands can arrive out of order, as long as they're within the window
+	if resp := send(&QCommand{Command: "POP", Client: "w1", SeqNumber: 2}); resp.Error != "" || resp.Reply.(*QMessage).Value != "c" {
+		t.Errorf("POP returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// The retried POP_BATCH gets the same messages instead of popping more
+	if retry := send(popCmd); retry.Error != "" || len(retry.Reply.([]QMessage)) != 2 || retry.Reply.([]QMessage)[0].Value != "a" {
+		t.Errorf("Retried POP_BATCH returned %v (err: %s)", retry.Reply, retry.Error)
+	}
+	if resp := send(&QCommand{Command: "LEN_IN_PROGRESS"}); resp.Reply != 3 {
+		t.Errorf("%v messages in progress instead of 3", resp.Reply)
+	}
+	// Responses are kept in the snapshot, so a new master recognizes retries too
+	resp = send(&QCommand{Command: "SNAPSHOT", Value: func() uint { return 1 }})
+	_, restored := startQueueServer(t)
+	if resp := restored(&QCommand{Command: "LOAD_SNAPSHOT", Value: resp.Reply.(QSnapshot).Data}); resp.Error != "" {
+		t.Errorf("LOAD_SNAPSHOT fails with %s", resp.Error)
+	}
+	if resp := restored(popCmd); resp.Error != "" || len(resp.Reply.([]QMessage)) != 2 {
+		t.Errorf("Retried POP_BATCH after restore returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// Sequence numbers that have fallen out of the window are rejected
+	send(&QCommand{Command: "PUSH", Value: "e", Client: "w1", SeqNumber: CLIENT_WINDOW + 5})
+	if resp := send(pushCmd); resp.Error != "Old Request" {
+		t.Errorf("Expected an Old Request error, got %v (err: %s)", resp.Reply, resp.Error)
+	}
+}
+
+func TestClientExpiry(t *testing.T) {
+	_, send := startQueueServer(t)
+	now := time.Now()
+	//
+	lenCmd := &QCommand{Command: "LEN", Client: "w1", SeqNumber: 0, Time: now}
+	send(lenCmd)
+	send(&QCommand{Command: "PUSH", Value: "a", Client: "w1", SeqNumber: 1, Time: now})
+	// Reads aren't remembered, so a retry sees the latest state
+	if resp := send(lenCmd); resp.Reply != 1 {
+		t.Errorf("Retried LEN returned %v instead of 1", resp.Reply)
+	}
+	pushCmd := &QCommand{Command: "PUSH", Value: "b", Client: "w1", SeqNumber: 2, Time: now}
+	send(pushCmd)
+	// A client that's been quiet for CLIENT_EXPIRY is forgotten (once anyone writes)...
+	later := now.Add(CLIENT_EXPIRY + time.Minute)
+	send(&QCommand{Command: "PUSH", Value: "c", Client: "w2", SeqNumber: 0, Time: later})
+	// ...so a retry that late is applied again
+	pushCmd.Time = later
+	send(pushCmd)
+	if resp := send(&QCommand{Command: "LEN", Time: later}); resp.Reply != 4 {
+		t.Errorf("Length of %v didn't match expectation of 4", resp.Reply)
+	}
+}
+
+func TestWaitingPop(t *testing.T) {
+	_, send := startQueueServer(t)
+	//
+	popCmd := &QCommand{Command: "POP", Value: QPop{Wait: time.Second}, Client: "w1", SeqNumber: 0}
+	if resp := send(popCmd); resp.Error != "Nothing to pop" {
+		t.Errorf("Expected nothing to pop, got %v (err: %s)", resp.Reply, resp.Error)
+	}
+	send(&QCommand{Command: "PUSH", Value: "hello", Client: "w2", SeqNumber: 0})
+	// The server tries the waiting POP again with the same sequence number once
+	// something's pushed, so the empty result mustn't have been remembered
+	if resp := send(popCmd); resp.Error != "" || resp.Reply.(*QMessage).Value != "hello" {
+		t.Errorf("Retried waiting POP returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// Once it has popped something, retries get that message back
+	if resp := send(popCmd); resp.Error != "" || resp.Reply.(*QMessage).Value != "hello" {
+		t.Errorf("Retried POP returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// An ordinary POP's empty result is remembered
+	plainPop := &QCommand{Command: "POP", Client: "w1", SeqNumber: 1}
+	send(plainPop)
+	send(&QCommand{Command: "PUSH", Value: "world", Client: "w2", SeqNumber: 1})
+	if resp := send(plainPop); resp.Error != "Nothing to pop" {
+		t.Errorf("Retried POP returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+}
+
+func TestPayloads(t *testing.T) {
+	_, send := startQueueServer(t)
+	//
+	push := QPush{Value: []byte{0, 1, 2}, ContentType: "application/octet-stream", Headers: map[string]string{"trace": "abc"}}
+	if resp := send(&QCommand{Command: "PUSH", Value: push}); resp.Error != "" {
+		t.Errorf("PUSH of a []byte fails with %s", resp.Error)
+	}
+	if resp := send(&QCommand{Command: "PUSH", Value: QPush{Value: 3.5}}); resp.Error != "Unsupported PUSH value" {
+		t.Errorf("PUSH of a float should fail, got %v", resp.Error)
+	}
+	// Bad arguments are errors rather than crashing the server
+	for _, cmd := range []string{"DONE", "EXTEND", "DLQ_REPLAY", "DLQ_PURGE", "SNAPSHOT", "LOAD_SNAPSHOT"} {
+		if resp := send(&QCommand{Command: cmd, Value: 42}); resp.Error == "" {
+			t.Errorf("%s with a bad argument should fail", cmd)
+		}
+	}
+	// Metadata survives a snapshot
+	resp := send(&QCommand{Command: "SNAPSHOT", Value: func() uint { return 1 }})
+	_, restored := startQueueServer(t)
+	restored(&QCommand{Command: "LOAD_SNAPSHOT", Value: resp.Reply.(QSnapshot).Data})
+	resp = restored(&QCommand{Command: "POP"})
+	if resp.Error != "" {
+		t.Fatalf("POP fails with %s", resp.Error)
+	}
+	msg := resp.Reply.(*QMessage)
+	if !bytes.Equal(msg.Value.([]byte), []byte{0, 1, 2}) || msg.ContentType != "application/octet-stream" || msg.Headers["trace"] != "abc" {
+		t.Errorf("Popped %v, expected the pushed []byte and its metadata", msg)
+	}
+}
+
+func TestMessageStats(t *testing.T) {
+	_, send := startQueueServer(t)
+	//
+	pushed := time.Now().Add(-time.Minute)
+	send(&QCommand{Command: "PUSH", Value: "a", Time: pushed})
+	send(&QCommand{Command: "PUSH", Value: "b", Time: pushed})
+	send(&QCommand{Command: "POP", Client: "w1", SeqNumber: 0})
+	//
+	resp := send(&QCommand{Command: "LIST", Value: QList{Which: LIST_IN_PROGRESS}})
+	list := resp.Reply.(QListResult)
+	if list.Total != 1 || list.Messages[0].Owner != "w1" || list.Messages[0].Deliveries != 1 || !list.Messages[0].EnqueueTime.Equal(pushed) {
+		t.Errorf("In progress messages are %v (err: %s)", list, resp.Error)
+	}
+	resp = send(&QCommand{Command: "PEEK"})
+	if resp.Error != "" || resp.Reply.(*QMessage).Value != "b" || resp.Reply.(*QMessage).Owner != "" {
+		t.Errorf("PEEK returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	// LIST defaults to the queued messages
+	if resp := send(&QCommand{Command: "LIST"}); resp.Reply.(QListResult).Total != 1 {
+		t.Errorf("LIST returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	if resp := send(&QCommand{Command: "PURGE"}); resp.Reply != 2 {
+		t.Errorf("PURGE returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	if resp := send(&QCommand{Command: "PEEK"}); resp.Error != "Nothing to peek" {
+		t.Errorf("PEEK of an empty queue returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+}
+
+// Run with -race: snapshots are encoded concurrently with the commands that follow them
+func TestConcurrentSnapshots(t *testing.T) {
+	input, send := startQueueServer(t)
+	//
+	var pending []chan *QResponse
+	var expected []int
+	length := 0
+	seq := uint(0)
+	for round := 0; round < 50; round++ {
+		snap := QCommandWithChannel{&QCommand{Command: "SNAPSHOT", Value: func() uint { return 0 }}, make(chan *QResponse, 1)}
+		input <- snap
+		pending = append(pending, snap.Done)
+		expected = append(expected, length)
+		// none of these should show up in the snapshot
+		for i := 0; i < 20; i++ {
+			send(&QCommand{Command: "PUSH", Value: fmt.Sprintf("%d-%d", round, i), Client: "w1", SeqNumber: seq})
+			seq++
+		}
+		send(&QCommand{Command: "POP"})
+		send(&QCommand{Command: "LEN"})
+		length += 19
+	}
+	for i, done := range pending {
+		resp := <-done
+		if resp.Error != "" {
+			t.Fatalf("SNAPSHOT fails with %s", resp.Error)
+		}
+		qs := new(QueueSet)
+		if err := qs.RecoverSnapshot(resp.Reply.(QSnapshot).Data); err != nil {
+			t.Fatalf("Couldn't recover snapshot %d: %s", i, err)
+		}
+		mq, _ := qs.Get(DEFAULT_QUEUE)
+		if mq.Len() != expected[i] {
+			t.Errorf("Snapshot %d has %d messages, expected %d", i, mq.Len(), expected[i])
+		}
+	}
+}
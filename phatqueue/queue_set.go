@@ -0,0 +1,281 @@
+package phatqueue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"time"
+)
+
+// name of the queue that always exists, used by commands that don't name one
+const DEFAULT_QUEUE = ""
+
+// per-queue statistics returned by the STATS command
+type QStats struct {
+	Name       string
+	Len        int
+	InProgress int
+	DeadLetter int
+	Pushed     uint64
+	Delivered  uint64
+	Completed  uint64
+}
+
+const (
+	// how many of a client's most recent writes we keep responses for. Clients can have
+	// this many commands outstanding at once and still get exactly-once behaviour
+	CLIENT_WINDOW = 16
+	// clients we haven't heard from for this long are forgotten, so a retry
+	// of one of their writes after that would be applied again
+	CLIENT_EXPIRY = time.Hour
+)
+
+// the responses to a client's recent writes, keyed by sequence number
+type ClientTableEntry struct {
+	SeqNumber uint // highest sequence number applied
+	Responses map[uint]*QResponse
+	// time of the client's latest write
+	LastSeen time.Time
+}
+
+// tooOld reports whether seq has fallen out of the window
+func (e *ClientTableEntry) tooOld(seq uint) bool {
+	return seq+CLIENT_WINDOW <= e.SeqNumber
+}
+
+// record saves the response to seq, forgetting any that fall out of the window
+func (e *ClientTableEntry) record(seq uint, resp *QResponse) {
+	// gob leaves out empty maps
+	if e.Responses == nil {
+		e.Responses = make(map[uint]*QResponse)
+	}
+	if seq > e.SeqNumber {
+		if seq-e.SeqNumber >= CLIENT_WINDOW {
+			e.Responses = make(map[uint]*QResponse)
+		} else {
+			for old := e.SeqNumber + 1; old <= seq; old++ {
+				if old >= CLIENT_WINDOW {
+					delete(e.Responses, old-CLIENT_WINDOW)
+				}
+			}
+		}
+		e.SeqNumber = seq
+	}
+	e.Responses[seq] = resp
+}
+
+// QueueSet holds all the named queues served by a single QueueServer
+type QueueSet struct {
+	Queues map[string]*MessageQueue
+	// lives alongside the queues so that it's replicated and snapshotted with them
+	ClientTable map[string]*ClientTableEntry
+	// when we next look for clients to expire
+	NextExpiry time.Time
+}
+
+func (qs *QueueSet) Init() {
+	qs.Queues = make(map[string]*MessageQueue)
+	qs.ClientTable = make(map[string]*ClientTableEntry)
+	qs.Create(DEFAULT_QUEUE)
+}
+
+// CheckClient returns the saved response if the command has already been applied,
+// or an error if the client has since sent a newer command. Reads are never saved
+// (running them again is harmless), so they're always run
+func (qs *QueueSet) CheckClient(req *QCommand) (*QResponse, error) {
+	if req.Client == "" || !IsWrite(req.Command) {
+		return nil, nil
+	}
+	if entry, ok := qs.ClientTable[req.Client]; ok {
+		if entry.tooOld(req.SeqNumber) {
+			return nil, errors.New("Old Request")
+		}
+		if resp, ok := entry.Responses[req.SeqNumber]; ok {
+			return resp, nil
+		}
+	}
+	return nil, nil
+}
+
+// UpdateClient saves the response to a write, and forgets clients that have expired
+func (qs *QueueSet) UpdateClient(req *QCommand, resp *QResponse) {
+	if req.Client == "" || !IsWrite(req.Command) {
+		return
+	}
+	entry, ok := qs.ClientTable[req.Client]
+	if !ok {
+		entry = &ClientTableEntry{Responses: make(map[uint]*QResponse)}
+		qs.ClientTable[req.Client] = entry
+	}
+	entry.record(req.SeqNumber, resp)
+	if req.Time.After(entry.LastSeen) {
+		entry.LastSeen = req.Time
+	}
+	qs.expireClients(req.Time)
+}
+
+// expireClients forgets clients we haven't heard from for CLIENT_EXPIRY. It only looks
+// every so often (using the commands' times, so every replica forgets the same clients)
+func (qs *QueueSet) expireClients(now time.Time) {
+	if now.IsZero() || now.Before(qs.NextExpiry) {
+		return
+	}
+	for id, entry := range qs.ClientTable {
+		if now.Sub(entry.LastSeen) > CLIENT_EXPIRY {
+			delete(qs.ClientTable, id)
+		}
+	}
+	qs.NextExpiry = now.Add(CLIENT_EXPIRY / 10)
+}
+
+func (qs *QueueSet) Get(name string) (*MessageQueue, error) {
+	mq, ok := qs.Queues[name]
+	if !ok {
+		return nil, errors.New("No such queue")
+	}
+	return mq, nil
+}
+
+func (qs *QueueSet) Create(name string) (*MessageQueue, error) {
+	if _, ok := qs.Queues[name]; ok {
+		return nil, errors.New("Queue already exists")
+	}
+	mq := new(MessageQueue)
+	mq.Init()
+	qs.Queues[name] = mq
+	return mq, nil
+}
+
+// Delete drops a queue along with any messages still in it
+func (qs *QueueSet) Delete(name string) error {
+	if name == DEFAULT_QUEUE {
+		return errors.New("Can't delete the default queue")
+	}
+	if _, ok := qs.Queues[name]; !ok {
+		return errors.New("No such queue")
+	}
+	delete(qs.Queues, name)
+	return nil
+}
+
+// Names returns the queue names in sorted order
+func (qs *QueueSet) Names() []string {
+	names := make([]string, 0, len(qs.Queues))
+	for name := range qs.Queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (qs *QueueSet) Stats(name string) (*QStats, error) {
+	mq, err := qs.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return &QStats{name, mq.Len(), mq.LenInProgress(), mq.LenDeadLetter(),
+		mq.Pushed, mq.Delivered, mq.Completed}, nil
+}
+
+// HasExpired reports whether any queue has an in progress message whose lease has run out
+func (qs *QueueSet) HasExpired(now time.Time) bool {
+	for _, mq := range qs.Queues {
+		if mq.HasExpired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequeueExpired requeues expired messages in every queue, returning their ids by queue name
+func (qs *QueueSet) RequeueExpired(now time.Time) map[string][]string {
+	requeued := make(map[string][]string)
+	for name, mq := range qs.Queues {
+		if ids := mq.RequeueExpired(now); len(ids) > 0 {
+			requeued[name] = ids
+		}
+	}
+	return requeued
+}
+
+func (qs *QueueSet) Copy() (newqs *QueueSet) {
+	newqs = new(QueueSet)
+	newqs.Queues = make(map[string]*MessageQueue)
+	for name, mq := range qs.Queues {
+		newqs.Queues[name] = mq.Copy()
+	}
+	newqs.ClientTable = make(map[string]*ClientTableEntry)
+	for k, v := range qs.ClientTable {
+		entry := &ClientTableEntry{v.SeqNumber, make(map[uint]*QResponse), v.LastSeen}
+		for seq, resp := range v.Responses {
+			entry.Responses[seq] = resp
+		}
+		newqs.ClientTable[k] = entry
+	}
+	newqs.NextExpiry = qs.NextExpiry
+	return
+}
+
+// convert every queue to a byte slice
+func (qs *QueueSet) Bytes() ([]byte, error) {
+	queues := make(map[string][]byte)
+	for name, mq := range qs.Queues {
+		b, err := mq.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		queues[name] = b
+	}
+	var state bytes.Buffer
+	enc := gob.NewEncoder(&state)
+	for _, v := range []interface{}{queues, qs.ClientTable, qs.NextExpiry} {
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return state.Bytes(), nil
+}
+
+//recover every queue from a snapshot (leaving the set as it was if that fails)
+func (qs *QueueSet) RecoverSnapshot(snapshotBytes []byte) error {
+	var queues map[string][]byte
+	clientTable := make(map[string]*ClientTableEntry)
+	var nextExpiry time.Time
+	dec := gob.NewDecoder(bytes.NewBuffer(snapshotBytes))
+	for _, v := range []interface{}{&queues, &clientTable, &nextExpiry} {
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+	}
+	restored := make(map[string]*MessageQueue)
+	for name, b := range queues {
+		mq := new(MessageQueue)
+		if err := mq.RecoverSnapshot(b); err != nil {
+			return err
+		}
+		restored[name] = mq
+	}
+	qs.Queues, qs.ClientTable, qs.NextExpiry = restored, clientTable, nextExpiry
+	return nil
+}
+
+// RegisterTypes registers everything that can show up in a QCommand's Value or a
+// QResponse's Reply, so they can be passed through gob as an interface{} (as can
+// the QResponse itself, e.g. when VR forwards it)
+func RegisterTypes() {
+	gob.Register(QCommand{})
+	gob.Register(QResponse{})
+	gob.Register(QMessage{})
+	gob.Register([]QMessage{})
+	gob.Register(QExtend{})
+	gob.Register(QPush{})
+	gob.Register([]QPush{})
+	gob.Register(QPopBatch{})
+	gob.Register(QPop{})
+	gob.Register(QList{})
+	gob.Register(QListResult{})
+	gob.Register(QStats{})
+	gob.Register(map[string][]string{})
+	gob.Register(time.Duration(0))
+}
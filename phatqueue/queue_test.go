@@ -2,6 +2,7 @@ package phatqueue
 
 import (
 	"testing"
+	"time"
 )
 
 func TestExistsNode(t *testing.T) {
@@ -17,13 +18,13 @@ func TestExistsNode(t *testing.T) {
 		t.Errorf("Incorrect expected queue length")
 	}
 	//
-	qmesg := mq.Pop()
+	qmesg := mq.Pop(time.Now(), DEFAULT_VISIBILITY_TIMEOUT)
 	if qmesg.Value != 1 {
 		t.Errorf("Expected result was not returned")
 	}
 	mq.Done(qmesg.MessageID)
 	//
-	qmesg = mq.Pop()
+	qmesg = mq.Pop(time.Now(), DEFAULT_VISIBILITY_TIMEOUT)
 	if qmesg.Value != "2" {
 		t.Errorf("Expected result was not returned")
 	}
@@ -33,16 +34,275 @@ func TestExistsNode(t *testing.T) {
 		t.Errorf("Incorrect expected queue length")
 	}
 	//
-	qmesg = mq.Pop()
+	qmesg = mq.Pop(time.Now(), DEFAULT_VISIBILITY_TIMEOUT)
 	if qmesg.Value != 4 {
 		t.Errorf("Expected result was not returned")
 	}
 	mq.Done(qmesg.MessageID)
 	//
-	qmesg = mq.Pop()
+	qmesg = mq.Pop(time.Now(), DEFAULT_VISIBILITY_TIMEOUT)
 	if qmesg.Value != "Eight" {
 		t.Errorf("Expected result was not returned")
 	}
 	mq.Done(qmesg.MessageID)
 	//
 }
+
+func TestInProgress(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	now := time.Now()
+	//
+	mq.Push("a")
+	mq.Push("b")
+	qmesg := mq.Pop(now, time.Minute)
+	if qmesg.Value != "a" || mq.LenInProgress() != 1 || mq.Len() != 1 {
+		t.Errorf("Popped message wasn't moved into InProgress")
+	}
+	if qmesg2 := mq.Pop(now, time.Second); qmesg2.Value != "b" || qmesg2.Deliveries != 1 {
+		t.Errorf("Expected b on its first delivery, got %v", qmesg2)
+	}
+	if err := mq.Done(qmesg.MessageID); err != nil || mq.LenInProgress() != 1 {
+		t.Errorf("Done didn't remove the message from InProgress")
+	}
+	if err := mq.Done(qmesg.MessageID); err == nil {
+		t.Errorf("Done should fail for a message that isn't in progress")
+	}
+	// Nothing left in the queue, and b's lease hasn't run out
+	if mq.HasExpired(now) || len(mq.RequeueExpired(now)) != 0 {
+		t.Errorf("Message requeued before its lease ran out")
+	}
+	if qmesg = mq.Pop(now, time.Second); qmesg != nil {
+		t.Errorf("Expected nothing to pop, got %v", qmesg.Value)
+	}
+	// Once the lease expires b goes back on the queue and is redelivered
+	later := now.Add(2 * time.Second)
+	if !mq.HasExpired(later) {
+		t.Errorf("Expired message not reported")
+	}
+	if ids := mq.RequeueExpired(later); len(ids) != 1 || mq.LenInProgress() != 0 || mq.Len() != 1 {
+		t.Errorf("Expired message wasn't requeued: %v", ids)
+	}
+	qmesg = mq.Pop(later, time.Second)
+	if qmesg == nil || qmesg.Value != "b" || qmesg.Deliveries != 2 {
+		t.Errorf("Expired message wasn't redelivered")
+	}
+	// Extending the lease keeps it in progress
+	if err := mq.Extend(qmesg.MessageID, later, time.Minute); err != nil {
+		t.Errorf("Extend fails with %v", err)
+	}
+	if mq.HasExpired(later.Add(2 * time.Second)) {
+		t.Errorf("Extended message expired anyway")
+	}
+	if err := mq.Extend("nonexistent", later, time.Minute); err == nil {
+		t.Errorf("Extend should fail for a message that isn't in progress")
+	}
+}
+
+func TestRequeueOrder(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	now := time.Now()
+	//
+	for i := 0; i < 12; i++ {
+		mq.Push(i)
+	}
+	// pop everything with the same deadline, except 3 which expires first
+	for i := 0; i < 12; i++ {
+		timeout := time.Second
+		if i == 3 {
+			timeout = time.Millisecond
+		}
+		mq.Pop(now, timeout)
+	}
+	mq.Push("new")
+	mq.RequeueExpired(now.Add(time.Minute))
+	expected := []interface{}{3, 0, 1, 2, 4, 5, 6, 7, 8, 9, 10, 11, "new"}
+	for _, val := range expected {
+		if qmesg := mq.Pop(now, time.Second); qmesg.Value != val {
+			t.Errorf("Expected %v, got %v", val, qmesg.Value)
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	mq.MaxDeliveries = 2
+	now := time.Now()
+	//
+	mq.Push("poison")
+	mq.Push("fine")
+	for i := 0; i < mq.MaxDeliveries; i++ {
+		if qmesg := mq.Pop(now, time.Second); qmesg.Value != "poison" {
+			t.Errorf("Expected poison, got %v", qmesg.Value)
+		}
+		now = now.Add(2 * time.Second)
+		mq.RequeueExpired(now)
+	}
+	if mq.LenDeadLetter() != 1 || mq.Len() != 1 || mq.LenInProgress() != 0 {
+		t.Errorf("Message wasn't moved to the dead letter queue")
+	}
+	// The dead letter survives a snapshot
+	b, err := mq.Bytes()
+	if err != nil {
+		t.Errorf("Bytes fails with %v", err)
+	}
+	restored := MessageQueue{}
+	restored.Init()
+	if err := restored.RecoverSnapshot(b); err != nil || restored.LenDeadLetter() != 1 || restored.MaxDeliveries != 2 {
+		t.Errorf("Dead letter queue wasn't restored from snapshot (err: %v)", err)
+	}
+	// Replaying puts it at the back of the queue with a fresh delivery count
+	if n := mq.ReplayDeadLetter(""); n != 1 || mq.LenDeadLetter() != 0 {
+		t.Errorf("Replay moved %d messages", n)
+	}
+	mq.Done(mq.Pop(now, time.Second).MessageID)
+	if qmesg := mq.Pop(now, time.Second); qmesg.Value != "poison" || qmesg.Deliveries != 1 {
+		t.Errorf("Replayed message wasn't requeued: %v", qmesg)
+	}
+	now = now.Add(time.Minute)
+	mq.RequeueExpired(now)
+	mq.Pop(now, time.Second)
+	mq.RequeueExpired(now.Add(time.Minute))
+	if mq.LenDeadLetter() != 1 {
+		t.Errorf("Message wasn't moved to the dead letter queue")
+	}
+	if n := mq.PurgeDeadLetter("nonexistent"); n != 0 || mq.LenDeadLetter() != 1 {
+		t.Errorf("Purge removed the wrong message")
+	}
+	if n := mq.PurgeDeadLetter(mq.DeadLetter[0].MessageID); n != 1 || mq.LenDeadLetter() != 0 {
+		t.Errorf("Purge didn't remove the message")
+	}
+}
+
+func TestPriorityAndDelay(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	now := time.Now()
+	//
+	mq.Push("low1")
+	mq.PushWithOptions("high", 5, time.Time{})
+	mq.PushWithOptions("later", 10, now.Add(time.Minute))
+	mq.Push("low2")
+	mq.PushWithOptions("mid", 1, time.Time{})
+	// "later" has the highest priority but isn't ready yet
+	expected := []string{"high", "mid", "low1"}
+	for _, val := range expected {
+		if qmesg := mq.Pop(now, time.Second); qmesg == nil || qmesg.Value != val {
+			t.Errorf("Expected %v, got %v", val, qmesg)
+		}
+	}
+	// Expired messages go back ahead of others of the same priority only
+	mq.RequeueExpired(now.Add(time.Hour))
+	expected = []string{"later", "high", "mid", "low1", "low2"}
+	for _, val := range expected {
+		if qmesg := mq.Pop(now.Add(time.Hour), time.Second); qmesg == nil || qmesg.Value != val {
+			t.Errorf("Expected %v, got %v", val, qmesg)
+		}
+	}
+	if qmesg := mq.Pop(now.Add(time.Hour), time.Second); qmesg != nil {
+		t.Errorf("Expected nothing to pop, got %v", qmesg.Value)
+	}
+}
+
+func TestInspection(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	now := time.Now()
+	//
+	for i := 0; i < 12; i++ {
+		mq.Push(i)
+	}
+	if qmesg := mq.Peek(now); qmesg == nil || qmesg.Value != 0 {
+		t.Errorf("Expected to peek at 0, got %v", qmesg)
+	}
+	if mq.Len() != 12 {
+		t.Errorf("Peek shouldn't pop anything")
+	}
+	for i := 0; i < 11; i++ {
+		mq.Pop(now, time.Second)
+	}
+	// in progress messages are listed oldest first, even past id 9
+	page, total, _ := mq.List(LIST_IN_PROGRESS, 8, 5)
+	if total != 11 || len(page) != 3 || page[0].Value != 8 || page[2].Value != 10 {
+		t.Errorf("Got page %v of %d in progress messages", page, total)
+	}
+	page, total, _ = mq.List(LIST_QUEUED, 0, 5)
+	if total != 1 || len(page) != 1 || page[0].Value != 11 {
+		t.Errorf("Got page %v of %d queued messages", page, total)
+	}
+	if _, _, err := mq.List("bogus", 0, 5); err == nil {
+		t.Errorf("Listing an unknown list should fail")
+	}
+	if n := mq.Purge(); n != 12 || mq.Len() != 0 || mq.LenInProgress() != 0 {
+		t.Errorf("Purged %d messages, leaving %d queued and %d in progress", n, mq.Len(), mq.LenInProgress())
+	}
+	if qmesg := mq.Peek(now); qmesg != nil {
+		t.Errorf("Expected nothing to peek at, got %v", qmesg.Value)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	now := time.Now()
+	//
+	mq.Push("a")
+	mq.Push("b")
+	mq.Push("c")
+	mq.Pop(now, time.Second)
+	newmq := mq.Copy()
+	if newmq.Len() != 2 || newmq.LenInProgress() != 1 || newmq.Id != 3 {
+		t.Errorf("Copy has %d queued and %d in progress messages", newmq.Len(), newmq.LenInProgress())
+	}
+	// changes to the copy don't show up in the original
+	newmq.Pop(now, time.Second)
+	newmq.Push("d")
+	if qmesg := mq.Pop(now, time.Second); qmesg == nil || qmesg.Value != "b" {
+		t.Errorf("Expected b, got %v", qmesg)
+	}
+	if mq.Len() != 1 || mq.LenInProgress() != 2 {
+		t.Errorf("Original has %d queued and %d in progress messages", mq.Len(), mq.LenInProgress())
+	}
+}
+
+func TestBadSnapshot(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	mq.Push("a")
+	mq.Push("b")
+	data, err := mq.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes fails with %s", err)
+	}
+	// a snapshot that's cut short fails without changing the queue
+	other := MessageQueue{}
+	other.Init()
+	other.Push("x")
+	if err := other.RecoverSnapshot(data[:len(data)-1]); err == nil {
+		t.Errorf("Recovering a truncated snapshot should fail")
+	}
+	if other.Len() != 1 || other.Queue[0].Value != "x" || other.Id != 1 {
+		t.Errorf("Failed recovery left %v (id %d)", other.Queue, other.Id)
+	}
+	if err := other.RecoverSnapshot(data); err != nil || other.Len() != 2 || other.Id != 2 {
+		t.Errorf("Recovered %v (id %d, err: %v)", other.Queue, other.Id, err)
+	}
+	// and the same goes for a whole set of queues
+	qs := new(QueueSet)
+	qs.Init()
+	qs.Create("jobs")
+	data, err = qs.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes fails with %s", err)
+	}
+	restored := new(QueueSet)
+	restored.Init()
+	if err := restored.RecoverSnapshot(data[:len(data)-1]); err == nil {
+		t.Errorf("Recovering a truncated snapshot should fail")
+	}
+	if names := restored.Names(); len(names) != 1 {
+		t.Errorf("Failed recovery left queues %v", names)
+	}
+}
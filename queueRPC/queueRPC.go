@@ -1,7 +1,7 @@
 package queueRPC
 
 import (
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
 //	"log"
@@ -12,79 +12,79 @@ import (
 	"net"
 	"net/rpc"
 	"os"
+	"sync"
+	"time"
 )
 
-const DEBUG = 0
+const (
+	DEBUG = 0
+	// how often the master checks for in progress messages whose visibility timeout has lapsed
+	REQUEUE_INTERVAL = time.Second
+	// longest a POP may be held waiting for a message
+	MAX_WAIT = time.Minute
+	// how often a held POP checks for a message even without a push (delayed messages become ready with no push)
+	WAIT_RECHECK = time.Second
+)
 
 var server_log *level_log.Logger
 
 type Server struct {
 	ReplicaServer *vr.Replica
-	InputChan     chan queue.QCommandWithChannel
-	ClientTable   map[string]ClientTableEntry
+	// client commands go to Queue. With VR, that commits them, and commits are
+	// applied to Local on every replica. Without VR, they're the same durable queue
+	Queue vr.StateMachine
+	Local vr.StateMachine
 	UseVR bool
+	// POPs being held until something is pushed to their queue (oldest first). These only
+	// live on the master, and clients retry (and wait again) on the new master if it fails
+	Waiters     map[string][]chan bool
+	WaitersLock sync.Mutex
 }
 
-type ClientTableEntry struct {
-	SeqNumber uint
-	Response  *queue.QResponse
-}
-
+// Uid identifies the client session, and SeqNumber must increase with every new command
+// (but stay the same on retries). The queue keeps track of the latest SeqNumber
+// for each session so it never applies a retried command twice
 type ClientCommand struct {
 	Uid       string
 	SeqNumber uint
 	Command   *queue.QCommand
+	// when the client gives up on the command (zero for never), after which
+	// we stop waiting on its behalf
+	Deadline time.Time
 }
 
 type Null struct{}
 
-// wraps a DB command to conform to the vr.Command interface
-type CommandFunctor struct {
-	Command queue.QCommandWithChannel
+// replicatedQueue is the queue clients use with VR: applying a command commits it
+// through VR, which applies it to every replica's Local queue
+type replicatedQueue struct {
+	*vr.ReplicatedStateMachine
 }
 
-func (c CommandFunctor) CommitFunc(context interface{}) {
-	server := context.(*Server)
-	argsWithChannel := c.Command
-	// we make our own QCommandWithChannel so we (VR) can make sure the DB has committed before continuing on
-	newArgsWithChannel := queue.QCommandWithChannel{argsWithChannel.Cmd, make(chan *queue.QResponse)}
-	server.InputChan <- newArgsWithChannel
-	// wait til the DB has actually committed the transaction
-	result := <-newArgsWithChannel.Done
-	// and pass the result along to the server-side RPC
-	// (if we're not master .Done will be nil since channels aren't passed over RPC)
-	if argsWithChannel.Done != nil {
-		argsWithChannel.Done <- result
+func (q replicatedQueue) Apply(command interface{}) interface{} {
+	result, err := q.Submit(command)
+	if err != nil {
+		return &queue.QResponse{Error: err.Error()}
 	}
+	return result
 }
 
-func SnapshotFunc(context interface{}, SnapshotHandle func() uint) ([]byte, uint, error) {
-	s := context.(*Server)
-	command := &queue.QCommand{"SNAPSHOT", SnapshotHandle}
-
-	argsWithChannel := queue.QCommandWithChannel{command, make(chan *queue.QResponse)}
-	s.InputChan <- argsWithChannel
-
-	result := <-argsWithChannel.Done
-	if result.Error != "" {
-		return nil, 0, errors.New(result.Error)
+// submit is Apply, but returns failing to commit through VR (e.g. because the
+// master lost its quorum) as an error rather than in the response
+func (q replicatedQueue) submit(ctx context.Context, command *queue.QCommand) (*queue.QResponse, error) {
+	result, err := q.SubmitContext(ctx, command)
+	if err != nil {
+		return nil, err
 	}
-	snapshot := result.Reply.(queue.QSnapshot)
-	return snapshot.Data, snapshot.SnapshotIndex, nil
+	return result.(*queue.QResponse), nil
 }
 
-func LoadSnapshotFunc(context interface{}, data []byte) error {
-    s := context.(*Server)
-    command := &queue.QCommand{"LOAD_SNAPSHOT", data}
-
-    argsWithChannel := queue.QCommandWithChannel{command, make(chan *queue.QResponse)}
-    s.InputChan <- argsWithChannel
+func (q replicatedQueue) Snapshot(index func() uint) ([]byte, uint, error) {
+	return q.Machine.Snapshot(index)
+}
 
-    result := <-argsWithChannel.Done
-    if result.Error != "" {
-        return errors.New(result.Error)
-    }
-    return nil
+func (q replicatedQueue) Restore(data []byte) error {
+	return q.Machine.Restore(data)
 }
 
 func (s *Server) debug(level int, format string, args ...interface{}) {
@@ -93,14 +93,15 @@ func (s *Server) debug(level int, format string, args ...interface{}) {
 	server_log.Printf(level, str, args...)
 }
 
-// startDB starts the queue for the server
-func (s *Server) startQueue() {
-	input := make(chan queue.QCommandWithChannel, 1000)
-	s.InputChan = input
-	if (s.UseVR) {	
-		go queue.QueueServer(input)	
+// startQueue starts the queue for the server, keeping any files in dataDir
+func (s *Server) startQueue(dataDir string) {
+	if s.UseVR {
+		s.Local = queue.NewStateMachine(queue.QueueServer)
+		s.Queue = replicatedQueue{vr.Replicate(s.ReplicaServer, s.Local)}
 	} else {
-		go queuedisk.QueueServer(input)
+		s.Local = queuedisk.NewStateMachine(dataDir)
+		s.Queue = s.Local
+		s.ReplicaServer.UseStateMachine(s.Local)
 	}
 }
 
@@ -115,6 +116,11 @@ func SetupLog() {
 // startServer starts a TCP server that accepts client requests at the given port
 // and has information about the replica server
 func StartServer(address string, replica *vr.Replica, useVR bool) (*rpc.Server, error) {
+	return StartServerInDir(address, replica, useVR, "")
+}
+
+// StartServerInDir is StartServer, but keeps the queue's files (if it isn't using VR) in dataDir
+func StartServerInDir(address string, replica *vr.Replica, useVR bool, dataDir string) (*rpc.Server, error) {
 	SetupLog()
 
 	var err error
@@ -129,26 +135,20 @@ func StartServer(address string, replica *vr.Replica, useVR bool) (*rpc.Server,
 	}
 	serve := new(Server)
 	serve.ReplicaServer = replica
-	serve.ClientTable = make(map[string]ClientTableEntry)
 	serve.UseVR = useVR
-	serve.startQueue()
+	serve.Waiters = make(map[string][]chan bool)
+	serve.startQueue(dataDir)
 
-	replica.Context = serve
-	replica.SnapshotFunc = SnapshotFunc
-    replica.LoadSnapshotFunc = LoadSnapshotFunc
 	newServer := rpc.NewServer()
 	err = newServer.Register(serve)
 	if err != nil {
 		return nil, err
 	}
 
-	// have to gob.Register this struct so we can pass it through RPC
-	// as a generic interface{} (I don't understand the details that well,
-	// see http://stackoverflow.com/questions/21934730/gob-type-not-registered-for-interface-mapstringinterface)
-	gob.Register(CommandFunctor{})
-	gob.Register(queue.QCommandWithChannel{})
-	// Need to register all types that are returned within the QResponse
-	gob.Register(queue.QMessage{})
+	// Need to register all types that are passed within the QCommand and QResponse
+	queue.RegisterTypes()
+
+	go serve.requeueExpired()
 
 	serve.debug(DEBUG, "Server at %s trying to accept new client connections\n", address)
 	go newServer.Accept(listener)
@@ -156,9 +156,38 @@ func StartServer(address string, replica *vr.Replica, useVR bool) (*rpc.Server,
 	return newServer, nil
 }
 
+// requeueExpired runs forever, and whenever we're master and some in progress messages
+// have expired, submits a REQUEUE_EXPIRED command (which, with VR, is replicated so every
+// replica redelivers them in the same order, and without it, is logged like any other write)
+func (s *Server) requeueExpired() {
+	for {
+		time.Sleep(REQUEUE_INTERVAL)
+		if s.ReplicaServer.Stopped() || !s.ReplicaServer.IsMaster() {
+			continue
+		}
+		now := time.Now()
+		// check first (without going through VR) so we don't fill the log with no-ops
+		check := s.Local.Apply(&queue.QCommand{Command: "HAS_EXPIRED", Time: now}).(*queue.QResponse)
+		if check.Reply != true {
+			continue
+		}
+		result, err := s.submit(context.Background(), &queue.QCommand{Command: "REQUEUE_EXPIRED"})
+		if err != nil {
+			s.debug(DEBUG, "Couldn't requeue expired messages: %v", err)
+			continue
+		}
+		s.debug(DEBUG, "Requeued expired messages %v", result.Reply)
+		if requeued, ok := result.Reply.(map[string][]string); ok {
+			for name, ids := range requeued {
+				s.wake(name, len(ids))
+			}
+		}
+	}
+}
+
 // makes sure that replica is in appropriate state to respond to client request
 func (s *Server) checkState() error {
-	if s.ReplicaServer.Rstate.Status != vr.Normal {
+	if s.ReplicaServer.Status() != vr.Normal {
 		return errors.New("My state isn't normal")
 	}
 
@@ -177,7 +206,7 @@ func (s *Server) checkState() error {
 // returns the master id, as long as replica is in a normal state
 func (s *Server) GetMaster(args *Null, reply *uint) error {
 	//if in recovery state, error
-	if s.ReplicaServer.Rstate.Status != vr.Normal {
+	if s.ReplicaServer.Status() != vr.Normal {
 		return errors.New("Master Failover")
 	}
 
@@ -185,17 +214,136 @@ func (s *Server) GetMaster(args *Null, reply *uint) error {
 	return nil
 }
 
-func (s *Server) checkClientTable(args *ClientCommand) (*queue.QResponse, error) {
-	if res, ok := s.ClientTable[args.Uid]; ok {
-		if args.SeqNumber < res.SeqNumber || res.Response == nil {
-			return nil, errors.New("Old Request")
+// park registers a channel that's closed the next time something is pushed to the queue
+func (s *Server) park(name string) chan bool {
+	s.WaitersLock.Lock()
+	defer s.WaitersLock.Unlock()
+	wake := make(chan bool)
+	s.Waiters[name] = append(s.Waiters[name], wake)
+	return wake
+}
+
+// unpark removes a channel registered with park (if it hasn't been woken already)
+func (s *Server) unpark(name string, wake chan bool) {
+	s.WaitersLock.Lock()
+	defer s.WaitersLock.Unlock()
+	waiters := s.Waiters[name]
+	for i, w := range waiters {
+		if w == wake {
+			s.Waiters[name] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(s.Waiters[name]) == 0 {
+		delete(s.Waiters, name)
+	}
+}
+
+// wake wakes up the n POPs that have been waiting on the queue longest (one per
+// message that's become available, so they don't all go after the same one)
+func (s *Server) wake(name string, n int) {
+	s.WaitersLock.Lock()
+	defer s.WaitersLock.Unlock()
+	waiters := s.Waiters[name]
+	if n > len(waiters) {
+		n = len(waiters)
+	}
+	for _, w := range waiters[:n] {
+		close(w)
+	}
+	s.Waiters[name] = waiters[n:]
+	if len(s.Waiters[name]) == 0 {
+		delete(s.Waiters, name)
+	}
+}
+
+// ready reports whether the queue has a message ready to pop, going by the
+// commits we've already applied (so it doesn't add anything to the log)
+func (s *Server) ready(name string) bool {
+	result := s.Local.Apply(&queue.QCommand{Command: "PEEK", Queue: name, Time: time.Now()}).(*queue.QResponse)
+	// (other errors, e.g. a missing queue, are left for the POP itself to report)
+	return result.Error != "Nothing to peek"
+}
+
+// waitReady holds a POP that found nothing until its queue has a message ready,
+// and returns false if there still isn't one by the deadline. wake is the
+// channel the POP is parked with, and is replaced whenever it parks again
+func (s *Server) waitReady(ctx context.Context, name string, deadline time.Time, wake *chan bool) (bool, error) {
+	for {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return false, nil
+		}
+		if left > WAIT_RECHECK {
+			left = WAIT_RECHECK
 		}
-		if args.SeqNumber == res.SeqNumber {
-			return res.Response, nil
+		select {
+		case <-*wake:
+		case <-time.After(left):
+		case <-ctx.Done():
+			// the client has given up waiting
+			return false, ctx.Err()
 		}
+		s.unpark(name, *wake)
+
+		// we may have lost mastership while waiting, in which case the client retries on the new master
+		if err := s.checkState(); err != nil {
+			return false, err
+		}
+		// park before checking, so a push that commits in between still wakes us
+		*wake = s.park(name)
+		if s.ready(name) {
+			return true, nil
+		}
+	}
+}
+
+// waitTime is how long a command may be held if there's nothing to pop
+func waitTime(cmd *queue.QCommand) time.Duration {
+	var wait time.Duration
+	switch v := cmd.Value.(type) {
+	case queue.QPop:
+		wait = v.Wait
+	case queue.QPopBatch:
+		wait = v.Wait
+	}
+	if wait > MAX_WAIT {
+		wait = MAX_WAIT
+	}
+	return wait
+}
+
+// submit runs a command on the queue
+func (s *Server) submit(ctx context.Context, cmd *queue.QCommand) (*queue.QResponse, error) {
+	// the master picks the time for the command, so every replica computes the same lease deadlines
+	cmd.Time = time.Now()
+	if q, ok := s.Queue.(replicatedQueue); ok {
+		return q.submit(ctx, cmd)
 	}
+	return s.Queue.Apply(cmd).(*queue.QResponse), nil
+}
 
-	return nil, nil
+// apply runs the client's command on the queue and returns the result
+func (s *Server) apply(ctx context.Context, args *ClientCommand) (*queue.QResponse, error) {
+	args.Command.Client = args.Uid
+	args.Command.SeqNumber = args.SeqNumber
+	result, err := s.submit(ctx, args.Command)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error == "" {
+		switch args.Command.Command {
+		case "PUSH":
+			s.wake(args.Command.Queue, 1)
+		case "PUSH_BATCH":
+			values, _ := args.Command.Value.([]queue.QPush)
+			s.wake(args.Command.Queue, len(values))
+		case "DLQ_REPLAY":
+			replayed, _ := result.Reply.(int)
+			s.wake(args.Command.Queue, replayed)
+		}
+	}
+	return result, nil
 }
 
 func (s *Server) Send(args *ClientCommand, reply *queue.QResponse) error {
@@ -206,37 +354,45 @@ func (s *Server) Send(args *ClientCommand, reply *queue.QResponse) error {
 	}
 	
 	s.debug(DEBUG, "Received message with %v", args)
-	
-	/*
-	// check to see if client has already sent this request before
-	res, err := s.checkClientTable(args)
-	if err != nil {
-		return err
-	}
-	if res != nil {
-		reply = res
+
+	ctx, cancel := vr.DeadlineContext(args.Deadline)
+	defer cancel()
+	wait := waitTime(args.Command)
+	if wait <= 0 {
+		// (only POPs that may wait take part in wake ups, so nothing else uses up theirs)
+		result, err := s.apply(ctx, args)
+		if err != nil {
+			return err
+		}
+		*reply = *result
 		return nil
 	}
-
-	// place a new "in progress" (nil) entry in the client table
-	s.ClientTable[args.Uid] = ClientTableEntry{args.SeqNumber, nil}
-	*/
-
-	argsWithChannel := queue.QCommandWithChannel{args.Command, make(chan *queue.QResponse, 1)}
-	
-	if s.UseVR {
-		s.ReplicaServer.RunVR(CommandFunctor{argsWithChannel})
-	} else { // in this case, we're using disk 
-		s.InputChan <- argsWithChannel
+	name := args.Command.Queue
+	deadline := time.Now().Add(wait)
+	// park before trying, so a push that commits in between still wakes us
+	wake := s.park(name)
+	defer func() {
+		s.unpark(name, wake)
+	}()
+	for {
+		result, err := s.apply(ctx, args)
+		if err != nil {
+			// the client retries on the new master
+			return err
+		}
+		if result.Error != "Nothing to pop" {
+			*reply = *result
+			return nil
+		}
+		// only go through VR again once there's something to pop, so
+		// waiting POPs don't fill the log
+		ready, err := s.waitReady(ctx, name, deadline, &wake)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			*reply = *result
+			return nil
+		}
 	}
-
-	result := <-argsWithChannel.Done
-	*reply = *result
-
-	
-	// place the response entry into the client table
-	// s.ClientTable[args.Uid] = ClientTableEntry{s.ClientTable[args.Uid].SeqNumber, reply}
-
-	return nil
 }
-	
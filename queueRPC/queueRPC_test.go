@@ -0,0 +1,202 @@
+package queueRPC
+
+import (
+	"context"
+	"fmt"
+	queue "github.com/mgentili/goPhat/phatqueue"
+	"github.com/mgentili/goPhat/vr"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freeAddresses returns n local addresses nothing is listening on
+func freeAddresses(t *testing.T, n int) []string {
+	addresses := make([]string, n)
+	for i := range addresses {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses[i] = l.Addr().String()
+		defer l.Close()
+	}
+	return addresses
+}
+
+// startServers starts a replicated queue server (without RPC) on each of n
+// replicas, and returns them once one of them is master
+func startServers(t *testing.T, n int) []*Server {
+	dir, err := ioutil.TempDir("", "queueRPC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.RegisterTypes()
+	config := freeAddresses(t, n)
+	servers := make([]*Server, n)
+	for i := range servers {
+		dataDir := filepath.Join(dir, fmt.Sprint(i))
+		os.Mkdir(dataDir, 0777)
+		servers[i] = &Server{ReplicaServer: vr.RunAsReplicaInDir(uint(i), config, dataDir), UseVR: true,
+			Waiters: make(map[string][]chan bool)}
+		servers[i].startQueue(dataDir)
+	}
+	t.Cleanup(func() {
+		for _, s := range servers {
+			s.ReplicaServer.Shutdown()
+		}
+		os.RemoveAll(dir)
+	})
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, s := range servers {
+			if s.checkState() == nil {
+				return servers
+			}
+		}
+	}
+	t.Fatal("No master")
+	return nil
+}
+
+func master(servers []*Server) *Server {
+	for _, s := range servers {
+		if s.checkState() == nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func opNumber(r *vr.Replica) uint {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	return r.Rstate.OpNumber
+}
+
+func TestWaitingPopDoesntFillLog(t *testing.T) {
+	m := master(startServers(t, 3))
+	popped := make(chan *queue.QResponse, 1)
+	go func() {
+		reply := new(queue.QResponse)
+		pop := &ClientCommand{Uid: "w1", Command: &queue.QCommand{Command: "POP", Value: queue.QPop{Wait: 10 * time.Second}}}
+		if err := m.Send(pop, reply); err != nil {
+			t.Errorf("Waiting POP fails with %s", err)
+		}
+		popped <- reply
+	}()
+	// (the POP goes through VR once, and then waits without doing so again)
+	time.Sleep(WAIT_RECHECK / 2)
+	before := opNumber(m.ReplicaServer)
+	time.Sleep(2 * WAIT_RECHECK)
+	if after := opNumber(m.ReplicaServer); after != before {
+		t.Errorf("Waiting POP added %d ops to the log", after-before)
+	}
+	//
+	push := &ClientCommand{Uid: "w2", Command: &queue.QCommand{Command: "PUSH", Value: "hello"}}
+	if err := m.Send(push, new(queue.QResponse)); err != nil {
+		t.Fatalf("PUSH fails with %s", err)
+	}
+	select {
+	case reply := <-popped:
+		if reply.Error != "" || reply.Reply.(*queue.QMessage).Value != "hello" {
+			t.Errorf("Waiting POP returned %v (err: %s)", reply.Reply, reply.Error)
+		}
+	case <-time.After(WAIT_RECHECK / 2):
+		t.Errorf("Waiting POP wasn't woken by the PUSH")
+	}
+}
+
+func TestFollowerSubmit(t *testing.T) {
+	servers := startServers(t, 3)
+	for _, s := range servers {
+		if s == master(servers) {
+			continue
+		}
+		// (once it knows who the master is, the follower forwards it there, and gets the response back)
+		for deadline := time.Now().Add(vr.LEASE); s.ReplicaServer.Status() != vr.Normal; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Follower never got back to normal")
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), vr.LEASE)
+		defer cancel()
+		cmd := &queue.QCommand{Command: "CREATE_QUEUE", Queue: "forwarded", Time: time.Now()}
+		resp, err := s.Queue.(replicatedQueue).submit(ctx, cmd)
+		if err != nil || resp.Error != "" {
+			t.Fatalf("CREATE_QUEUE on a follower returned %v (err: %v)", resp, err)
+		}
+		return
+	}
+}
+
+// waiting is how many commands are waiting for a push to the queue
+func waiting(s *Server, name string) int {
+	s.WaitersLock.Lock()
+	defer s.WaitersLock.Unlock()
+	return len(s.Waiters[name])
+}
+
+func TestPushesWakeWaitingPops(t *testing.T) {
+	m := master(startServers(t, 3))
+	// other commands on the queue keep coming in the meantime, and mustn't take the POPs' wake ups
+	stop := make(chan bool)
+	defer close(stop)
+	for i := 0; i < 16; i++ {
+		go func(i int) {
+			for seq := uint(1); ; seq++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				peek := &ClientCommand{Uid: fmt.Sprint("peek", i), SeqNumber: seq, Command: &queue.QCommand{Command: "PEEK"}}
+				m.Send(peek, new(queue.QResponse))
+			}
+		}(i)
+	}
+	// (only POPs that may wait are woken by pushes)
+	for end := time.Now().Add(WAIT_RECHECK / 10); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		if n := waiting(m, ""); n > 0 {
+			t.Fatalf("%d commands waiting for a push, but none of them are waiting POPs", n)
+		}
+	}
+	const POPS = 5
+	popped := make(chan *queue.QResponse, POPS)
+	for i := 0; i < POPS; i++ {
+		// each POP starts waiting while others' commands are in flight, and then
+		// a push comes along for it (while the next POP starts waiting)
+		go func(i int) {
+			reply := new(queue.QResponse)
+			pop := &ClientCommand{Uid: fmt.Sprint("pop", i), Command: &queue.QCommand{Command: "POP", Value: queue.QPop{Wait: 10 * time.Second}}}
+			if err := m.Send(pop, reply); err != nil {
+				t.Errorf("Waiting POP fails with %s", err)
+			}
+			popped <- reply
+		}(i)
+		time.Sleep(2 * time.Millisecond)
+		go func(i int) {
+			push := &ClientCommand{Uid: fmt.Sprint("push", i), Command: &queue.QCommand{Command: "PUSH", Value: fmt.Sprint(i)}}
+			if err := m.Send(push, new(queue.QResponse)); err != nil {
+				t.Errorf("PUSH fails with %s", err)
+			}
+		}(i)
+	}
+	// each is woken by a push, rather than finding its message when it next rechecks
+	values := make(map[interface{}]bool)
+	timeout := time.After(WAIT_RECHECK / 2)
+	for i := 0; i < POPS; i++ {
+		select {
+		case reply := <-popped:
+			if msg, ok := reply.Reply.(*queue.QMessage); reply.Error != "" || !ok || values[msg.Value] {
+				t.Errorf("Waiting POP returned %#v (err: %s)", reply.Reply, reply.Error)
+			} else {
+				values[msg.Value] = true
+			}
+		case <-timeout:
+			t.Fatalf("Only %d of %d waiting POPs woken within %v", i, POPS, WAIT_RECHECK/2)
+		}
+	}
+}
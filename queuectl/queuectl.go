@@ -0,0 +1,137 @@
+package main
+
+// queuectl inspects a running queue without going through a worker's code, e.g.
+//   queuectl -servers "127.0.0.1:6000 127.0.0.1:6001 127.0.0.1:6002" -queue jobs list in_progress
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	queue "github.com/mgentili/goPhat/phatqueue"
+	"github.com/mgentili/goPhat/worker"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: queuectl [flags] command\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  peek                 show the next message a worker would pop\n")
+	fmt.Fprintf(os.Stderr, "  list [which]         list %s (default), %s or %s messages\n",
+		queue.LIST_QUEUED, queue.LIST_IN_PROGRESS, queue.LIST_DEAD_LETTER)
+	fmt.Fprintf(os.Stderr, "  purge                drop every queued and in progress message\n")
+	fmt.Fprintf(os.Stderr, "  stats                show the queue's statistics\n")
+	fmt.Fprintf(os.Stderr, "  queues               list the queues\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// formatValue shows strings as they are and binary payloads by size
+func formatValue(msg *queue.QMessage) string {
+	switch v := msg.Value.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []byte:
+		return fmt.Sprintf("<%d bytes %s>", len(v), msg.ContentType)
+	}
+	return fmt.Sprintf("%v", msg.Value)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func printMessage(out io.Writer, msg *queue.QMessage) {
+	owner := msg.Owner
+	if owner == "" {
+		owner = "-"
+	}
+	fmt.Fprintf(out, "%-8s pri=%-3d deliveries=%-3d owner=%-20s enqueued=%s deadline=%s %s\n",
+		msg.MessageID, msg.Priority, msg.Deliveries, owner,
+		formatTime(msg.EnqueueTime), formatTime(msg.Deadline), formatValue(msg))
+}
+
+// returned by run for commands it doesn't know
+var errUsage = errors.New("unknown command")
+
+// run carries out the command in args (see usage) on the worker's queue, writing the result to out
+func run(w *worker.Worker, args []string, offset int, limit int, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "peek":
+		msg, err := w.Peek()
+		if err != nil {
+			return err
+		}
+		printMessage(out, msg)
+	case "list":
+		which := queue.LIST_QUEUED
+		if len(args) > 1 {
+			which = args[1]
+		}
+		list, err := w.List(which, offset, limit)
+		if err != nil {
+			return err
+		}
+		for i := range list.Messages {
+			printMessage(out, &list.Messages[i])
+		}
+		fmt.Fprintf(out, "(%d of %d %s messages, starting at %d)\n", len(list.Messages), list.Total, which, offset)
+	case "purge":
+		n, err := w.Purge()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "purged %d messages\n", n)
+	case "stats":
+		stats, err := w.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%+v\n", *stats)
+	case "queues":
+		names, err := w.ListQueues()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Fprintf(out, "%q\n", name)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func main() {
+	rawServers := flag.String("servers", "127.0.0.1:6000 127.0.0.1:6001 127.0.0.1:6002", "Client addresses of the queue servers, space delimited")
+	queueName := flag.String("queue", queue.DEFAULT_QUEUE, "Queue to inspect")
+	offset := flag.Int("offset", 0, "First message to list")
+	limit := flag.Int("limit", 100, "Most messages to list")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	w, err := worker.NewWorker(strings.Fields(*rawServers), 0, "queuectl")
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Queue = *queueName
+
+	if err := run(w, flag.Args(), *offset, *limit, os.Stdout); err == errUsage {
+		usage()
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/mgentili/goPhat/queueRPC"
+	"github.com/mgentili/goPhat/vr"
+	"github.com/mgentili/goPhat/worker"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startWorker starts three queue servers replicating with VR (shut down once the
+// test is over), and returns a worker connected to them
+func startWorker(t *testing.T) *worker.Worker {
+	dir, err := ioutil.TempDir("", "queuectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := make([]string, 6)
+	for i := range addresses {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses[i] = l.Addr().String()
+		l.Close()
+	}
+	replicaConfig, clientConfig := addresses[:3], addresses[3:]
+	replicas := make([]*vr.Replica, len(replicaConfig))
+	for i := range replicas {
+		replicas[i] = vr.RunAsReplicaInDir(uint(i), replicaConfig, dir)
+		if _, err := queueRPC.StartServer(clientConfig[i], replicas[i], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, r := range replicas {
+			r.Shutdown()
+		}
+		os.RemoveAll(dir)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w, err := worker.NewWorkerContext(ctx, clientConfig, 0, "queuectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ListQueuesContext(ctx); err != nil {
+		t.Fatalf("No master: %s", err)
+	}
+	return w
+}
+
+func TestRun(t *testing.T) {
+	w := startWorker(t)
+	for _, v := range []string{"first", "second"} {
+		if err := w.Push(v); err != nil {
+			t.Fatalf("Push fails with %s", err)
+		}
+	}
+	if err := w.PushBytes([]byte{1, 2, 3}, "application/octet-stream", nil); err != nil {
+		t.Fatalf("PushBytes fails with %s", err)
+	}
+	w.Pop()
+
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"peek"}, []string{`"second"`, "deliveries=0"}},
+		{[]string{"list"}, []string{`"second"`, "<3 bytes application/octet-stream>", "(2 of 2 queued messages, starting at 0)"}},
+		{[]string{"list", "in_progress"}, []string{`"first"`, "deliveries=1", "(1 of 1 in_progress messages"}},
+		{[]string{"stats"}, []string{"Len:2", "InProgress:1", "Pushed:3"}},
+		{[]string{"queues"}, []string{`""`}},
+		{[]string{"purge"}, []string{"purged 3 messages"}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := run(w, test.args, 0, 100, &out); err != nil {
+			t.Errorf("%v fails with %s", test.args, err)
+			continue
+		}
+		for _, s := range test.expected {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("%v printed %q, expected it to contain %q", test.args, out.String(), s)
+			}
+		}
+	}
+	for _, args := range [][]string{nil, {"frobnicate"}} {
+		if err := run(w, args, 0, 100, ioutil.Discard); err != errUsage {
+			t.Errorf("%v returned %v, expected the usage error", args, err)
+		}
+	}
+	if err := run(w, []string{"peek"}, 0, 100, ioutil.Discard); err == nil {
+		t.Errorf("Peeking an empty queue should fail")
+	}
+}
@@ -1,221 +1,300 @@
 package queuedisk
 
 import (
-    "strconv"
-    "bytes"
-    "os"
-    "encoding/gob"
-    "encoding/binary"
-    "io/ioutil"
-    "github.com/mgentili/goPhat/phatlog"
-    queue "github.com/mgentili/goPhat/phatqueue"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	queue "github.com/mgentili/goPhat/phatqueue"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 )
 
 var log_file = "log.bin"
 var snapshot_file = "snapshot.bin"
-
-type MessageQueue struct {
-	Queue           []queue.QMessage
-	InProgress      map[string]queue.QMessage
-	Id              int
-    Log *phatlog.Log
-	logFilename string
-    logFilePtr *os.File
-    snapshotFilename string
-    OpsPerSnapshot int
-    OpCounter int
+var tmp_file = "tmp.bin"
+
+// every log record is the length of its payload and the payload's CRC-32 (4 bytes each),
+// followed by the payload, a gob encoded logRecord
+const RECORD_HEADER = 8
+
+// what the queue needs from its log file (so tests can inject faults)
+type logFile interface {
+	Write(b []byte) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
 }
 
-func (mq *MessageQueue) Init(TmpOpsPerSnapshot int) {
-	mq.InProgress = make(map[string]queue.QMessage)
-	mq.logFilename = log_file
-    mq.snapshotFilename = snapshot_file
-	mq.Log = phatlog.EmptyLog()
-    mq.OpsPerSnapshot = TmpOpsPerSnapshot
-    mq.OpCounter = 0
-
-    //recover from snapshot if available
-	_, err := os.Stat(mq.snapshotFilename)
-    if !os.IsNotExist(err) {
-        mq.RecoverSnapshot(mq.snapshotFilename)
-    }
-
-    //recover from log if available
-	_, err = os.Stat(mq.logFilename)
-    if !os.IsNotExist(err) {
-        mq.RecoverLog(mq.logFilename)
-    }
-
-    mq.logFilePtr, _  = os.OpenFile(mq.logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+// opens the log file for appending
+var openLog = func(filename string) (logFile, error) {
+	return os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 }
 
-func (mq *MessageQueue) NextID() int {
-	mq.Id += 1
-	return mq.Id
+// a logged write. They're numbered so that recovery can tell which ones the snapshot already has
+type logRecord struct {
+	Index   uint64
+	Command queue.QCommand
 }
 
-func (mq *MessageQueue) Push(v interface{}) {
-	qm := queue.QMessage{strconv.Itoa(mq.NextID()), v}
-	mq.Queue = append(mq.Queue, qm)
-    mq.BackupLog(queue.LogEntry{Message:qm, Command:"PUSH"})
-    mq.OpCounter++
-    mq.CheckSnapshot()
+// QueueSet is a phatqueue.QueueSet kept on disk. Writes are logged as commands, and
+// since commands carry their time, replaying them over the last snapshot gets back
+// exactly the same queues (client table included)
+type QueueSet struct {
+	Queues *queue.QueueSet
+	// number of the last write applied
+	Index            uint64
+	logFilename      string
+	logFilePtr       logFile
+	logSize          int64 // length of the complete records in the log file
+	unsynced         bool  // whether records have been written since the last Sync
+	dataDir          string
+	snapshotFilename string
+	tmpFilename      string
+	OpsPerSnapshot   int
+	OpCounter        int
 }
 
-func (mq *MessageQueue) Pop() *queue.QMessage {
-	if mq.Len() == 0 {
-		return nil
+// Init sets up the queues, recovering whatever was saved in dataDir ("" for the current directory)
+func (qs *QueueSet) Init(TmpOpsPerSnapshot int, dataDir string) error {
+	// commands and responses are logged, so gob needs to know what can be in them
+	queue.RegisterTypes()
+	qs.Queues = new(queue.QueueSet)
+	qs.Queues.Init()
+	qs.Index = 0
+	qs.dataDir = dataDir
+	qs.logFilename = filepath.Join(dataDir, log_file)
+	qs.snapshotFilename = filepath.Join(dataDir, snapshot_file)
+	qs.tmpFilename = filepath.Join(dataDir, tmp_file)
+	qs.OpsPerSnapshot = TmpOpsPerSnapshot
+	qs.OpCounter = 0
+
+	//recover from snapshot if available
+	if _, err := os.Stat(qs.snapshotFilename); !os.IsNotExist(err) {
+		if err := qs.RecoverSnapshot(qs.snapshotFilename); err != nil {
+			return err
+		}
 	}
-    var qm queue.QMessage
-    qm, mq.Queue = mq.Queue[len(mq.Queue)-1], mq.Queue[:len(mq.Queue)-1]
-    mq.BackupLog(queue.LogEntry{Command:"POP"})
-    mq.OpCounter++
-    mq.CheckSnapshot()
-	return &qm
-}
-
-//ReplayPush/Pop modify the queue in the same way, but do not add to
-//logging file (since they are already there!)
-func (mq *MessageQueue) ReplayPush(v interface{}) {
-	qm := queue.QMessage{strconv.Itoa(mq.NextID()), v}
-	mq.Queue = append(mq.Queue, qm)
-}
 
-func (mq *MessageQueue) ReplayPop() *queue.QMessage {
-	if mq.Len() == 0 {
-		return nil
+	//recover from log if available
+	if _, err := os.Stat(qs.logFilename); !os.IsNotExist(err) {
+		if err := qs.RecoverLog(qs.logFilename); err != nil {
+			return err
+		}
 	}
-    var qm queue.QMessage
-    qm, mq.Queue = mq.Queue[len(mq.Queue)-1], mq.Queue[:len(mq.Queue)-1]
-	return &qm
-}
-
-func (mq *MessageQueue) Done(mId string) {
-	delete(mq.InProgress, mId)
-}
 
-func (mq *MessageQueue) Len() int {
-	return len(mq.Queue)
+	var err error
+	qs.logFilePtr, err = openLog(qs.logFilename)
+	return err
 }
 
-func (mq *MessageQueue) LenInProgress() int {
-	return len(mq.InProgress)
+// Apply runs a command on the queues (see phatqueue.QueueSet.Apply). Like every write,
+// it's logged before it's applied, so an error logging it means it didn't happen.
+// It isn't durable until the next Sync though
+func (qs *QueueSet) Apply(req *queue.QCommand) *queue.QResponse {
+	if !queue.IsWrite(req.Command) {
+		return qs.Queues.Apply(req)
+	}
+	if err := qs.BackupLog(logRecord{qs.Index + 1, *req}); err != nil {
+		return &queue.QResponse{Error: err.Error()}
+	}
+	qs.Index++
+	resp := qs.Queues.Apply(req)
+	qs.CheckSnapshot()
+	return resp
 }
 
-//periodically snapshot when we have done enough operations
-func (mq *MessageQueue) CheckSnapshot() {
-    if mq.OpCounter >= mq.OpsPerSnapshot {
-        mq.Snapshot()
-        mq.OpCounter = 0
-    }
+//periodically snapshot when we have done enough operations. If it fails, everything
+//is still in the log, so we just try again after the next operation
+func (qs *QueueSet) CheckSnapshot() {
+	qs.OpCounter++
+	if qs.OpCounter >= qs.OpsPerSnapshot {
+		qs.Snapshot()
+	}
 }
 
 //recover the snapshot from disk
-func (mq *MessageQueue) RecoverSnapshot(filename string) error {
-    var r []byte
+func (qs *QueueSet) RecoverSnapshot(filename string) error {
 	r, err := ioutil.ReadFile(filename)
-
-    dec := gob.NewDecoder(bytes.NewBuffer(r))
-	err = dec.Decode(&mq.Queue)
-	err = dec.Decode(&mq.InProgress)
-	err = dec.Decode(&mq.Id)
 	if err != nil {
 		return err
-    }
-
-    return nil
+	}
+	return qs.Restore(r)
 }
 
-//recover the log from disk
-func (mq *MessageQueue) RecoverLog(filename string) {
-	var r []byte
-	r, _ = ioutil.ReadFile(filename)
-    logEntries := mq.ParseLogFile(r)
-
-    for _, entry := range logEntries {
-        switch entry.Command {
-            case "PUSH":
-                mq.ReplayPush(entry.Message)
-            case "POP":
-                mq.ReplayPop()
-            }
-    }
+//replace the queues with a snapshot's (leaving them as they were if that fails)
+func (qs *QueueSet) Restore(r []byte) error {
+	var index uint64
+	var data []byte
+	dec := gob.NewDecoder(bytes.NewBuffer(r))
+	if err := dec.Decode(&index); err != nil {
+		return err
+	}
+	if err := dec.Decode(&data); err != nil {
+		return err
+	}
+	queues := new(queue.QueueSet)
+	if err := queues.RecoverSnapshot(data); err != nil {
+		return err
+	}
+	qs.Queues, qs.Index = queues, index
+	return nil
 }
 
-//parses the binary log file into log entries
-func (mq *MessageQueue) ParseLogFile(buffer []byte) []queue.LogEntry {
-    gob.Register(queue.LogEntry{})
-    logEntries := []queue.LogEntry{}
+//recover the log from disk. Anything after the last complete, intact record was
+//being written when we crashed, so it's cut off (and was never acknowledged)
+func (qs *QueueSet) RecoverLog(filename string) error {
+	r, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	records, valid := qs.ParseLogFile(r)
+	if valid < len(r) {
+		if err := os.Truncate(filename, int64(valid)); err != nil {
+			return err
+		}
+	}
+	qs.logSize = int64(valid)
 
-    buf_len := len(buffer)
-    beg_idx := 0
-    int_len := 4
+	for _, record := range records {
+		qs.replay(record)
+	}
+	return nil
+}
 
-    for beg_idx < buf_len {
-        le := queue.LogEntry{}
+//replay applies a logged write without logging it again. The log is only cleared
+//after a snapshot is saved, so writes the snapshot already has are skipped
+func (qs *QueueSet) replay(record logRecord) {
+	if record.Index <= qs.Index {
+		return
+	}
+	qs.Queues.Apply(&record.Command)
+	qs.Index = record.Index
+}
 
-        length := int(binary.LittleEndian.Uint32(buffer[beg_idx:beg_idx + int_len]))
-        beg_idx += int_len
-        decoder := gob.NewDecoder(bytes.NewBuffer(buffer[beg_idx:beg_idx+length]))
-        decoder.Decode(&le)
-        logEntries = append(logEntries, le)
-        beg_idx += length
-    }
-    return logEntries
+//parses the binary log file into log records, stopping at the first one that's
+//incomplete or fails its checksum. Also returns the length of the records it parsed
+func (qs *QueueSet) ParseLogFile(buffer []byte) ([]logRecord, int) {
+	records := []logRecord{}
+	valid := 0
+
+	for len(buffer)-valid >= RECORD_HEADER {
+		length := int(binary.LittleEndian.Uint32(buffer[valid:]))
+		checksum := binary.LittleEndian.Uint32(buffer[valid+4:])
+		start := valid + RECORD_HEADER
+		if length > len(buffer)-start {
+			break
+		}
+		payload := buffer[start : start+length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		record := logRecord{}
+		if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(&record); err != nil {
+			break
+		}
+		records = append(records, record)
+		valid = start + length
+	}
+	return records, valid
 }
 
 //write copy of log to disk
-func (mq *MessageQueue) BackupLog(logentry queue.LogEntry) error {
-    gob.Register(queue.LogEntry{})
-    w := new(bytes.Buffer)
-    encoder := gob.NewEncoder(w)
-    err := encoder.Encode(logentry)
-
-    if err != nil {
+func (qs *QueueSet) BackupLog(record logRecord) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(record); err != nil {
 		return err
 	}
+	buf := make([]byte, RECORD_HEADER+payload.Len())
+	binary.LittleEndian.PutUint32(buf, uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(buf[RECORD_HEADER:], payload.Bytes())
 
-    //write the size of the logentry to the file
-    bs := make([]byte, 4)
-    binary.LittleEndian.PutUint32(bs, uint32(len(w.Bytes())))
-    _, err = mq.logFilePtr.Write(bs)
-
-    //write the logentry to the file
-    _, err = mq.logFilePtr.Write(w.Bytes())
-
+	_, err := qs.logFilePtr.Write(buf)
 	if err != nil {
+		// don't leave part of a record for the next one to be appended to
+		qs.logFilePtr.Truncate(qs.logSize)
 		return err
 	}
+	qs.logSize += int64(len(buf))
+	qs.unsynced = true
+	return nil
+}
 
-    mq.logFilePtr.Sync()
-
+//make everything logged so far durable. This is the expensive part of logging,
+//so callers should do as many operations as they can per Sync
+func (qs *QueueSet) Sync() error {
+	if !qs.unsynced {
+		return nil
+	}
+	if err := qs.logFilePtr.Sync(); err != nil {
+		return err
+	}
+	qs.unsynced = false
 	return nil
 }
 
-func (mq *MessageQueue) Snapshot() {
-    queuebytes, _ := mq.Bytes()
-    temp_file := "tmp.bin"
-    f, _  := os.OpenFile(temp_file, os.O_CREATE|os.O_WRONLY, 0666)
-    f.Write(queuebytes)
-    f.Sync()
-    f.Close()
-    os.Rename(temp_file, snapshot_file)
+//throw away the queues in memory and recover them from disk again, e.g. after a failed
+//Sync, when we can't tell which of the operations since the last one will survive
+func (qs *QueueSet) Reload() error {
+	opsPerSnapshot, dataDir := qs.OpsPerSnapshot, qs.dataDir
+	if qs.logFilePtr != nil {
+		qs.logFilePtr.Close()
+	}
+	*qs = QueueSet{}
+	return qs.Init(opsPerSnapshot, dataDir)
+}
 
-    //clear logfile since we just snapshotted
-    mq.logFilePtr.Close()
-    os.Remove(mq.logFilename)
-    mq.logFilePtr, _  = os.OpenFile(mq.logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+//save all the queues to the snapshot file and clear the log
+func (qs *QueueSet) Snapshot() error {
+	queuebytes, err := qs.Bytes()
+	if err != nil {
+		return err
+	}
+	// write to a temp file first, so the snapshot is replaced atomically
+	f, err := os.OpenFile(qs.tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(queuebytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(qs.tmpFilename, qs.snapshotFilename); err != nil {
+		return err
+	}
 
+	//clear logfile since we just snapshotted
+	if err := qs.logFilePtr.Truncate(0); err != nil {
+		return err
+	}
+	// the snapshot has everything the log did (and is synced)
+	qs.logSize = 0
+	qs.unsynced = false
+	qs.OpCounter = 0
+	return nil
 }
 
-func (mq *MessageQueue) Bytes() ([]byte, error) {
-	var queueState bytes.Buffer
-	enc := gob.NewEncoder(&queueState)
-	err := enc.Encode(mq.Queue)
-	err = enc.Encode(mq.InProgress)
-	err = enc.Encode(mq.Id)
+// Bytes encodes the queues along with the number of the last write they include
+func (qs *QueueSet) Bytes() ([]byte, error) {
+	data, err := qs.Queues.Bytes()
 	if err != nil {
 		return nil, err
 	}
-	return queueState.Bytes(), nil
+	var state bytes.Buffer
+	enc := gob.NewEncoder(&state)
+	if err := enc.Encode(qs.Index); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(data); err != nil {
+		return nil, err
+	}
+	return state.Bytes(), nil
 }
@@ -6,38 +6,114 @@ import (
 
 var OpsPerCommit = 100
 
+// most requests that share one fsync
+const MAX_GROUP_COMMIT = 1000
+
 func QueueServer(input chan queue.QCommandWithChannel) {
-	// Set up the queue
-	mq := MessageQueue{}
-	mq.Init(OpsPerCommit)
-
-	// Enter the command loop
-	for {
-		request := <-input
-		req := request.Cmd
-		resp := &queue.QResponse{}
-		switch req.Command {
-		case "PUSH":
-			mq.Push(req.Value)
-		case "POP":
-			v := mq.Pop()
-			if v != nil {
-				resp.Reply = v
+	QueueServerInDir(input, "")
+}
+
+// NewStateMachine returns a single node, durable set of queues (kept in dataDir) as a vr.StateMachine
+func NewStateMachine(dataDir string) *queue.StateMachine {
+	return queue.NewStateMachine(func(input chan queue.QCommandWithChannel) {
+		QueueServerInDir(input, dataDir)
+	})
+}
+
+// QueueServerInDir is QueueServer, but keeps the queue's files in dataDir
+// instead of the current directory
+func QueueServerInDir(input chan queue.QCommandWithChannel, dataDir string) {
+	// Set up the queues
+	qs := QueueSet{}
+	initErr := qs.Init(OpsPerCommit, dataDir)
+
+	// Enter the command loop (until input is closed)
+	for request := range input {
+		// group commit: take every request that's already waiting, so a single
+		// fsync makes all of their log records durable
+		batch := []queue.QCommandWithChannel{request}
+	collect:
+		for len(batch) < MAX_GROUP_COMMIT {
+			select {
+			case request, ok := <-input:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, request)
+			default:
+				break collect
+			}
+		}
+
+		responses := make([]*queue.QResponse, len(batch))
+		for i, request := range batch {
+			// if we couldn't recover, it's not safe to do anything
+			if initErr != nil {
+				responses[i] = &queue.QResponse{Error: "Couldn't recover queue: " + initErr.Error()}
 			} else {
-				resp.Error = "Nothing to pop"
+				responses[i] = apply(&qs, request.Cmd)
+			}
+		}
+
+		// nobody hears about anything in the batch until it's on disk
+		if initErr == nil {
+			if err := qs.Sync(); err != nil {
+				for _, resp := range responses {
+					resp.Reply = nil
+					resp.Error = "Couldn't write to disk: " + err.Error()
+				}
+				// none of the batch can be trusted, so start again from what's on disk
+				initErr = qs.Reload()
 			}
-        case "SNAPSHOT":
-            mq.Snapshot()
-		case "DONE":
-			mq.Done(req.Value.(string))
-		case "LEN":
-			resp.Reply = mq.Len()
-		case "LEN_IN_PROGRESS":
-			resp.Reply = mq.LenInProgress()
-		default:
-			resp.Error = "Unknown command"
-		}
-
-		request.Done <- resp
+		}
+		for i, request := range batch {
+			request.Done <- responses[i]
+		}
+	}
+	if qs.logFilePtr != nil {
+		qs.logFilePtr.Close()
+	}
+}
+
+// apply runs a single command, without waiting for its log record to be synced
+func apply(qs *QueueSet, req *queue.QCommand) *queue.QResponse {
+	resp := &queue.QResponse{}
+	switch req.Command {
+	case "SNAPSHOT":
+		err := qs.Snapshot()
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		data, err := qs.Bytes()
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		// the value is an optional func giving the index to return with the data
+		var index uint
+		if snapshotIndex, ok := req.Value.(func() uint); ok {
+			index = snapshotIndex()
+		}
+		resp.Reply = queue.QSnapshot{Data: data, SnapshotIndex: index}
+	case "LOAD_SNAPSHOT":
+		data, ok := req.Value.([]byte)
+		if !ok {
+			resp.Error = "LOAD_SNAPSHOT takes a []byte"
+			break
+		}
+		err := qs.Restore(data)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		// save it, since the log we have doesn't apply to it
+		err = qs.Snapshot()
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	default:
+		return qs.Apply(req)
 	}
+	return resp
 }
@@ -1,35 +1,196 @@
 package queuedisk
 
 import (
-	"testing"
+	"errors"
+	"fmt"
 	queue "github.com/mgentili/goPhat/phatqueue"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
 )
 
 func TestQServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queuedisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
 	input := make(chan queue.QCommandWithChannel)
-	go QueueServer(input)
+	go QueueServerInDir(input, dir)
 
 	elems := []string{"/dev/nulled", "/dev/random", "/dev/urandom"}
     for i := 0; i < 100; i++ {
 	for _, val := range elems {
 		// Place an object on the queue
-		pushCmd := queue.QCommandWithChannel{&queue.QCommand{"PUSH", val}, make(chan *queue.QResponse)}
+		pushCmd := queue.QCommandWithChannel{Cmd: &queue.QCommand{Command: "PUSH", Value: val, Time: now}, Done: make(chan *queue.QResponse)}
 		input <- pushCmd
 		<-pushCmd.Done
 }
-    popCmd := queue.QCommandWithChannel{&queue.QCommand{"POP", ""}, make(chan *queue.QResponse)}
+    popCmd := queue.QCommandWithChannel{Cmd: &queue.QCommand{Command: "POP", Value: "", Time: now}, Done: make(chan *queue.QResponse)}
     input <- popCmd
     <-popCmd.Done
 
     }
-    popCmd := queue.QCommandWithChannel{&queue.QCommand{"POP", ""}, make(chan *queue.QResponse)}
+    popCmd := queue.QCommandWithChannel{Cmd: &queue.QCommand{Command: "POP", Value: "", Time: now}, Done: make(chan *queue.QResponse)}
     input <- popCmd
     <-popCmd.Done
 
 
-    popCmd = queue.QCommandWithChannel{&queue.QCommand{"POP", ""}, make(chan *queue.QResponse)}
+    popCmd = queue.QCommandWithChannel{Cmd: &queue.QCommand{Command: "POP", Value: "", Time: now}, Done: make(chan *queue.QResponse)}
     input <- popCmd
     <-popCmd.Done
 
 }
+
+func TestStateMachine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queuedisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//
+	sm := NewStateMachine(dir)
+	for _, val := range []string{"a", "b", "c"} {
+		sm.Apply(&queue.QCommand{Command: "PUSH", Value: val, Time: now})
+	}
+	sm.Apply(&queue.QCommand{Command: "POP", Time: now})
+	data, index, err := sm.Snapshot(func() uint { return 3 })
+	if err != nil || index != 3 {
+		t.Fatalf("Snapshot returned index %d (err: %v)", index, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshot_file)); err != nil {
+		t.Errorf("Snapshot wasn't saved in the data directory: %s", err)
+	}
+	// a queue started in the same directory picks up where the first left off
+	sm.Apply(&queue.QCommand{Command: "PUSH", Value: "d", Time: now})
+	if resp := NewStateMachine(dir).Apply(&queue.QCommand{Command: "LEN"}).(*queue.QResponse); resp.Reply != 3 {
+		t.Errorf("Recovered queue has %v messages instead of 3", resp.Reply)
+	}
+	// and restoring a snapshot replaces the whole queue
+	other, _ := ioutil.TempDir("", "queuedisk")
+	defer os.RemoveAll(other)
+	restored := NewStateMachine(other)
+	restored.Apply(&queue.QCommand{Command: "PUSH", Value: "x", Time: now})
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("Restore fails with %s", err)
+	}
+	if resp := restored.Apply(&queue.QCommand{Command: "LEN"}).(*queue.QResponse); resp.Reply != 2 {
+		t.Errorf("Restored queue has %v messages instead of 2", resp.Reply)
+	}
+}
+
+// countingLog counts syncs, and fails the next one if failSync is set
+type countingLog struct {
+	*os.File
+	syncs    *int32
+	failSync *int32
+}
+
+func (l countingLog) Sync() error {
+	if atomic.CompareAndSwapInt32(l.failSync, 1, 0) {
+		return errors.New("disk on fire")
+	}
+	atomic.AddInt32(l.syncs, 1)
+	return l.File.Sync()
+}
+
+func TestGroupCommit(t *testing.T) {
+	defer func(open func(string) (logFile, error)) { openLog = open }(openLog)
+	var syncs, failSync int32
+	openLog = func(filename string) (logFile, error) {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		return countingLog{f, &syncs, &failSync}, err
+	}
+	dir, err := ioutil.TempDir("", "queuedisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//
+	sm := NewStateMachine(dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if resp := sm.Apply(&queue.QCommand{Command: "PUSH", Value: fmt.Sprint(i), Time: now}).(*queue.QResponse); resp.Error != "" {
+				t.Errorf("PUSH fails with %s", resp.Error)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if syncs >= 200 {
+		t.Errorf("%d syncs for 200 concurrent pushes", syncs)
+	}
+	if resp := sm.Apply(&queue.QCommand{Command: "LEN"}).(*queue.QResponse); resp.Reply != 200 {
+		t.Errorf("%v messages were pushed instead of 200", resp.Reply)
+	}
+	// if a sync fails, the batch fails and the queue goes back to what's on disk
+	atomic.StoreInt32(&failSync, 1)
+	if resp := sm.Apply(&queue.QCommand{Command: "POP", Time: now}).(*queue.QResponse); resp.Error == "" {
+		t.Errorf("POP should fail when the disk does")
+	}
+	if resp := sm.Apply(&queue.QCommand{Command: "POP", Time: now}).(*queue.QResponse); resp.Error != "" {
+		t.Errorf("POP after reloading fails with %s", resp.Error)
+	}
+}
+
+func TestDiskCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queuedisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sm := NewStateMachine(dir)
+	clock := now
+	send := func(cmd *queue.QCommand) *queue.QResponse {
+		cmd.Time = clock
+		return sm.Apply(cmd).(*queue.QResponse)
+	}
+	//
+	if resp := send(&queue.QCommand{Command: "CREATE_QUEUE", Queue: "jobs", Value: 1}); resp.Error != "" {
+		t.Fatalf("CREATE_QUEUE fails with %s", resp.Error)
+	}
+	push := &queue.QCommand{Command: "PUSH_BATCH", Value: []queue.QPush{{Value: "a"}, {Value: "b"}}, Queue: "jobs", Client: "w1", SeqNumber: 0}
+	send(push)
+	// a retry isn't applied again
+	send(push)
+	if resp := send(&queue.QCommand{Command: "LEN", Queue: "jobs"}); resp.Reply != 2 {
+		t.Errorf("jobs has %v messages instead of 2", resp.Reply)
+	}
+	if resp := send(&queue.QCommand{Command: "LEN"}); resp.Reply != 0 {
+		t.Errorf("Default queue has %v messages instead of 0", resp.Reply)
+	}
+	resp := send(&queue.QCommand{Command: "POP_BATCH", Value: queue.QPopBatch{Max: 2, Timeout: time.Second}, Queue: "jobs"})
+	if resp.Error != "" || len(resp.Reply.([]queue.QMessage)) != 2 {
+		t.Fatalf("POP_BATCH returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	a := resp.Reply.([]queue.QMessage)[0].MessageID
+	if resp := send(&queue.QCommand{Command: "EXTEND", Value: queue.QExtend{MessageID: a, Timeout: time.Hour}, Queue: "jobs"}); resp.Error != "" {
+		t.Errorf("EXTEND fails with %s", resp.Error)
+	}
+	// b's lease runs out, and it's only allowed one delivery, so it's dead lettered
+	clock = clock.Add(time.Minute)
+	send(&queue.QCommand{Command: "REQUEUE_EXPIRED"})
+	//
+	// everything survives a restart, including the client table
+	sm = NewStateMachine(dir)
+	send(push)
+	if resp := send(&queue.QCommand{Command: "LEN_IN_PROGRESS", Queue: "jobs"}); resp.Reply != 1 {
+		t.Errorf("jobs has %v messages in progress instead of 1", resp.Reply)
+	}
+	if resp := send(&queue.QCommand{Command: "DLQ_LIST", Queue: "jobs"}); len(resp.Reply.([]queue.QMessage)) != 1 {
+		t.Errorf("Dead letters are %v (err: %s)", resp.Reply, resp.Error)
+	}
+	if resp := send(&queue.QCommand{Command: "DLQ_REPLAY", Value: "", Queue: "jobs"}); resp.Reply != 1 {
+		t.Errorf("DLQ_REPLAY returned %v (err: %s)", resp.Reply, resp.Error)
+	}
+	if resp := send(&queue.QCommand{Command: "LEN", Queue: "jobs"}); resp.Reply != 1 {
+		t.Errorf("jobs has %v messages instead of 1", resp.Reply)
+	}
+}
@@ -0,0 +1,199 @@
+package queuedisk
+
+import (
+	"errors"
+	"fmt"
+	queue "github.com/mgentili/goPhat/phatqueue"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// crashingLog writes its first budget bytes, then fails as if the process had been
+// killed: the write is cut short and nothing after it (e.g. truncating) reaches the file
+type crashingLog struct {
+	f      *os.File
+	budget int
+}
+
+var errCrashed = errors.New("crashed")
+
+func (l *crashingLog) Write(b []byte) (int, error) {
+	if l.budget >= len(b) {
+		l.budget -= len(b)
+		return l.f.Write(b)
+	}
+	n, _ := l.f.Write(b[:l.budget])
+	l.budget = -1
+	return n, errCrashed
+}
+
+func (l *crashingLog) Sync() error {
+	if l.budget < 0 {
+		return errCrashed
+	}
+	return l.f.Sync()
+}
+
+func (l *crashingLog) Truncate(size int64) error {
+	if l.budget < 0 {
+		return errCrashed
+	}
+	return l.f.Truncate(size)
+}
+
+func (l *crashingLog) Close() error {
+	return l.f.Close()
+}
+
+// the time every command in these tests is sent at
+var now = time.Now()
+
+func send(qs *QueueSet, command string, value interface{}) *queue.QResponse {
+	return qs.Apply(&queue.QCommand{Command: command, Value: value, Time: now})
+}
+
+func counts(qs *QueueSet) (queued int, inProgress int) {
+	return send(qs, "LEN", nil).Reply.(int), send(qs, "LEN_IN_PROGRESS", nil).Reply.(int)
+}
+
+// runUntilCrash pushes, pops and acknowledges messages until the log fails, and
+// returns how many messages should be queued and in progress afterwards.
+// Operations only count once they've been synced
+func runUntilCrash(qs *QueueSet) (queued int, inProgress int) {
+	synced := func(resp *queue.QResponse) bool {
+		return resp.Error == "" && qs.Sync() == nil
+	}
+	for i := 0; ; i++ {
+		if !synced(send(qs, "PUSH", fmt.Sprintf("m%d", i))) {
+			return
+		}
+		queued++
+		if i%3 == 0 {
+			resp := send(qs, "POP", nil)
+			if !synced(resp) {
+				return
+			}
+			queued--
+			inProgress++
+			if i%2 == 0 {
+				if !synced(send(qs, "DONE", resp.Reply.(*queue.QMessage).MessageID)) {
+					return
+				}
+				inProgress--
+			}
+		}
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	defer func(open func(string) (logFile, error)) { openLog = open }(openLog)
+	r := rand.New(rand.NewSource(1))
+
+	for trial := 0; trial < 100; trial++ {
+		dir, err := ioutil.TempDir("", "queuedisk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		budget := r.Intn(20000)
+		openLog = func(filename string) (logFile, error) {
+			f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+			return &crashingLog{f, budget}, err
+		}
+		qs := QueueSet{}
+		// snapshot every so often, so some trials recover from a snapshot and a log
+		if err := qs.Init(37, dir); err != nil {
+			t.Fatal(err)
+		}
+		queued, inProgress := runUntilCrash(&qs)
+		qs.logFilePtr.Close()
+
+		openLog = func(filename string) (logFile, error) {
+			return os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		}
+		recovered := QueueSet{}
+		if err := recovered.Init(37, dir); err != nil {
+			t.Fatalf("Recovery after writing %d bytes fails with %s", budget, err)
+		}
+		if q, p := counts(&recovered); q != queued || p != inProgress {
+			t.Errorf("After writing %d bytes, recovered %d queued and %d in progress messages, expected %d and %d",
+				budget, q, p, queued, inProgress)
+		}
+		// the torn record is gone, so new records can be recovered too
+		send(&recovered, "PUSH", "after")
+		recovered.logFilePtr.Close()
+		again := QueueSet{}
+		again.Init(37, dir)
+		if q, _ := counts(&again); q != queued+1 {
+			t.Errorf("After writing %d bytes, %d messages are queued after another push, expected %d", budget, q, queued+1)
+		}
+		again.logFilePtr.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queuedisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//
+	qs := QueueSet{}
+	qs.Init(1000, dir)
+	send(&qs, "PUSH", "a")
+	size := qs.logSize
+	send(&qs, "PUSH", "b")
+	send(&qs, "PUSH", "c")
+	qs.logFilePtr.Close()
+	// flip a bit in the second record's payload
+	filename := filepath.Join(dir, log_file)
+	data, _ := ioutil.ReadFile(filename)
+	data[size+RECORD_HEADER+2] ^= 1
+	ioutil.WriteFile(filename, data, 0666)
+	//
+	recovered := QueueSet{}
+	if err := recovered.Init(1000, dir); err != nil {
+		t.Fatalf("Recovery fails with %s", err)
+	}
+	if q, _ := counts(&recovered); q != 1 || send(&recovered, "PEEK", nil).Reply.(*queue.QMessage).Value != "a" {
+		t.Errorf("Recovered %d messages, expected just a", q)
+	}
+	if info, _ := os.Stat(filename); info.Size() != size {
+		t.Errorf("Log is %d bytes after recovery, expected it cut to %d", info.Size(), size)
+	}
+}
+
+func TestCrashAfterSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queuedisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//
+	qs := QueueSet{}
+	qs.Init(1000, dir)
+	send(&qs, "PUSH", "a")
+	send(&qs, "PUSH", "b")
+	resp := send(&qs, "POP", nil)
+	send(&qs, "DONE", resp.Reply.(*queue.QMessage).MessageID)
+	send(&qs, "POP", nil)
+	filename := filepath.Join(dir, log_file)
+	oldLog, _ := ioutil.ReadFile(filename)
+	if err := qs.Snapshot(); err != nil {
+		t.Fatalf("Snapshot fails with %s", err)
+	}
+	qs.logFilePtr.Close()
+	// as if we crashed after saving the snapshot but before clearing the log
+	ioutil.WriteFile(filename, oldLog, 0666)
+	//
+	recovered := QueueSet{}
+	recovered.Init(1000, dir)
+	mq, _ := recovered.Queues.Get(queue.DEFAULT_QUEUE)
+	if q, p := counts(&recovered); q != 0 || p != 1 || mq.Id != 2 {
+		t.Errorf("Replaying the log again gave %d queued and %d in progress messages (id %d)", q, p, mq.Id)
+	}
+}
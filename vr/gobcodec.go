@@ -33,6 +33,11 @@ func (c *GobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err e
 		return
 	}
 	if err = c.enc.Encode(body); err != nil {
+		// the header's already gone out, so the caller would wait forever for the
+		// rest: close the connection instead (as net/rpc's own codec does)
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
 		return
 	}
 	return c.encBuf.Flush()
@@ -21,7 +21,8 @@ var VR_log *level_log.Logger
 
 func SetupVRLog() {
 	if VR_log == nil {
-		levelsToLog := []int{DEBUG, STATUS, ERROR}
+		// (add DEBUG and STATUS to follow what the replicas are up to)
+		levelsToLog := []int{ERROR}
 		VR_log = level_log.NewLL(os.Stdout, "VR: ")
 		VR_log.SetLevelsToLog(levelsToLog)
 	}
@@ -39,34 +40,80 @@ func wrongView() error {
 	return errors.New("view numbers don't match")
 }
 
+// Debug logs a message along with our view, op and commit numbers. The caller must
+// hold StateLock (logf is for those that don't)
 func (r *Replica) Debug(level int, format string, args ...interface{}) {
-	return
-	str := fmt.Sprintf("r%d: %s, %s", r.Rstate.ReplicaNumber, r.replicaStateInfo(), format)
-	VR_log.Printf(level, str, args...)
+	r.logf(level, r.replicaStateInfo()+", "+format, args...)
+}
+
+// logf logs a message tagged with just our replica number
+func (r *Replica) logf(level int, format string, args ...interface{}) {
+	VR_log.Printf(level, fmt.Sprintf("r%d: %s", r.Rstate.ReplicaNumber, format), args...)
 }
 
 func (r *Replica) replicaStateInfo() string {
 	return fmt.Sprintf("{v: %d, o: %d, c:%d}", r.Rstate.View, r.Rstate.OpNumber, r.Rstate.CommitNumber)
-	//r.Debug(STATUS, "r%d: v:%d, o:%d, c:%d\n", r.Rstate.ReplicaNumber, r.Rstate.View, r.Rstate.OpNumber, r.Rstate.CommitNumber)
 }
 
 func (r *Replica) IsMaster() bool {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	return r.isMasterLocked()
+}
+
+// isMasterLocked is IsMaster for callers that hold StateLock
+func (r *Replica) isMasterLocked() bool {
 	// only consider ourself master if we're in Normal state!
 	return r.Rstate.View%NREPLICAS == r.Rstate.ReplicaNumber && r.Rstate.Status == Normal
 }
 
 func (r *Replica) GetMasterId() uint {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 	return r.Rstate.View % NREPLICAS
 }
 
+// Status returns our status (Normal, Recovery or ViewChange)
+func (r *Replica) Status() int {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	return r.Rstate.Status
+}
+
+// View returns our view number
+func (r *Replica) View() uint {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	return r.Rstate.View
+}
+
+// MasterSince returns when we became master (see MasterState.Since)
+func (r *Replica) MasterSince() time.Time {
+	r.Mstate.LeaseLock.Lock()
+	defer r.Mstate.LeaseLock.Unlock()
+	return r.Mstate.Since
+}
+
+// Stopped is whether we've been shut down
+func (r *Replica) Stopped() bool {
+	r.ConnLock.Lock()
+	defer r.ConnLock.Unlock()
+	return r.IsShutdown
+}
+
 func (mstate *MasterState) Reset() {
+	mstate.LeaseLock.Lock()
 	mstate.HighestOp = map[uint]uint{}
 	mstate.Heartbeats = map[uint]time.Time{}
+	// a new master only gets a lease once a majority replies to it
+	mstate.LeaseExpiry = time.Time{}
+	mstate.LeaseLock.Unlock()
 }
 
 // just closes the connections (doesn't stop timers, etc.)
 func (r *Replica) ShutdownIncoming() {
-	// TODO: locking
+	r.ConnLock.Lock()
+	defer r.ConnLock.Unlock()
 	if r.Listener != nil {
 		r.Listener.Close()
 	}
@@ -87,20 +134,24 @@ func (r *Replica) ShutdownOutgoing() {
 }
 
 func (r *Replica) Disconnect() {
+	r.ConnLock.Lock()
 	r.IsDisconnected = true
+	r.ConnLock.Unlock()
 	r.ShutdownIncoming()
 	r.ShutdownOutgoing()
 }
 
 func (r *Replica) Reconnect() {
-	assert(r.IsDisconnected)
 	ln, err := net.Listen("tcp", r.Config[r.Rstate.ReplicaNumber])
 	if err != nil {
-		r.Debug(ERROR, "Couldn't start a listener: %v", err)
+		r.logf(ERROR, "Couldn't start a listener: %v", err)
 		return
 	}
+	r.ConnLock.Lock()
+	assert(r.IsDisconnected)
 	r.Listener = ln
 	r.IsDisconnected = false
+	r.ConnLock.Unlock()
 	go r.ReplicaRun()
 }
 
@@ -109,30 +160,37 @@ func (r *Replica) Shutdown() {
 	r.Rstate.Timer.Stop()
 	r.Mstate.Timer.Stop()
 	r.Disconnect()
+	r.endTerm(errors.New("Shut down"))
 	r.Mstate.Reset()
+	r.ConnLock.Lock()
 	r.IsShutdown = true
+	r.ConnLock.Unlock()
 }
 
 func (r *Replica) ListenerInit() error {
 	ln, err := net.Listen("tcp", r.Config[r.Rstate.ReplicaNumber])
 	if err != nil {
-		r.Debug(ERROR, "Couldn't start a listener: %v", err)
+		r.logf(ERROR, "Couldn't start a listener: %v", err)
 		return err
 	}
+	r.ConnLock.Lock()
 	r.Listener = ln
+	r.ConnLock.Unlock()
 	return nil
 }
 
 func (r *Replica) Revive() {
 	ln, err := net.Listen("tcp", r.Config[r.Rstate.ReplicaNumber])
 	if err != nil {
-		r.Debug(ERROR, "Couldn't start a listener: %v", err)
+		r.logf(ERROR, "Couldn't start a listener: %v", err)
 		return
 	}
+	r.ConnLock.Lock()
 	r.Listener = ln
+	r.IsShutdown = false
+	r.ConnLock.Unlock()
 	r.Rstate.Timer.Reset(LEASE)
 	r.Mstate.Timer.Reset(LEASE / RENEW_FACTOR)
-	r.IsShutdown = false
 }
 
 // closes connection to the given replica number
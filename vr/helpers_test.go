@@ -0,0 +1,113 @@
+package vr
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// freeConfig returns a config of n local addresses nothing is listening on
+func freeConfig(t *testing.T, n int) []string {
+	config := make([]string, n)
+	for i := range config {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config[i] = l.Addr().String()
+		defer l.Close()
+	}
+	return config
+}
+
+// startReplicas starts n replicas, keeping their files in a temporary directory,
+// and shuts them down once the test is over. Each is passed to setup (if
+// there is one) as soon as it starts
+func startReplicas(t *testing.T, n int, setup func(i int, r *Replica)) []*Replica {
+	dir, err := ioutil.TempDir("", "vr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := freeConfig(t, n)
+	replicas := make([]*Replica, n)
+	for i := range config {
+		replicas[i] = RunAsReplicaInDir(uint(i), config, dir)
+		if setup != nil {
+			setup(i, replicas[i])
+		}
+	}
+	t.Cleanup(func() {
+		for _, r := range replicas {
+			r.Shutdown()
+		}
+		os.RemoveAll(dir)
+	})
+	return replicas
+}
+
+// startServices is startReplicas, with each replica replicating a counter
+func startServices(t *testing.T, n int) ([]*ReplicatedStateMachine, []*counter) {
+	services := make([]*ReplicatedStateMachine, n)
+	counters := make([]*counter, n)
+	startReplicas(t, n, func(i int, r *Replica) {
+		counters[i] = new(counter)
+		services[i] = Replicate(r, counters[i])
+	})
+	return services, counters
+}
+
+func replicasOf(services []*ReplicatedStateMachine) []*Replica {
+	replicas := make([]*Replica, len(services))
+	for i, s := range services {
+		replicas[i] = s.Replica
+	}
+	return replicas
+}
+
+// waitFor polls cond until it holds, failing the test if it still doesn't after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Still waiting for %s after %v", what, timeout)
+		}
+	}
+}
+
+// waitForMaster waits until every replica is in normal status in the same view,
+// and that view's master holds the lease, and returns the master
+func waitForMaster(t *testing.T, replicas []*Replica) *Replica {
+	t.Helper()
+	var master *Replica
+	// (the first election can be slow on a busy machine)
+	waitFor(t, 5*LEASE, "a master with the lease", func() bool {
+		master = nil
+		view := replicas[0].View()
+		for _, r := range replicas {
+			if r.Status() != Normal || r.View() != view {
+				return false
+			}
+			if r.IsMaster() {
+				master = r
+			}
+		}
+		return master != nil && master.HasLease()
+	})
+	return master
+}
+
+// countersAgree waits until every counter is at total
+func countersAgree(t *testing.T, counters []*counter, total int) {
+	t.Helper()
+	// (followers apply commits once they next hear from the master)
+	waitFor(t, 2*LEASE, "the counters to agree", func() bool {
+		for _, c := range counters {
+			if c.Query(nil) != total {
+				return false
+			}
+		}
+		return true
+	})
+}
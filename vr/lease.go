@@ -1,32 +1,99 @@
 package vr
 
 import (
+	"errors"
 	"sort"
 	"time"
 )
 
 // handle a given replica's heartbeat response
 func (r *Replica) Heartbeat(replica uint, newTime time.Time) {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	r.heartbeatLocked(replica, newTime)
+}
+
+// heartbeatLocked is Heartbeat for callers that hold StateLock
+func (r *Replica) heartbeatLocked(replica uint, newTime time.Time) {
 	//assert(r.IsMaster())
-	if !r.IsMaster() {
+	if !r.isMasterLocked() {
 		r.Debug(ERROR, "called heartbeat but we're no longer master")
 		return
 	}
 
+	r.Mstate.LeaseLock.Lock()
+	defer r.Mstate.LeaseLock.Unlock()
 	r.Mstate.Heartbeats[replica] = newTime
 
 	sortedTimes := SortTimes(r.Mstate.Heartbeats)
 
 	oldestMajority := len(sortedTimes) - int(F)
-	if oldestMajority < 0 {
+	if oldestMajority < 0 || oldestMajority >= len(sortedTimes) {
 		// not enough heartbeats yet to have a lease
 		return
 	}
 	leaseExpiry := sortedTimes[oldestMajority].Add(-MAX_CLOCK_DRIFT)
+	if leaseExpiry.After(r.Mstate.LeaseExpiry) {
+		r.Mstate.LeaseExpiry = leaseExpiry
+	}
 	r.Mstate.ExtendNeedsRenewal(leaseExpiry)
 	r.Rstate.ExtendLease(leaseExpiry)
 }
 
+// HasLease is whether we're master and hold the master lease, i.e. no other replica
+// can have become master, so our committed state is the latest there is. A new
+// master only gets it once any lease an earlier one held has run out (see BecomeMaster),
+// and a master gives it up as soon as it finds out about a view change
+func (r *Replica) HasLease() bool {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	return r.hasLeaseLocked()
+}
+
+// hasLeaseLocked is HasLease for callers that hold StateLock
+func (r *Replica) hasLeaseLocked() bool {
+	if !r.isMasterLocked() {
+		return false
+	}
+	r.Mstate.LeaseLock.Lock()
+	defer r.Mstate.LeaseLock.Unlock()
+	now := time.Now()
+	return !now.Before(r.Mstate.Since) && now.Before(r.Mstate.LeaseExpiry)
+}
+
+// grantLease promises the master of our view not to help elect another master
+// for LEASE (unless it takes part itself), and returns until when. The caller
+// must hold StateLock, as for the rest of these
+func (r *Replica) grantLease() time.Time {
+	lease := time.Now().Add(LEASE)
+	if lease.After(r.Rstate.LeaseGranted) {
+		r.Rstate.LeaseGranted = lease
+		r.Rstate.LeaseView = r.Rstate.View
+	}
+	r.Rstate.ExtendLease(lease)
+	return lease
+}
+
+// waitedOut notes that, as the new master, we're waiting out a lease that runs
+// out at oldLease, which whoever succeeds us has to wait out too
+func (r *Replica) waitedOut(oldLease time.Time) {
+	if oldLease.After(r.Rstate.LeaseGranted) {
+		r.Rstate.LeaseGranted = oldLease
+	}
+	r.Rstate.LeaseView = r.Rstate.View
+}
+
+// handedOver notes that replica master has started or joined a change to view. If
+// our lease is granted to it, it's given that up, so we only need to keep the
+// part of our promise it was still waiting out itself (lease) as a new master
+func (r *Replica) handedOver(master uint, view uint, lease time.Time) {
+	if master != r.Rstate.ReplicaNumber && r.Rstate.LeaseView%NREPLICAS == master && r.Rstate.LeaseView < view &&
+		lease.Before(r.Rstate.LeaseGranted) {
+		r.Debug(DEBUG, "Replica %d has handed over its lease", master)
+		r.Rstate.LeaseGranted = lease
+	}
+}
+
 func (mstate *MasterState) ExtendNeedsRenewal(newTime time.Time) {
 	mstate.Timer.Reset(newTime.Sub(time.Now()) / RENEW_FACTOR)
 }
@@ -36,18 +103,24 @@ func (rstate *ReplicaState) ExtendLease(newTime time.Time) {
 }
 
 func (r *Replica) ReplicaTimeout() {
-	if r.IsMaster() {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	if r.isMasterLocked() {
 		r.Debug(STATUS, "we couldn't stay master :(,ViewNum:%d\n", r.Rstate.View)
-		// TODO: can't handle read requests anymore
+		// can't handle read requests anymore
+		r.Mstate.LeaseLock.Lock()
+		r.Mstate.LeaseExpiry = time.Time{}
+		r.Mstate.LeaseLock.Unlock()
+		r.endTerm(errors.New("Lost master lease"))
 	}
 	r.Debug(STATUS, "Timed out, trying view change")
-	r.PrepareViewChange()
+	r.prepareViewChangeLocked()
 	// start counting again so we timeout if the new replica can't become master
 	r.Rstate.ExtendLease(time.Now().Add(LEASE))
 }
 
 func (r *Replica) MasterNeedsRenewal() {
-	if r.IsShutdown {
+	if r.Stopped() {
 		return
 	}
 	r.sendCommitMsgs()
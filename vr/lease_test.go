@@ -0,0 +1,118 @@
+package vr
+
+import (
+	"context"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	replicas := startReplicas(t, 3, nil)
+	master := waitForMaster(t, replicas)
+	for i, r := range replicas {
+		if r != master && r.HasLease() {
+			t.Errorf("Replica %d has the lease without being master", i)
+		}
+	}
+	// once the master stops hearing from the others, its lease runs out
+	master.Disconnect()
+	waitFor(t, LEASE, "the disconnected master's lease to run out", func() bool {
+		return !master.HasLease()
+	})
+}
+
+func TestRunVRFailsWithoutQuorum(t *testing.T) {
+	gob.Register(nop{})
+	master := waitForMaster(t, startReplicas(t, 3, nil))
+	if err := master.RunVR(nop{}); err != nil {
+		t.Fatalf("RunVR failed with a quorum: %v", err)
+	}
+	// cut off from everyone else, the master can't commit anything, and gives
+	// up once its lease runs out
+	master.Disconnect()
+	// (though callers can give up sooner)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := master.RunVRContext(ctx, nop{}); err != context.DeadlineExceeded {
+		t.Errorf("RunVRContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- master.RunVR(nop{})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("RunVR succeeded without a quorum")
+		}
+	case <-time.After(2 * LEASE):
+		t.Errorf("RunVR still hadn't returned %v after losing quorum", 2*LEASE)
+	}
+	if err := master.RunVR(nop{}); err == nil {
+		t.Error("RunVR succeeded after we stopped being master")
+	}
+}
+
+// leaseHolders returns how many of the replicas think they hold the lease
+func leaseHolders(replicas []*Replica) int {
+	n := 0
+	for _, r := range replicas {
+		if r.HasLease() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestNewMasterWaitsOutLease(t *testing.T) {
+	replicas := startReplicas(t, 3, nil)
+	master := waitForMaster(t, replicas)
+	// the master is cut off, but one of the others gives up on it straight
+	// away, and the rest elect a new master, while the old one still holds the lease
+	master.Disconnect()
+	for _, r := range replicas {
+		if r != master {
+			r.PrepareViewChange()
+			break
+		}
+	}
+	newMaster := false
+	for end := time.Now().Add(2 * LEASE); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		if n := leaseHolders(replicas); n > 1 {
+			t.Fatalf("%d replicas hold the lease at once", n)
+		}
+		for _, r := range replicas {
+			if r != master && r.HasLease() {
+				newMaster = true
+			}
+		}
+	}
+	if !newMaster {
+		t.Errorf("No new master got the lease within %v", 2*LEASE)
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	replicas := startReplicas(t, 3, nil)
+	master := waitForMaster(t, replicas)
+	// the master hands its lease over, so the next one needn't wait for it to run out
+	master.StepDown()
+	if master.HasLease() {
+		t.Error("Master still has the lease after stepping down")
+	}
+	start := time.Now()
+	for leaseHolders(replicas) == 0 && time.Since(start) < LEASE {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if took := time.Since(start); took > LEASE/4 {
+		t.Errorf("Took %v for the next master to get the lease", took)
+	}
+	if master.IsMaster() {
+		t.Error("Master is still master after stepping down")
+	}
+}
+
+type nop struct{}
+
+func (nop) CommitFunc(context interface{}) {}
@@ -0,0 +1,213 @@
+package vr
+
+import (
+	"time"
+)
+
+// While we're master, each other replica gets a peer: one goroutine that sends
+// it our Prepares and Commits, one RPC at a time and in op order. Prepares that
+// queue up while an RPC is in flight go out together in the next one, and
+// Commits (which are also our heartbeats) coalesce, as does a Commit with the
+// Prepare it would follow, since a Prepare carries the commit number too.
+//
+// A peer's queue holds up to PREPARE_WINDOW Prepares. The master itself only lets
+// PREPARE_WINDOW Prepares go uncommitted (see prepareLoop), so the queue can only fill
+// up when the follower has fallen behind the rest, in which case we drop what
+// doesn't fit instead of holding the master back. Every Commit's reply says how
+// far along the follower is, so whatever it missed (or we gave up sending) goes
+// out again after the next heartbeat, and ops don't stay uncommitted just because
+// the master has gone idle.
+
+type peer struct {
+	r      *Replica
+	repNum uint
+	// the last op the follower told us it has
+	acked uint
+	// Prepares waiting to be sent
+	prepares chan *PrepareArgs
+	// a Commit is waiting to be sent
+	commit chan bool
+	// closed to stop the peer
+	stop chan bool
+}
+
+func newPeer(r *Replica, repNum uint) *peer {
+	p := &peer{
+		r:        r,
+		repNum:   repNum,
+		prepares: make(chan *PrepareArgs, PREPARE_WINDOW),
+		commit:   make(chan bool, 1),
+		stop:     make(chan bool),
+	}
+	go p.run()
+	return p
+}
+
+// prepare queues a Prepare to send, or drops it if the queue is full
+func (p *peer) prepare(args *PrepareArgs) {
+	select {
+	case p.prepares <- args:
+	default:
+		p.r.Debug(STATUS, "replica %d is falling behind, not sending it prepare %d", p.repNum, args.OpNumber)
+	}
+}
+
+// heartbeat asks for a Commit to be sent, unless one is already waiting
+func (p *peer) heartbeat() {
+	select {
+	case p.commit <- true:
+	default:
+	}
+}
+
+func (p *peer) run() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case args := <-p.prepares:
+			p.sendPrepares(args)
+		case <-p.commit:
+			p.sendCommit()
+		}
+	}
+}
+
+// sendPrepares sends args, along with any Prepares queued after it
+func (p *peer) sendPrepares(args *PrepareArgs) {
+	batch := ownCopy(args)
+	for more := true; more; {
+		select {
+		case next := <-p.prepares:
+			if next.View == batch.View && next.OpNumber-uint(len(next.Commands)) == batch.OpNumber {
+				batch.Commands = append(batch.Commands, next.Commands...)
+				batch.OpNumber = next.OpNumber
+			} else {
+				p.sendPrepare(&batch)
+				batch = ownCopy(next)
+			}
+		default:
+			more = false
+		}
+	}
+	p.sendPrepare(&batch)
+}
+
+// ownCopy copies a Prepare so that appending to its Commands can't touch
+// the original (which other peers are sending too)
+func ownCopy(args *PrepareArgs) PrepareArgs {
+	c := *args
+	c.Commands = c.Commands[:len(c.Commands):len(c.Commands)]
+	return c
+}
+
+// sendPrepare sends a Prepare, and returns whether the follower took it
+func (p *peer) sendPrepare(args *PrepareArgs) bool {
+	r := p.r
+	r.StateLock.Lock()
+	// Prepares from an earlier view (when we were master before) are no use to anyone
+	current := r.isMasterLocked() && args.View == r.Rstate.View
+	args.CommitNumber = r.Rstate.CommitNumber
+	r.StateLock.Unlock()
+	if !current {
+		return false
+	}
+	reply := new(PrepareReply)
+	if !p.call("RPCReplica.Prepare", args, reply) || reply.View != args.View {
+		return false
+	}
+	p.acked = reply.OpNumber
+	r.handlePrepareOK(reply)
+	select {
+	case <-p.commit:
+	default:
+	}
+	return true
+}
+
+func (p *peer) sendCommit() {
+	r := p.r
+	r.StateLock.Lock()
+	master := r.isMasterLocked()
+	args := CommitArgs{r.Rstate.View, r.Rstate.CommitNumber}
+	r.StateLock.Unlock()
+	if !master {
+		return
+	}
+	reply := new(HeartbeatReply)
+	if p.call("RPCReplica.Commit", &args, reply) {
+		// (it answered, so it's in our view, and has prepared up to reply.OpNumber)
+		p.acked = reply.OpNumber
+		r.handlePrepareOK(&PrepareReply{args.View, reply.OpNumber, reply.ReplicaNumber, reply.Lease})
+		p.catchUp(args.View)
+	}
+}
+
+// catchUp resends the follower whatever ops it's missing, MAX_BATCH at a time,
+// until it has them all (or stops taking them)
+func (p *peer) catchUp(view uint) {
+	r := p.r
+	for {
+		r.StateLock.Lock()
+		last := r.Rstate.OpNumber
+		// (a follower too far behind for our log catches up by state transfer instead)
+		if !r.isMasterLocked() || r.Rstate.View != view || p.acked >= last || !r.Phatlog.HasEntry(p.acked+1) {
+			r.StateLock.Unlock()
+			return
+		}
+		if last-p.acked > uint(MAX_BATCH) {
+			last = p.acked + uint(MAX_BATCH)
+		}
+		commands := make([]interface{}, 0, last-p.acked)
+		for op := p.acked + 1; op <= last; op++ {
+			commands = append(commands, r.Phatlog.GetCommand(op))
+		}
+		r.Debug(STATUS, "replica %d is behind, resending ops %d to %d", p.repNum, last-uint(len(commands))+1, last)
+		r.StateLock.Unlock()
+		acked := p.acked
+		if !p.sendPrepare(&PrepareArgs{View: view, Commands: commands, OpNumber: last}) || p.acked <= acked {
+			return
+		}
+	}
+}
+
+// call sends an RPC to the peer, trying up to MAX_TRIES times, and returns whether it succeeded
+func (p *peer) call(msg string, args interface{}, reply interface{}) bool {
+	for tries := uint(1); ; tries++ {
+		conn, err := p.r.getConn(p.repNum)
+		if err == nil {
+			err = conn.Call(msg, args, reply)
+		}
+		if err == nil {
+			return true
+		}
+		p.r.callFailed(p.repNum, tries, err)
+		if tries >= MAX_TRIES {
+			return false
+		}
+		select {
+		case <-p.stop:
+			return false
+		case <-time.After(BACKOFF_TIME * (1 << (tries - 1))):
+		}
+	}
+}
+
+// startPeersLocked starts a peer for every other replica.
+// The caller must hold RunVRLock
+func (r *Replica) startPeersLocked() {
+	for repNum := uint(0); repNum < NREPLICAS; repNum++ {
+		if repNum != r.Rstate.ReplicaNumber {
+			r.Mstate.Peers = append(r.Mstate.Peers, newPeer(r, repNum))
+		}
+	}
+}
+
+// stopPeersLocked stops our peers, dropping whatever they had left to send.
+// The caller must hold RunVRLock
+func (r *Replica) stopPeersLocked() {
+	for _, p := range r.Mstate.Peers {
+		close(p.stop)
+	}
+	r.Mstate.Peers = nil
+}
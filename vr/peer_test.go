@@ -0,0 +1,66 @@
+package vr
+
+import (
+	"encoding/gob"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNoGoroutineLeak(t *testing.T) {
+	services, _ := startServices(t, 3)
+	master := masterService(t, services)
+	// messages to a follower that's gone never get through, which mustn't leave anything behind
+	for _, s := range services {
+		if s != master {
+			s.Replica.Disconnect()
+			break
+		}
+	}
+	master.Submit(0)
+	time.Sleep(LEASE / RENEW_FACTOR)
+	//
+	before := runtime.NumGoroutine()
+	const SUBMITS = 200
+	for i := 0; i < SUBMITS; i++ {
+		if _, err := master.Submit(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// (and a few heartbeats' worth)
+	waitFor(t, 2*LEASE, "the goroutines to finish", func() bool {
+		return runtime.NumGoroutine() <= before+SUBMITS/10
+	})
+}
+
+func TestIdleMasterCatchesUpFollowers(t *testing.T) {
+	gob.Register(nop{})
+	replicas := startReplicas(t, 3, nil)
+	master := waitForMaster(t, replicas)
+	// every follower misses the Prepare (which the master gives up on), and then
+	// nothing else comes along to be prepared after it
+	for _, r := range replicas {
+		if r != master {
+			r.Disconnect()
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- master.RunVR(nop{})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for _, r := range replicas {
+		if r != master {
+			r.Reconnect()
+		}
+	}
+	// the followers get it again once the master's heartbeats find them behind
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("RunVR failed with %v", err)
+		}
+	case <-time.After(2 * LEASE):
+		t.Errorf("Op still hadn't committed %v after the followers came back", 2*LEASE)
+	}
+}
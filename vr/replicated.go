@@ -0,0 +1,241 @@
+package vr
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// Querier is a StateMachine that can also answer read-only queries, which
+// aren't logged (and so must not change anything)
+type Querier interface {
+	Query(query interface{}) interface{}
+}
+
+// ReplicatedStateMachine replicates a StateMachine with VR. Commands submitted to
+// any replica are committed through the master and applied to every replica's
+// machine in the same order, and the machine is snapshotted along with the log.
+// Anything used in commands, queries or results must be gob.Register'ed
+type ReplicatedStateMachine struct {
+	Replica *Replica
+	Machine StateMachine
+}
+
+// ReplicatedCommand carries a submitted command through the log
+type ReplicatedCommand struct {
+	Command interface{}
+	// the master's Submit waits for the result here (it's nil on other
+	// replicas, since channels aren't sent over RPC)
+	Done chan committed
+}
+
+type committed struct {
+	result   interface{}
+	opNumber uint
+}
+
+func (c ReplicatedCommand) CommitFunc(context interface{}) {
+	rsm := context.(*ReplicatedStateMachine)
+	result := rsm.Machine.Apply(c.Command)
+	if c.Done != nil {
+		// (commits happen before CommitNumber is bumped, and with CommitLock held)
+		c.Done <- committed{result, rsm.Replica.Rstate.CommitNumber + 1}
+	}
+}
+
+// arguments to RPCReplica.Forward, which a replica uses to pass commands
+// and queries it was given on to the master
+type ForwardArgs struct {
+	Command interface{}
+	Query   bool
+	// when the replica that forwarded it gives up (zero for never)
+	Deadline time.Time
+}
+
+// ForwardReply's Result is a gob encoded forwardResult, which the master encodes
+// itself, so a result gob can't handle fails the call rather than the reply
+type ForwardReply struct {
+	Result   []byte
+	OpNumber uint
+}
+
+// forwardResult is a forwarded command or query's result. Gob sends a pointer in
+// an interface{} as the value it points to, so it comes with whether it was one
+type forwardResult struct {
+	Result  interface{}
+	Pointer bool
+}
+
+func encodeResult(result interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	pointer := result != nil && reflect.TypeOf(result).Kind() == reflect.Ptr
+	if err := gob.NewEncoder(&buf).Encode(forwardResult{result, pointer}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeResult gets back a result encodeResult encoded, of the same type as on the master
+func decodeResult(data []byte) (interface{}, error) {
+	var fr forwardResult
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&fr); err != nil {
+		return nil, err
+	}
+	if v := reflect.ValueOf(fr.Result); fr.Pointer && v.IsValid() && v.Kind() != reflect.Ptr {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		return p.Interface(), nil
+	}
+	return fr.Result, nil
+}
+
+// DeadlineContext returns a context for handling an RPC whose caller gives
+// up at deadline, where a zero deadline means it never does
+func DeadlineContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// Replicate makes r replicate sm (r's Context becomes the returned ReplicatedStateMachine)
+func Replicate(r *Replica, sm StateMachine) *ReplicatedStateMachine {
+	gob.Register(ReplicatedCommand{})
+	rsm := &ReplicatedStateMachine{r, sm}
+	r.Context = rsm
+	r.UseStateMachine(sm)
+	return rsm
+}
+
+// Submit commits a command and returns the master's result of applying it. If the
+// master fails before the command commits, it returns an error (and the command
+// may or may not commit anyway)
+func (rsm *ReplicatedStateMachine) Submit(command interface{}) (interface{}, error) {
+	return rsm.SubmitContext(context.Background(), command)
+}
+
+// SubmitContext is Submit, but gives up once ctx is done (see Replica.RunVRContext)
+func (rsm *ReplicatedStateMachine) SubmitContext(ctx context.Context, command interface{}) (interface{}, error) {
+	result, _, err := rsm.SubmitOpContext(ctx, command)
+	return result, err
+}
+
+// SubmitOp is Submit, but also returns the command's op number, so callers can
+// tell when another replica has committed it (see Replica.WaitForCommit)
+func (rsm *ReplicatedStateMachine) SubmitOp(command interface{}) (interface{}, uint, error) {
+	return rsm.SubmitOpContext(context.Background(), command)
+}
+
+// SubmitOpContext is SubmitOp, but gives up once ctx is done
+func (rsm *ReplicatedStateMachine) SubmitOpContext(ctx context.Context, command interface{}) (interface{}, uint, error) {
+	if !rsm.isMaster() {
+		return rsm.forward(ctx, &ForwardArgs{Command: command})
+	}
+	return rsm.submit(ctx, command)
+}
+
+// Query answers a read-only query from the master's copy of the machine,
+// which has to be a Querier. It fails if the master doesn't hold the lease
+func (rsm *ReplicatedStateMachine) Query(query interface{}) (interface{}, error) {
+	return rsm.QueryContext(context.Background(), query)
+}
+
+// QueryContext is Query, but gives up once ctx is done
+func (rsm *ReplicatedStateMachine) QueryContext(ctx context.Context, query interface{}) (interface{}, error) {
+	if !rsm.isMaster() {
+		result, _, err := rsm.forward(ctx, &ForwardArgs{Command: query, Query: true})
+		return result, err
+	}
+	return rsm.query(query)
+}
+
+func (rsm *ReplicatedStateMachine) isMaster() bool {
+	return rsm.Replica.IsMaster()
+}
+
+func (rsm *ReplicatedStateMachine) submit(ctx context.Context, command interface{}) (interface{}, uint, error) {
+	c := ReplicatedCommand{command, make(chan committed, 1)}
+	if err := rsm.Replica.RunVRContext(ctx, c); err != nil {
+		return nil, 0, err
+	}
+	done := <-c.Done
+	return done.result, done.opNumber, nil
+}
+
+func (rsm *ReplicatedStateMachine) query(query interface{}) (interface{}, error) {
+	q, ok := rsm.Machine.(Querier)
+	if !ok {
+		return nil, errors.New("State machine doesn't support queries")
+	}
+	// (otherwise another master might have committed commands we haven't)
+	if !rsm.Replica.HasLease() {
+		return nil, errors.New("No master lease")
+	}
+	return q.Query(query), nil
+}
+
+// forward sends a command or query to the master to handle
+func (rsm *ReplicatedStateMachine) forward(ctx context.Context, args *ForwardArgs) (interface{}, uint, error) {
+	r := rsm.Replica
+	r.StateLock.Lock()
+	normal, masterId := r.Rstate.Status == Normal, r.Rstate.View%NREPLICAS
+	r.StateLock.Unlock()
+	if !normal {
+		return nil, 0, errors.New("No master")
+	}
+	// (we might have become master since the caller checked)
+	if masterId == r.Rstate.ReplicaNumber {
+		if args.Query {
+			result, err := rsm.query(args.Command)
+			return result, 0, err
+		}
+		return rsm.submit(ctx, args.Command)
+	}
+	conn, err := r.getConn(masterId)
+	if err != nil {
+		return nil, 0, err
+	}
+	// (the master gives up when we do)
+	args.Deadline, _ = ctx.Deadline()
+	reply := new(ForwardReply)
+	call := conn.Go("RPCReplica.Forward", args, reply, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, 0, call.Error
+		}
+		result, err := decodeResult(reply.Result)
+		return result, reply.OpNumber, err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// Forward handles a command or query another replica was given. It isn't
+// forwarded again, so replicas that disagree about the master can't bounce it around
+func (t *RPCReplica) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	rsm, ok := t.R.Context.(*ReplicatedStateMachine)
+	if !ok {
+		return errors.New("Not replicating a state machine")
+	}
+	if !rsm.isMaster() {
+		return errors.New("Not master")
+	}
+	var result interface{}
+	var err error
+	if args.Query {
+		result, err = rsm.query(args.Command)
+	} else {
+		ctx, cancel := DeadlineContext(args.Deadline)
+		defer cancel()
+		result, reply.OpNumber, err = rsm.submit(ctx, args.Command)
+	}
+	if err != nil {
+		return err
+	}
+	reply.Result, err = encodeResult(result)
+	return err
+}
@@ -0,0 +1,200 @@
+package vr
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counter is about the smallest useful replicated service: Apply adds to it and
+// returns the new total, and a query returns the total
+type counter struct {
+	n    int
+	lock sync.Mutex
+}
+
+func (c *counter) Apply(command interface{}) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.n += command.(int)
+	return c.n
+}
+
+func (c *counter) Query(query interface{}) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.n
+}
+
+func (c *counter) Snapshot(index func() uint) ([]byte, uint, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return []byte(fmt.Sprint(c.n)), index(), nil
+}
+
+func (c *counter) Restore(data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := fmt.Sscan(string(data), &c.n)
+	return err
+}
+
+func TestReplicatedStateMachine(t *testing.T) {
+	gob.Register(0)
+	services, counters := startServices(t, 3)
+	waitForMaster(t, replicasOf(services))
+	//
+	total := 0
+	for i, s := range services {
+		// followers forward commands and queries to the master
+		total += i + 1
+		if result, err := s.Submit(i + 1); err != nil || result != total {
+			t.Errorf("Submit on replica %d returned %v (err: %v), expected %d", i, result, err, total)
+		}
+		if result, err := s.Query(nil); err != nil || result != total {
+			t.Errorf("Query on replica %d returned %v (err: %v), expected %d", i, result, err, total)
+		}
+	}
+	countersAgree(t, counters, total)
+}
+
+// counted is a result like most real machines', a pointer to a struct
+type counted struct {
+	Total int
+}
+
+// unregistered is a result gob can't send, since nobody registered it
+type unregistered struct{}
+
+// structCounter is a counter whose results are counteds (or unregistereds, for string commands)
+type structCounter struct {
+	counter
+}
+
+func (c *structCounter) Apply(command interface{}) interface{} {
+	if _, ok := command.(string); ok {
+		return &unregistered{}
+	}
+	return &counted{c.counter.Apply(command).(int)}
+}
+
+func TestForwardedResults(t *testing.T) {
+	gob.Register(0)
+	gob.Register(counted{})
+	services := make([]*ReplicatedStateMachine, 3)
+	startReplicas(t, len(services), func(i int, r *Replica) {
+		services[i] = Replicate(r, new(structCounter))
+	})
+	master := masterService(t, services)
+	total := 0
+	for i, s := range services {
+		// (followers forward the command, and get back what the master got)
+		total += i + 1
+		result, err := s.Submit(i + 1)
+		if c, ok := result.(*counted); err != nil || !ok || c.Total != total {
+			t.Errorf("Submit on replica %d returned %#v (err: %v), expected &counted{%d}", i, result, err, total)
+		}
+		if s == master {
+			continue
+		}
+		// a result that can't be sent back fails the call, rather than never arriving
+		ctx, cancel := context.WithTimeout(context.Background(), LEASE)
+		_, err = s.SubmitContext(ctx, "unregistered")
+		cancel()
+		if err == nil || err == context.DeadlineExceeded {
+			t.Errorf("Forwarding a command with an unregistered result returned %v", err)
+		}
+	}
+}
+
+func TestConcurrentSubmits(t *testing.T) {
+	gob.Register(0)
+	services, counters := startServices(t, 3)
+	master := masterService(t, services)
+	//
+	const CLIENTS, SUBMITS = 64, 20
+	// with many Prepares in flight, every command should still commit exactly once,
+	// so each sees a different total
+	seen := make(chan int, CLIENTS*SUBMITS)
+	var wg sync.WaitGroup
+	for i := 0; i < CLIENTS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < SUBMITS; j++ {
+				result, err := master.Submit(1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				seen <- result.(int)
+			}
+		}()
+	}
+	wg.Wait()
+	close(seen)
+	totals := make(map[int]bool)
+	for total := range seen {
+		if totals[total] {
+			t.Errorf("Two commands both brought the counter to %d", total)
+		}
+		totals[total] = true
+	}
+	countersAgree(t, counters, CLIENTS*SUBMITS)
+}
+
+func TestSubmitsDuringViewChanges(t *testing.T) {
+	gob.Register(0)
+	services, counters := startServices(t, 3)
+	waitForMaster(t, replicasOf(services))
+	// clients keep submitting to every replica while the master keeps handing
+	// over, which mostly matters for what the race detector makes of it
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for _, s := range services {
+		wg.Add(1)
+		go func(s *ReplicatedStateMachine) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// (some fail while there's no master)
+				s.Submit(1)
+				s.Query(nil)
+				s.Replica.Freshness()
+			}
+		}(s)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(LEASE / 4)
+		for _, s := range services {
+			s.Replica.StepDown()
+		}
+	}
+	close(stop)
+	wg.Wait()
+	// once things settle down, everyone agrees
+	total, err := masterService(t, services).Submit(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countersAgree(t, counters, total.(int))
+}
+
+// masterService waits for a master with the lease (see waitForMaster), and returns its service
+func masterService(t *testing.T, services []*ReplicatedStateMachine) *ReplicatedStateMachine {
+	t.Helper()
+	master := waitForMaster(t, replicasOf(services))
+	for _, s := range services {
+		if s.Replica == master {
+			return s
+		}
+	}
+	return nil
+}
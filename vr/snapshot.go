@@ -11,7 +11,7 @@ func (r *Replica) SnapshotDiskData() (snapshot []byte) {
 	f, err := os.Open(r.SnapshotFile)
 	defer func() {
 		if err != nil {
-			r.Debug(ERROR, err.Error())
+			r.logf(ERROR, "%v", err)
 		}
 	}()
 	if err != nil {
@@ -38,27 +38,45 @@ func (r *Replica) LoadSnapshotFromDisk() {
 	r.LoadSnapshot(buf)
 }
 
+// LoadSnapshot restores the state machine from a snapshot. The caller must hold StateLock
 func (r *Replica) LoadSnapshot(data []byte) {
 	snapIndex := uint(binary.LittleEndian.Uint64(data[:8]))
+	r.SnapshotLock.Lock()
+	defer r.SnapshotLock.Unlock()
+	r.CommitLock.Lock()
+	defer r.CommitLock.Unlock()
 	// call user code
 	r.LoadSnapshotFunc(r.Context, data[8:])
 	r.SnapshotIndex = snapIndex
 	r.Rstate.OpNumber = snapIndex
 	r.Rstate.CommitNumber = snapIndex
+	r.wakeCommitWaiters()
+}
+
+// snapshotIndex returns the index of our last snapshot
+func (r *Replica) snapshotIndex() uint {
+	r.SnapshotLock.Lock()
+	defer r.SnapshotLock.Unlock()
+	return r.SnapshotIndex
 }
 
 // does a snapshot (synchronous)
 func (r *Replica) TakeSnapshot() {
 	r.SnapshotLock.Lock()
 	defer r.SnapshotLock.Unlock()
-	r.Debug(STATUS, "Taking snapshot of roughly %d (current snapshot is %d)", r.Rstate.CommitNumber, r.SnapshotIndex)
+	// nothing commits while we snapshot, so the state machine's state is exactly
+	// as of our commit number
+	r.CommitLock.Lock()
 	if r.Rstate.CommitNumber <= r.SnapshotIndex {
+		r.CommitLock.Unlock()
 		return
 	}
+	r.logf(STATUS, "Taking snapshot of %d (current snapshot is %d)", r.Rstate.CommitNumber, r.SnapshotIndex)
 	bytes, snapIndex, err := r.SnapshotFunc(r.Context, func() uint { return r.Rstate.CommitNumber })
+	r.CommitLock.Unlock()
 	defer func() {
 		if err != nil {
-			r.Debug(ERROR, err.Error())
+			r.logf(ERROR, "%v", err)
 		}
 	}()
 	if err != nil {
@@ -94,15 +112,15 @@ func (r *Replica) TakeSnapshot() {
 }
 
 // returns either just the log suffix or a snapshot and log suffix that are required to
-// recover to current state from the given op number
+// recover to current state from the given op number. The caller must hold StateLock
 func (r *Replica) RecoverInfoFromOpNumber(op uint) (log *phatlog.Log, snapshot []byte) {
 	if !r.Phatlog.HasEntry(op) {
 		// need to send snapshot too
 		snapshot = r.SnapshotDiskData()
-        // and whatever log we do have
-        log = r.Phatlog
+		// and whatever log we do have
+		log = r.Phatlog.Copy()
 	} else {
-        log = r.Phatlog.Suffix(op)
-    }
+		log = r.Phatlog.Suffix(op)
+	}
 	return
 }
@@ -0,0 +1,25 @@
+package vr
+
+// StateMachine is the application state that committed commands are applied to.
+// Every replica applies the same commands in the same order, so Apply has to be
+// deterministic (e.g. take times from the command rather than the local clock)
+type StateMachine interface {
+	// Apply applies a command and returns its result
+	Apply(command interface{}) interface{}
+	// Snapshot encodes the current state. index is called at the exact point in the
+	// command sequence the snapshot reflects, and its result is returned with the data
+	Snapshot(index func() uint) ([]byte, uint, error)
+	// Restore replaces the current state with the data from a snapshot
+	Restore(data []byte) error
+}
+
+// UseStateMachine makes the replica snapshot and restore sm. Context is left alone,
+// since it's whatever the commands' CommitFuncs expect
+func (r *Replica) UseStateMachine(sm StateMachine) {
+	r.SnapshotFunc = func(context interface{}, index func() uint) ([]byte, uint, error) {
+		return sm.Snapshot(index)
+	}
+	r.LoadSnapshotFunc = func(context interface{}, data []byte) error {
+		return sm.Restore(data)
+	}
+}
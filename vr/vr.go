@@ -2,12 +2,14 @@ package vr
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"github.com/mgentili/goPhat/phatlog"
 	"net"
 	"net/rpc"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -15,6 +17,11 @@ import (
 var NREPLICAS uint
 var F uint
 
+// the master batches up to MAX_BATCH commands into each Prepare, and has up to
+// PREPARE_WINDOW Prepares in flight at once (set these before starting replicas)
+var PREPARE_WINDOW = 16
+var MAX_BATCH = 64
+
 const (
 	LEASE = 2000 * time.Millisecond
 	// how soon master renews lease before actual expiry date. e.g. if lease expires in 100 seconds
@@ -27,6 +34,8 @@ const (
 	MAX_TRIES = 2
 	// doubles after every failure
 	BACKOFF_TIME = 10 * time.Millisecond
+	// how long a replica holds a Prepare that arrived before an earlier one
+	PREPARE_WAIT = 100 * time.Millisecond
 
 	// start off with very frequent snapshots (set to high number to disable snapshots)
 	SNAP_FREQ     = 100
@@ -40,33 +49,51 @@ const (
 	ViewChange
 )
 
+// A Replica's state is shared between RPC handlers, timers and the goroutines
+// sending its messages, and protected by these locks, taken in this order when
+// more than one is needed:
+// StateLock, RunVRLock, SnapshotLock, CommitLock, LeaseLock, ConnLock
 type Replica struct {
 	//Replica State Structs
+	// (Rstate, Vcstate and Rcvstate are protected by StateLock, except as noted,
+	// and Mstate by its own locks)
 	Rstate   ReplicaState
 	Mstate   MasterState
 	Vcstate  ViewChangeState
 	Rcvstate RecoveryState
 
 	// list of replica addresses, in sorted order
-	Config   []string
-	Conns    []*rpc.Client
-	ConnLock sync.Mutex
-	Phatlog  *phatlog.Log
+	Config []string
+	// RPC handlers and timer callbacks hold StateLock while they run (other than
+	// while they wait for something), so each sees a consistent state
+	StateLock sync.Mutex
+	// (protected by StateLock)
+	Phatlog *phatlog.Log
 	// opaque data passed to each command's CommitFunc
 	Context interface{}
-	// ensure each commit only happens once!
+	// ensure each commit only happens once! Commits happen holding both StateLock
+	// and CommitLock, so either is enough to read Rstate.CommitNumber
 	CommitLock sync.Mutex
-	Listener   net.Listener
-	Codecs     []*GobServerCodec
+	// WaitForCommit callers, woken once their op commits (protected by CommitLock)
+	CommitWaiters []commitWaiter
+	// signals each addition to the log (its lock is StateLock)
+	PrepareCond *sync.Cond
+
+	// our connections to the other replicas and theirs to us (protected by ConnLock)
+	Conns    []*rpc.Client
+	Listener net.Listener
+	Codecs   []*GobServerCodec
+	ConnLock sync.Mutex
 
 	SnapshotFunc     func(interface{}, func() uint) ([]byte, uint, error)
 	LoadSnapshotFunc func(interface{}, []byte) error
 	// ensure only one snapshot at a time
 	SnapshotLock sync.Mutex
-	// index of last snapshot
+	// index of last snapshot (protected by SnapshotLock)
 	SnapshotIndex uint
 	SnapshotFile  string
 
+	// (protected by ConnLock)
 	IsShutdown     bool // completely shutdown
 	IsDisconnected bool // just disconnected from other replicas
 }
@@ -100,20 +127,52 @@ type ReplicaState struct {
 	NormalView     uint
 	ViewChangeMsgs uint
 	Timer          *time.Timer
+	// when we last knew we'd committed everything the master had (protected by CommitLock)
+	CaughtUp time.Time
+	// the latest some master might think it holds the lease until, as far as we know (i.e.
+	// the last lease we granted, or waited out as master), and its view
+	LeaseGranted time.Time
+	LeaseView    uint
 }
 
 type MasterState struct {
-	// map from replica number to OpNumber
+	// map from replica number to OpNumber (protected by LeaseLock)
 	HighestOp map[uint]uint
 
 	Timer      *time.Timer
 	Heartbeats map[uint]time.Time
-	RunVRLock  sync.Mutex
+	// until when a majority has promised not to elect another master,
+	// so we can answer reads without going through the log
+	LeaseExpiry time.Time
+	LeaseLock   sync.Mutex
+	RunVRLock   sync.Mutex
+	// when we became master, or will have once every lease an earlier master might
+	// hold has run out: until then we don't commit anything or answer reads (protected by LeaseLock)
+	Since time.Time
+	// commands waiting to go out in a Prepare (protected by RunVRLock), and
+	// whether prepareLoop is running to send them
+	Pending   []VRCommand
+	Preparing bool
+	// one token per uncommitted Prepare, and the last op of each (protected by RunVRLock)
+	Window   chan bool
+	Inflight []uint
+	// send our Prepares and Commits to the other replicas (protected by RunVRLock)
+	Peers []*peer
+	// our current term as master, if we're in one (protected by RunVRLock)
+	Term *masterTerm
+}
+
+// a masterTerm lasts from when we become master until we find out we might not be any more
+type masterTerm struct {
+	// closed once the term is over, with Err saying why
+	Over chan bool
+	Err  error
 }
 
+// a Prepare's Commands are ops up to and including OpNumber
 type PrepareArgs struct {
 	View         uint
-	Command      interface{}
+	Commands     []interface{}
 	OpNumber     uint
 	CommitNumber uint
 }
@@ -132,17 +191,21 @@ type CommitArgs struct {
 
 type HeartbeatReply struct {
 	ReplicaNumber uint
-	Lease         time.Time
+	// the follower has every op up to OpNumber
+	OpNumber uint
+	Lease    time.Time
 }
 
 // RPCs
 func (t *RPCReplica) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 	r := t.R
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 	r.Debug(STATUS, "Got prepare %d\n", args.OpNumber)
 
 	if args.View > r.Rstate.View {
 		// a new master must have been elected without us, so need to recover
-		r.PrepareRecovery()
+		r.prepareRecoveryLocked()
 		//TODO: should we return an error, block until recovery completes, or
 		// something else??
 		return errors.New("recovering")
@@ -156,33 +219,48 @@ func (t *RPCReplica) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 		return errors.New("not in normal mode")
 	}
 
-	if args.OpNumber > r.Rstate.OpNumber+1 {
+	first := args.OpNumber - uint(len(args.Commands)) + 1
+	if first > r.Rstate.OpNumber+1 {
+		// the master has several Prepares in flight, so an earlier one may just not be here yet
+		r.waitForOp(first-1, PREPARE_WAIT)
+		// (and the view might have changed in the meantime)
+		if args.View != r.Rstate.View || r.Rstate.Status != Normal {
+			return wrongView()
+		}
+	}
+	if first > r.Rstate.OpNumber+1 {
 		// we must be behind?
-		r.StartStateTransfer()
-		return fmt.Errorf("op numbers out of sync: got %d expected %d", args.OpNumber, r.Rstate.OpNumber+1)
+		r.startStateTransferLocked()
+		return fmt.Errorf("op numbers out of sync: got %d expected %d", first, r.Rstate.OpNumber+1)
 	}
 
-	if args.OpNumber > r.Rstate.OpNumber {
-		r.addLog(args.Command)
-		r.Rstate.OpNumber++
+	for i, command := range args.Commands {
+		// (some might be from a Prepare we've already had, if it was resent)
+		if first+uint(i) > r.Rstate.OpNumber {
+			r.addLog(command)
+			r.Rstate.OpNumber++
+		}
 	}
+	r.PrepareCond.Broadcast()
 
 	// commit the last thing if necessary (this reduces the number of actual
 	// commit messages that need to be sent)
 	r.doCommit(args.CommitNumber)
+	r.caughtUpTo(args.CommitNumber)
 
-	*reply = PrepareReply{r.Rstate.View, r.Rstate.OpNumber, r.Rstate.ReplicaNumber, time.Now().Add(LEASE)}
-	r.Rstate.ExtendLease(reply.Lease)
+	*reply = PrepareReply{r.Rstate.View, r.Rstate.OpNumber, r.Rstate.ReplicaNumber, r.grantLease()}
 
 	return nil
 }
 
 func (t *RPCReplica) Commit(args *CommitArgs, reply *HeartbeatReply) error {
 	r := t.R
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 
 	if args.View > r.Rstate.View {
 		// a new master must have been elected without us, so need to recover
-		r.PrepareRecovery()
+		r.prepareRecoveryLocked()
 		return errors.New("doing a recovery")
 	} else if args.View < r.Rstate.View {
 		// message from the old master, ignore
@@ -190,41 +268,169 @@ func (t *RPCReplica) Commit(args *CommitArgs, reply *HeartbeatReply) error {
 	}
 
 	r.doCommit(args.CommitNumber)
+	r.caughtUpTo(args.CommitNumber)
 
 	reply.ReplicaNumber = r.Rstate.ReplicaNumber
-	reply.Lease = time.Now().Add(LEASE)
-	r.Rstate.ExtendLease(reply.Lease)
+	reply.OpNumber = r.Rstate.OpNumber
+	reply.Lease = r.grantLease()
 
 	return nil
 }
 
-func (r *Replica) RunVR(command Command) {
-	if r.IsShutdown {
-		return
+// waitForOp waits up to timeout for other Prepares to bring us up to op.
+// The caller must hold StateLock (which others can take while we wait)
+func (r *Replica) waitForOp(op uint, timeout time.Duration) {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		r.StateLock.Lock()
+		timedOut = true
+		r.PrepareCond.Broadcast()
+		r.StateLock.Unlock()
+	})
+	defer timer.Stop()
+	for r.Rstate.OpNumber < op && !timedOut {
+		r.PrepareCond.Wait()
 	}
-	assert(r.IsMaster())
-	r.Mstate.RunVRLock.Lock()
+}
 
-	vrCommand := VRCommand{command, make(chan int)}
+// RunVR replicates a command, and returns once it has committed. Commands
+// from concurrent calls commit in the order RunVR was called. It returns an
+// error if we aren't master, or stop being master before the command commits
+// (e.g. because we lost touch with a majority), in which case the command may
+// or may not still commit under the next master
+func (r *Replica) RunVR(command Command) error {
+	return r.RunVRContext(context.Background(), command)
+}
 
-	r.addLog(vrCommand)
-	r.Rstate.OpNumber++
+// RunVRContext is RunVR, but gives up once ctx is done. A command that hasn't
+// gone out in a Prepare by then is dropped, so it never commits
+func (r *Replica) RunVRContext(ctx context.Context, command Command) error {
+	if r.Stopped() {
+		return errors.New("Shut down")
+	}
+	// (buffered, since nobody's listening if the command commits after we've given up on it)
+	vrCommand := VRCommand{command, make(chan int, 1)}
 
-	r.Debug(STATUS, "I'm master, RunVR'ing %d", r.Rstate.OpNumber)
+	r.Mstate.RunVRLock.Lock()
+	// (we only have a term while we're master)
+	term := r.Mstate.Term
+	if term == nil {
+		r.Mstate.RunVRLock.Unlock()
+		return errors.New("Not master")
+	}
+	r.Mstate.Pending = append(r.Mstate.Pending, vrCommand)
+	if !r.Mstate.Preparing {
+		r.Mstate.Preparing = true
+		go r.prepareLoop()
+	}
+	r.Mstate.RunVRLock.Unlock()
 
-	args := PrepareArgs{r.Rstate.View, vrCommand, r.Rstate.OpNumber, r.Rstate.CommitNumber}
-	replyConstructor := func() interface{} { return new(PrepareReply) }
-	go r.sendAndRecv(NREPLICAS-1, "RPCReplica.Prepare", args, replyConstructor, func(reply interface{}) bool {
-		return r.handlePrepareOK(reply.(*PrepareReply))
-	})
+	select {
+	case <-vrCommand.Done:
+		r.logf(DEBUG, "Finished RunVR")
+		return nil
+	case <-term.Over:
+		r.logf(STATUS, "RunVR failed: %v", term.Err)
+		return term.Err
+	case <-ctx.Done():
+		r.Mstate.RunVRLock.Lock()
+		for i, pending := range r.Mstate.Pending {
+			if pending.Done == vrCommand.Done {
+				r.Mstate.Pending = append(r.Mstate.Pending[:i], r.Mstate.Pending[i+1:]...)
+				break
+			}
+		}
+		r.Mstate.RunVRLock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// startTerm readies us to take commands as master. The caller must hold StateLock
+func (r *Replica) startTerm() {
+	r.Mstate.RunVRLock.Lock()
+	defer r.Mstate.RunVRLock.Unlock()
+	r.endTermLocked(errors.New("Became master again"))
+	// whatever was in flight before will never commit as part of that Prepare
+	for range r.Mstate.Inflight {
+		<-r.Mstate.Window
+	}
+	r.Mstate.Inflight = nil
+	r.startPeersLocked()
+	r.Mstate.Term = &masterTerm{Over: make(chan bool)}
+}
+
+// endTerm stops us acting as master (if we were), failing every RunVR still waiting with err
+func (r *Replica) endTerm(err error) {
+	r.Mstate.RunVRLock.Lock()
+	r.endTermLocked(err)
 	r.Mstate.RunVRLock.Unlock()
+}
 
-	<-vrCommand.Done
-	r.Debug(DEBUG, "Finished RunVR")
+// endTermLocked is endTerm for callers that hold RunVRLock
+func (r *Replica) endTermLocked(err error) {
+	term := r.Mstate.Term
+	if term == nil {
+		return
+	}
+	r.logf(STATUS, "No longer master: %v", err)
+	term.Err = err
+	close(term.Over)
+	r.Mstate.Term = nil
+	r.Mstate.Pending = nil
+	r.stopPeersLocked()
 }
 
+// prepareLoop sends Prepares for pending commands until there are none left. Whatever
+// piles up while PREPARE_WINDOW Prepares are in flight goes out together in the next one
+func (r *Replica) prepareLoop() {
+	for {
+		r.Mstate.Window <- true
+		r.StateLock.Lock()
+		r.Mstate.RunVRLock.Lock()
+		if len(r.Mstate.Pending) == 0 {
+			r.Mstate.Preparing = false
+			r.Mstate.RunVRLock.Unlock()
+			r.StateLock.Unlock()
+			<-r.Mstate.Window
+			return
+		}
+		n := len(r.Mstate.Pending)
+		if n > MAX_BATCH {
+			n = MAX_BATCH
+		}
+		commands := make([]interface{}, n)
+		for i, vrCommand := range r.Mstate.Pending[:n] {
+			r.addLog(vrCommand)
+			r.Rstate.OpNumber++
+			commands[i] = vrCommand
+		}
+		r.Mstate.Pending = r.Mstate.Pending[n:]
+		r.Debug(STATUS, "I'm master, RunVR'ing %d commands up to %d", n, r.Rstate.OpNumber)
+		args := &PrepareArgs{r.Rstate.View, commands, r.Rstate.OpNumber, r.Rstate.CommitNumber}
+		r.Mstate.Inflight = append(r.Mstate.Inflight, r.Rstate.OpNumber)
+		for _, p := range r.Mstate.Peers {
+			p.prepare(args)
+		}
+		r.Mstate.RunVRLock.Unlock()
+		r.StateLock.Unlock()
+	}
+}
+
+// releaseWindow gives back the Window tokens of Prepares that have now committed.
+// The caller must hold StateLock
+func (r *Replica) releaseWindow() {
+	r.Mstate.RunVRLock.Lock()
+	for len(r.Mstate.Inflight) > 0 && r.Mstate.Inflight[0] <= r.Rstate.CommitNumber {
+		r.Mstate.Inflight = r.Mstate.Inflight[1:]
+		<-r.Mstate.Window
+	}
+	r.Mstate.RunVRLock.Unlock()
+}
+
+// calcHighestMajorityOp returns the highest op a majority has prepared. The
+// caller must hold StateLock and LeaseLock
 func (r *Replica) calcHighestMajorityOp() uint {
-	assert(r.IsMaster())
+	assert(r.isMasterLocked())
 	sortedOps := SortUints(r.Mstate.HighestOp)
 
 	lowestMajority := len(sortedOps) - int(F)
@@ -236,10 +442,12 @@ func (r *Replica) calcHighestMajorityOp() uint {
 }
 
 func (r *Replica) handlePrepareOK(reply *PrepareReply) bool {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 	r.Debug(DEBUG, "got response: %+v\n", reply)
 
 	// no longer master, we don't care about this prepare anymore
-	if !r.IsMaster() {
+	if !r.isMasterLocked() {
 		return true
 	}
 
@@ -247,42 +455,69 @@ func (r *Replica) handlePrepareOK(reply *PrepareReply) bool {
 		return false
 	}
 
-	r.Heartbeat(reply.ReplicaNumber, reply.Lease)
+	r.heartbeatLocked(reply.ReplicaNumber, reply.Lease)
 
+	// (replies from different replicas are handled concurrently)
+	r.Mstate.LeaseLock.Lock()
 	if reply.OpNumber > r.Mstate.HighestOp[reply.ReplicaNumber] {
 		r.Mstate.HighestOp[reply.ReplicaNumber] = reply.OpNumber
 	}
+	r.Mstate.LeaseLock.Unlock()
 
-	r.Debug(DEBUG, "new master state: %v\n", r.Mstate)
+	return r.commitPreparedLocked() >= reply.OpNumber
+}
+
+// commitPrepared commits everything a majority has prepared, unless an earlier
+// master might still hold the lease (see BecomeMaster)
+func (r *Replica) commitPrepared() {
+	r.StateLock.Lock()
+	r.commitPreparedLocked()
+	r.StateLock.Unlock()
+}
 
+// commitPreparedLocked is commitPrepared for callers that hold StateLock, and
+// returns our commit number
+func (r *Replica) commitPreparedLocked() uint {
+	if !r.isMasterLocked() {
+		return r.Rstate.CommitNumber
+	}
+	r.Mstate.LeaseLock.Lock()
 	highCommit := r.calcHighestMajorityOp()
+	waiting := time.Now().Before(r.Mstate.Since)
+	r.Mstate.LeaseLock.Unlock()
 
-	if highCommit > r.Rstate.CommitNumber {
+	if highCommit > r.Rstate.CommitNumber && !waiting {
 		// we've now gotten a majority
 		r.doCommit(highCommit)
+		r.releaseWindow()
 	}
-
-	return highCommit >= reply.OpNumber
+	return r.Rstate.CommitNumber
 }
 
 func (r *Replica) sendCommitMsgs() {
-	args := CommitArgs{r.Rstate.View, r.Rstate.CommitNumber}
-	r.Debug(STATUS, "sending commit: %d", r.Rstate.CommitNumber)
-	go r.sendAndRecv(NREPLICAS-1, "RPCReplica.Commit", args,
-		func() interface{} { return new(HeartbeatReply) },
-		func(reply interface{}) bool {
-			heartbeat := reply.(*HeartbeatReply)
-			r.Heartbeat(heartbeat.ReplicaNumber, heartbeat.Lease)
-			return false
-		})
+	r.logf(STATUS, "sending heartbeats")
+	r.Mstate.RunVRLock.Lock()
+	for _, p := range r.Mstate.Peers {
+		p.heartbeat()
+	}
+	r.Mstate.RunVRLock.Unlock()
 }
 
 func RunAsReplica(i uint, config []string) *Replica {
-	NREPLICAS = uint(len(config))
-	F = (NREPLICAS - 1) / 2
+	return RunAsReplicaInDir(i, config, "")
+}
+
+// RunAsReplicaInDir is RunAsReplica, but keeps the replica's files (i.e. its snapshot)
+// in dataDir instead of the current directory
+func RunAsReplicaInDir(i uint, config []string, dataDir string) *Replica {
+	// (other replicas in this process read these, so only write them if they change)
+	if n := uint(len(config)); n != NREPLICAS {
+		NREPLICAS = n
+		F = (NREPLICAS - 1) / 2
+	}
 	r := new(Replica)
 	r.Rstate.ReplicaNumber = i
-	r.SnapshotFile = fmt.Sprintf(SNAPSHOT_FILE, i)
+	r.SnapshotFile = filepath.Join(dataDir, fmt.Sprintf(SNAPSHOT_FILE, i))
 	r.Config = config
 	r.Conns = make([]*rpc.Client, NREPLICAS)
 
@@ -300,19 +535,38 @@ func RunAsReplica(i uint, config []string) *Replica {
 	return r
 }
 
-func (r *Replica) BecomeMaster() {
-	assert(r.IsMaster())
-	// TODO: anything else we need to do to become the master?
+// BecomeMaster starts our term as master of the view. The last master (or one
+// before it) might think it holds the lease until oldLease, so until then we
+// don't commit anything or answer reads, or else it could answer reads that
+// miss our writes. Prepares still go out in the meantime, and commit once it's over.
+// The caller must hold StateLock
+func (r *Replica) BecomeMaster(oldLease time.Time) {
+	assert(r.isMasterLocked())
+	now := time.Now()
 	r.Mstate.Reset()
-	// resets master's timer
-	// TODO: we can't just assume we have the lease like this
-	r.Mstate.ExtendNeedsRenewal(time.Now().Add(LEASE - MAX_CLOCK_DRIFT))
-	r.Rstate.ExtendLease(time.Now().Add(LEASE - MAX_CLOCK_DRIFT))
+	r.Mstate.LeaseLock.Lock()
+	r.Mstate.Since = now
+	if oldLease.After(now) {
+		r.Mstate.Since = oldLease
+		r.Debug(STATUS, "Waiting out the old master's lease for %v", oldLease.Sub(now))
+		time.AfterFunc(oldLease.Sub(now), r.commitPrepared)
+	}
+	r.Mstate.LeaseLock.Unlock()
+	// (if we hand over before then, our successor has to wait it out too)
+	r.waitedOut(oldLease)
+	r.startTerm()
+	// these are only timers: we hold the lease once a majority has answered our
+	// heartbeats (and oldLease has passed), see Heartbeat and HasLease
+	r.Mstate.ExtendNeedsRenewal(now.Add(LEASE - MAX_CLOCK_DRIFT))
+	r.Rstate.ExtendLease(now.Add(LEASE - MAX_CLOCK_DRIFT))
 }
 
 func (r *Replica) ReplicaInit() {
 	SetupVRLog()
 	gob.Register(VRCommand{})
+	r.PrepareCond = sync.NewCond(&r.StateLock)
+	r.Mstate.Window = make(chan bool, PREPARE_WINDOW)
+	r.resetVcstate()
 	// ReplicaRun will do this too if necessary, but if there's some reason the listener won't work initially
 	// e.g. there's already something running on that port, we catch it here and exit
 	if err := r.ListenerInit(); err != nil {
@@ -333,38 +587,127 @@ func (r *Replica) ReplicaRun() {
 	newServer.Register(rpcreplica)
 
 	for {
-		if r.IsDisconnected {
+		r.ConnLock.Lock()
+		disconnected, listener := r.IsDisconnected, r.Listener
+		r.ConnLock.Unlock()
+		if disconnected {
 			break
 		}
-		if r.Listener == nil {
+		if listener == nil {
 			err := r.ListenerInit()
 			if err != nil {
 				time.Sleep(500 * time.Millisecond)
-				continue
 			}
+			continue
 		}
-		conn, err := r.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			r.Debug(ERROR, "err: %v", err)
-			if r.Listener != nil {
-				r.Listener.Close()
+			r.logf(ERROR, "err: %v", err)
+			listener.Close()
+			r.ConnLock.Lock()
+			if r.Listener == listener {
+				r.Listener = nil
 			}
-			r.Listener = nil
+			r.ConnLock.Unlock()
 			time.Sleep(500 * time.Millisecond)
 			continue
 		}
 		buf := bufio.NewWriter(conn)
 		srv := &GobServerCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+		r.ConnLock.Lock()
 		r.Codecs = append(r.Codecs, srv)
+		r.ConnLock.Unlock()
 		go newServer.ServeCodec(srv)
 	}
 }
 
+// addLog adds the next op to the log. The caller must hold StateLock
 func (r *Replica) addLog(command interface{}) {
 	r.Phatlog.Add(r.Rstate.OpNumber+1, command)
 	r.Debug(DEBUG, "adding command to log")
 }
 
+// caughtUpTo notes that the master has committed up to cn, as of now
+func (r *Replica) caughtUpTo(cn uint) {
+	r.CommitLock.Lock()
+	if r.Rstate.CommitNumber >= cn {
+		r.Rstate.CaughtUp = time.Now()
+	}
+	r.CommitLock.Unlock()
+}
+
+// Freshness returns our commit number, and when we last knew that was everything the
+// master had committed: now if we're master and hold the lease, and the zero time if
+// we aren't in normal status (so can't tell)
+func (r *Replica) Freshness() (uint, time.Time) {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	if r.hasLeaseLocked() {
+		return r.Rstate.CommitNumber, time.Now()
+	}
+	r.CommitLock.Lock()
+	defer r.CommitLock.Unlock()
+	if r.Rstate.Status != Normal || r.isMasterLocked() {
+		return r.Rstate.CommitNumber, time.Time{}
+	}
+	return r.Rstate.CommitNumber, r.Rstate.CaughtUp
+}
+
+type commitWaiter struct {
+	OpNumber uint
+	Done     chan bool
+}
+
+// WaitForCommit waits up to timeout until we've committed op cn, and returns whether we have
+func (r *Replica) WaitForCommit(cn uint, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return r.WaitForCommitContext(ctx, cn)
+}
+
+// WaitForCommitContext is WaitForCommit, but waits until ctx is done
+func (r *Replica) WaitForCommitContext(ctx context.Context, cn uint) bool {
+	r.CommitLock.Lock()
+	if r.Rstate.CommitNumber >= cn {
+		r.CommitLock.Unlock()
+		return true
+	}
+	w := commitWaiter{cn, make(chan bool, 1)}
+	r.CommitWaiters = append(r.CommitWaiters, w)
+	r.CommitLock.Unlock()
+
+	select {
+	case <-w.Done:
+		return true
+	case <-ctx.Done():
+	}
+	r.CommitLock.Lock()
+	defer r.CommitLock.Unlock()
+	for i, other := range r.CommitWaiters {
+		if other.Done == w.Done {
+			r.CommitWaiters = append(r.CommitWaiters[:i], r.CommitWaiters[i+1:]...)
+			return false
+		}
+	}
+	// we were woken just as we gave up
+	return true
+}
+
+// wakeCommitWaiters wakes up everyone waiting for an op we've now committed.
+// The caller must hold CommitLock
+func (r *Replica) wakeCommitWaiters() {
+	waiting := r.CommitWaiters[:0]
+	for _, w := range r.CommitWaiters {
+		if w.OpNumber <= r.Rstate.CommitNumber {
+			w.Done <- true
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	r.CommitWaiters = waiting
+}
+
+// doCommit commits everything up to op cn. The caller must hold StateLock
 func (r *Replica) doCommit(cn uint) {
 	r.CommitLock.Lock()
 	needsUnlock := true
@@ -381,7 +724,7 @@ func (r *Replica) doCommit(cn uint) {
 		r.Debug(STATUS, "need to do state transfer. only at op %d in log but got commit for %d\n", r.Rstate.OpNumber, cn)
 		r.CommitLock.Unlock()
 		needsUnlock = false
-		r.StartStateTransfer()
+		r.startStateTransferLocked()
 		return
 	} else if cn > r.Rstate.CommitNumber+1 {
 		r.Debug(STATUS, "need to do extra commits to commit to %d", cn)
@@ -402,6 +745,7 @@ func (r *Replica) doCommit(cn uint) {
 	vrCommand := r.Phatlog.GetCommand(r.Rstate.CommitNumber + 1).(VRCommand)
 	vrCommand.C.CommitFunc(r.Context)
 	r.Rstate.CommitNumber++
+	r.wakeCommitWaiters()
 	r.Debug(DEBUG, "committed: %d", r.Rstate.CommitNumber)
 	if (r.Rstate.CommitNumber % SNAP_FREQ) == SNAP_FREQ-1 {
 		go r.TakeSnapshot()
@@ -412,7 +756,10 @@ func (r *Replica) doCommit(cn uint) {
 }
 
 func (r *Replica) ClientConnect(repNum uint) (*rpc.Client, error) {
-	if r.IsDisconnected {
+	r.ConnLock.Lock()
+	disconnected := r.IsDisconnected
+	r.ConnLock.Unlock()
+	if disconnected {
 		return nil, errors.New("Disconnected")
 	}
 	assert(repNum != r.Rstate.ReplicaNumber)
@@ -430,6 +777,36 @@ func (r *Replica) ClientConnect(repNum uint) (*rpc.Client, error) {
 	return c, err
 }
 
+// getConn returns our connection to the given replica, connecting if we have none
+func (r *Replica) getConn(repNum uint) (*rpc.Client, error) {
+	r.ConnLock.Lock()
+	conn := r.Conns[repNum]
+	r.ConnLock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	return r.ClientConnect(repNum)
+}
+
+// callFailed logs an RPC to the given replica failing on its tries'th try
+func (r *Replica) callFailed(repNum uint, tries uint, err error) {
+	if err == rpc.ErrShutdown {
+		// connection is shutdown so force reconnect
+		r.ConnLock.Lock()
+		if r.Conns[repNum] != nil {
+			r.Conns[repNum].Close()
+			r.Conns[repNum] = nil
+		}
+		r.ConnLock.Unlock()
+	}
+	level := STATUS
+	// errors from retries are only logged in debug mode
+	if tries > 1 {
+		level = DEBUG
+	}
+	r.logf(level, "message error: %v", err)
+}
+
 // send RPC (and retry if needed) to the given replica
 func (r *Replica) SendOne(repNum uint, msg string, args interface{}, reply interface{}) {
 	r.sendAndRecvTo([]uint{repNum}, msg, args, func() interface{} { return reply }, func(r interface{}) bool { return false })
@@ -464,10 +841,11 @@ func (r *Replica) sendAndRecv(N uint, msg string, args interface{}, newReply fun
 * are received, even when handler returns true. This is so all replicas
 * do eventually get the message, even once a majority has been reached
 * and other operations can continue
+* If handler never returns true, sendAndRecv returns once every replica has
+* replied or been given up on (after MAX_TRIES), so nothing is left waiting
+* The master's Prepares and Commits don't go through here (see peer.go), and
+* when they can't reach a majority, RunVR fails once the master's lease runs out
 */
-//TODO: need to handle the case where handler never returns true e.g.
-// because we were in a network partition and couldn't reach any other
-// replicas. eventually we should exit but still somehow signify failure
 func (r *Replica) sendAndRecvTo(replicas []uint, msg string, args interface{}, newReply func() interface{}, handler func(reply interface{}) bool) {
 	type ReplicaCall struct {
 		Reply interface{}
@@ -486,15 +864,11 @@ func (r *Replica) sendAndRecvTo(replicas []uint, msg string, args interface{}, n
 		call.Tries = tries + 1
 
 		// might need to first open a connection to them
-		r.ConnLock.Lock()
-		conn := r.Conns[repNum]
-		r.ConnLock.Unlock()
-		if conn == nil {
-			conn, call.Error = r.ClientConnect(repNum)
-			if call.Error != nil {
-				callChan <- call
-				return
-			}
+		conn, err := r.getConn(repNum)
+		if err != nil {
+			call.Error = err
+			callChan <- call
+			return
 		}
 		call.Reply = newReply()
 		call.Error = conn.Call(msg, args, call.Reply)
@@ -503,10 +877,12 @@ func (r *Replica) sendAndRecvTo(replicas []uint, msg string, args interface{}, n
 	}
 
 	// send requests to the replicas
+	N := 0
 	for _, repNum := range replicas {
 		if repNum == r.Rstate.ReplicaNumber {
 			continue
 		}
+		N++
 		go sendOne(repNum, 0)
 	}
 
@@ -515,29 +891,14 @@ func (r *Replica) sendAndRecvTo(replicas []uint, msg string, args interface{}, n
 	go func() {
 		callHandler := true
 		// and now get the responses and retry if necessary
-		N := len(replicas)
 		for i := 0; i < N; {
 			call := <-callChan
 			if call.Error != nil {
-				level := STATUS
-				if call.Error == rpc.ErrShutdown {
-					// connection is shutdown so force reconnect
-					r.ConnLock.Lock()
-					if r.Conns[call.RepNum] != nil {
-						r.Conns[call.RepNum].Close()
-						r.Conns[call.RepNum] = nil
-					}
-					r.ConnLock.Unlock()
-				}
-				// errors from retries are only logged in debug mode
-				if call.Tries > 1 {
-					level = DEBUG
-				}
-				r.Debug(level, "sendAndRecv message error: %v", call.Error)
+				r.callFailed(call.RepNum, call.Tries, call.Error)
 
 				// give up eventually (mainly, helps recovery errors actually show up)
 				if call.Tries >= MAX_TRIES {
-					//i++
+					i++
 					continue
 				}
 				go func() {
@@ -23,7 +23,7 @@ var N int
 func RunTest(r *vr.Replica) {
 	go func() {
 		for {
-			if r.IsShutdown || !r.IsMaster() {
+			if r.Stopped() || !r.IsMaster() {
 				time.Sleep(100 * time.Millisecond)
 				continue
 			}
@@ -1,6 +1,7 @@
 package vr
 
 import (
+	"errors"
 	"github.com/mgentili/goPhat/phatlog"
 	"math/rand"
 )
@@ -38,6 +39,13 @@ func (r *Replica) resetRcvstate() {
 
 //A replica notices that it needs a recovery
 func (r *Replica) PrepareRecovery() {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	r.prepareRecoveryLocked()
+}
+
+// prepareRecoveryLocked is PrepareRecovery for callers that hold StateLock
+func (r *Replica) prepareRecoveryLocked() {
 
 	// already in recovery
 	if r.Rstate.Status == Recovery {
@@ -45,6 +53,7 @@ func (r *Replica) PrepareRecovery() {
 	}
 
 	//change state to recovery
+	r.endTerm(errors.New("Recovering"))
 	r.Rstate.Status = Recovery
 	r.Debug(STATUS, "Starting Recovery")
 
@@ -52,7 +61,7 @@ func (r *Replica) PrepareRecovery() {
 
 	//fill RPC args
 	r.Rcvstate.Nonce = uint(rand.Uint32())
-	args := RecoveryArgs{r.Rstate.ReplicaNumber, r.Rcvstate.Nonce, r.SnapshotIndex}
+	args := RecoveryArgs{r.Rstate.ReplicaNumber, r.Rcvstate.Nonce, r.snapshotIndex()}
 
 	//send Recovery RPCs
 	go r.sendAndRecv(NREPLICAS-1, "RPCReplica.Recovery", args,
@@ -63,12 +72,14 @@ func (r *Replica) PrepareRecovery() {
 
 func (t *RPCReplica) Recovery(args *RecoveryArgs, reply *RecoveryResponse) error {
 	r := t.R
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 
 	r.Debug(STATUS, "Got Recovery RPC")
 
 	var log *phatlog.Log = nil
 	var snapshot []byte = nil
-	if r.IsMaster() {
+	if r.isMasterLocked() {
 		log, snapshot = r.RecoverInfoFromOpNumber(args.SnapshotIndex)
 	}
 	*reply = RecoveryResponse{r.Rstate.View, args.Nonce, log, snapshot, r.Rstate.OpNumber,
@@ -78,6 +89,8 @@ func (t *RPCReplica) Recovery(args *RecoveryArgs, reply *RecoveryResponse) error
 }
 
 func (r *Replica) handleRecoveryResponse(reply *RecoveryResponse) (done bool) {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 	r.Debug(STATUS, "Got recoveryresponse from replica %d", reply.ReplicaNumber)
 
 	done = false
@@ -113,7 +126,7 @@ func (r *Replica) handleRecoveryResponse(reply *RecoveryResponse) (done bool) {
 	// if majority of replicas respond with empty logs, then we've just started
 	// so we go into view change
 	if r.Rcvstate.EmptyLogs >= F+1 {
-		r.PrepareViewChange()
+		r.prepareViewChangeLocked()
 		r.Debug(STATUS, "Received quorum of empty logs, going to Normal")
 		done = true
 		return
@@ -133,7 +146,7 @@ func (r *Replica) handleRecoveryResponse(reply *RecoveryResponse) (done bool) {
 
 	//We have recived enough Recovery messages and have recieved from master
 	if r.Rcvstate.RecoveryResponses >= F+1 && ((1<<masterId)&r.Rcvstate.RecoveryResponseReplies) != 0 {
-		assert(r.Rcvstate.RecoveryResponseMsgs[masterId].CommitNumber >= r.SnapshotIndex)
+		assert(r.Rcvstate.RecoveryResponseMsgs[masterId].CommitNumber >= r.snapshotIndex())
 		r.Rstate.View = r.Rcvstate.RecoveryResponseMsgs[masterId].View
 		r.Phatlog = r.Rcvstate.RecoveryResponseMsgs[masterId].Log
 		if r.Phatlog == nil {
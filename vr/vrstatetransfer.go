@@ -18,6 +18,14 @@ type GetStateResponse struct {
 
 //A replica notices that it needs a recovery
 func (r *Replica) StartStateTransfer() {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	r.startStateTransferLocked()
+}
+
+// startStateTransferLocked is StartStateTransfer for callers that hold StateLock.
+// The transfer happens in the background
+func (r *Replica) startStateTransferLocked() {
 
 	if r.Rstate.Status != Normal {
 		return
@@ -29,13 +37,15 @@ func (r *Replica) StartStateTransfer() {
 	args := GetStateArgs{r.Rstate.View, r.Rstate.OpNumber}
 
 	//send State Transfer RPC to master
-	r.sendAndRecvTo([]uint{r.Rstate.View % NREPLICAS}, "RPCReplica.GetState", args,
+	go r.sendAndRecvTo([]uint{r.Rstate.View % NREPLICAS}, "RPCReplica.GetState", args,
 		func() interface{} { return new(GetStateResponse) },
 		func(reply interface{}) bool { return r.handleGetStateResponse(reply.(*GetStateResponse)) })
 }
 
 func (t *RPCReplica) GetState(args *GetStateArgs, reply *GetStateResponse) error {
 	r := t.R
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 
 	r.Debug(STATUS, "Got GetState RPC")
 
@@ -44,21 +54,27 @@ func (t *RPCReplica) GetState(args *GetStateArgs, reply *GetStateResponse) error
 	}
 
 	//TODO: Only need to send new part of log
-	*reply = GetStateResponse{r.Rstate.View, r.Phatlog, r.Rstate.OpNumber,
+	// (a copy, since the reply is sent after we've let go of StateLock)
+	*reply = GetStateResponse{r.Rstate.View, r.Phatlog.Copy(), r.Rstate.OpNumber,
 		r.Rstate.CommitNumber}
 
 	return nil
 }
 
 func (r *Replica) handleGetStateResponse(reply *GetStateResponse) bool {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 	r.Debug(STATUS, "Got NewState")
 
 	if reply.View != r.Rstate.View {
 		return true
 	}
 
-	r.Phatlog = reply.Log
-	r.Rstate.OpNumber = reply.OpNumber
+	// (Prepares might have brought us as far along while we waited)
+	if reply.OpNumber > r.Rstate.OpNumber {
+		r.Phatlog = reply.Log
+		r.Rstate.OpNumber = reply.OpNumber
+	}
 	r.doCommit(reply.CommitNumber)
 
 	return true
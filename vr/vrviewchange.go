@@ -1,6 +1,7 @@
 package vr
 
 import (
+	"errors"
 	"github.com/mgentili/goPhat/phatlog"
 	"time"
 )
@@ -17,6 +18,9 @@ type ViewChangeState struct {
 type StartViewChangeArgs struct {
 	View          uint
 	ReplicaNumber uint
+	// the latest the sender knows some master might hold the lease until. If the
+	// sender was master itself, this doesn't count its own lease, which it's given up
+	Lease time.Time
 }
 
 type StartViewArgs struct {
@@ -33,6 +37,9 @@ type DoViewChangeArgs struct {
 	NormalView    uint
 	OpNumber      uint
 	CommitNumber  uint
+	// the latest the sender knows some master might hold the lease until, and its view
+	Lease     time.Time
+	LeaseView uint
 }
 
 func (r *Replica) resetVcstate() {
@@ -42,7 +49,15 @@ func (r *Replica) resetVcstate() {
 
 //A replica notices that a viewchange is needed
 func (r *Replica) PrepareViewChange() {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	r.prepareViewChangeLocked()
+}
+
+// prepareViewChangeLocked is PrepareViewChange for callers that hold StateLock
+func (r *Replica) prepareViewChangeLocked() {
 	r.resetVcstate()
+	r.endTerm(errors.New("View change"))
 	if r.Rstate.Status == Normal {
 		r.Vcstate.NormalView = r.Rstate.View
 	}
@@ -50,7 +65,7 @@ func (r *Replica) PrepareViewChange() {
 	r.Rstate.View++
 	r.Debug(STATUS, "PrepareViewChange")
 
-	args := StartViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber}
+	args := StartViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber, r.Rstate.LeaseGranted}
 
 	go r.sendAndRecv(NREPLICAS-1, "RPCReplica.StartViewChange", args,
 		func() interface{} { return nil },
@@ -58,15 +73,35 @@ func (r *Replica) PrepareViewChange() {
 
 }
 
+// StepDown hands over to the next master, if we're master. We give up the lease
+// straight away and say so in our StartViewChange, so the next master needn't
+// wait for it to run out
+func (r *Replica) StepDown() {
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
+	if !r.isMasterLocked() {
+		return
+	}
+	r.Debug(STATUS, "Stepping down")
+	r.prepareViewChangeLocked()
+	// (we time out if the next master doesn't take over)
+	r.Rstate.ExtendLease(time.Now().Add(LEASE))
+}
+
 //viewchange RPCs
 func (t *RPCReplica) StartViewChange(args *StartViewChangeArgs, reply *int) error {
 	r := t.R
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 
 	//This view is already ahead of the proposed one
 	if r.Rstate.View > args.View || (r.Rstate.View == args.View && r.Rstate.Status != ViewChange) {
 		return nil
 	}
 
+	// (a master only sends these once it's stopped acting as master)
+	r.handedOver(args.ReplicaNumber, args.View, args.Lease)
+
 	if r.Rstate.View < args.View {
 		r.resetVcstate()
 	}
@@ -82,20 +117,18 @@ func (t *RPCReplica) StartViewChange(args *StartViewChangeArgs, reply *int) erro
 
 	//first time we have seen this viewchange message
 	if r.Rstate.View < args.View {
+		r.endTerm(errors.New("View change"))
 		if r.Rstate.Status == Normal {
 			r.Vcstate.NormalView = r.Rstate.View //last known normal View
 		}
 		r.Rstate.View = args.View
 		r.Rstate.Status = ViewChange
 
-		SVCargs := StartViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber}
+		SVCargs := StartViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber, r.Rstate.LeaseGranted}
 
 		//send StartViewChange messages to all replicas
-		// TODO: we may want to only do this if our own master lease times out
-		// (and not necessarily if we get a StartViewChange from someone else)
-		// otherwise, we can potentially ditch our master too early, violating
-		// the lease contract (which implies that a new master can't be
-		// elected until a majority of the old master's leases expire)
+		// (this can be before the lease we granted our master runs out, but we
+		// tell the new master about it in our DoViewChange, and it waits it out)
 		go r.sendAndRecv(NREPLICAS-1, "RPCReplica.StartViewChange", SVCargs,
 			func() interface{} { return nil },
 			func(r interface{}) bool { return false })
@@ -106,20 +139,21 @@ func (t *RPCReplica) StartViewChange(args *StartViewChangeArgs, reply *int) erro
 		r.Debug(STATUS, "Sending DoViewChange")
 		r.Debug(STATUS, "Sending to: %d\n", r.Rstate.View%NREPLICAS)
 
+		//DoViewChange args
+		// (a copy of the log, which is sent after we've let go of StateLock)
+		DVCargs := DoViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber, r.Phatlog.Copy(), r.Vcstate.NormalView,
+			r.Rstate.OpNumber, r.Rstate.CommitNumber, r.Rstate.LeaseGranted, r.Rstate.LeaseView}
+
 		if r.Rstate.View%NREPLICAS == r.Rstate.ReplicaNumber {
 			r.Debug(STATUS, "Implicitly sending DoViewChange to myself")
 			r.Vcstate.DoViews++
-			r.Vcstate.DoViewChangeMsgs[r.Rstate.ReplicaNumber] = DoViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber,
-				r.Phatlog, r.Vcstate.NormalView, r.Rstate.OpNumber, r.Rstate.CommitNumber}
+			r.Vcstate.DoViewChangeMsgs[r.Rstate.ReplicaNumber] = DVCargs
 			return nil
 		}
 
-		//DoViewChange args
-		DVCargs := DoViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber,
-			r.Phatlog, r.Vcstate.NormalView, r.Rstate.OpNumber, r.Rstate.CommitNumber}
-
 		//send to new master
-		r.SendOne(r.Rstate.View%NREPLICAS, "RPCReplica.DoViewChange", DVCargs, nil)
+		// (in the background, since it might be sending us its own at the same time)
+		go r.SendOne(r.Rstate.View%NREPLICAS, "RPCReplica.DoViewChange", DVCargs, nil)
 	}
 
 	return nil
@@ -127,8 +161,14 @@ func (t *RPCReplica) StartViewChange(args *StartViewChangeArgs, reply *int) erro
 
 func (t *RPCReplica) DoViewChange(args *DoViewChangeArgs, reply *int) error {
 	r := t.R
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 
-	// TODO: should probably drop the request if view number doesn't match up
+	// drop messages about any view change but the one we're in the middle of
+	// (including ours, once it's over)
+	if args.View != r.Rstate.View || r.Rstate.Status != ViewChange {
+		return wrongView()
+	}
 
 	//already recieved a message from this replica
 	if ((1 << args.ReplicaNumber) & r.Vcstate.DoViewReplies) != 0 {
@@ -145,15 +185,15 @@ func (t *RPCReplica) DoViewChange(args *DoViewChangeArgs, reply *int) error {
 		r.Debug(STATUS, "PrepareStartView")
 		//updates replica state based on replies
 		r.calcMasterView()
+		oldLease := r.calcOldLease()
 		r.resetVcstate()
 
 		r.Rstate.Status = Normal
-		// TODO: we don't technically have a master lease at this point
-		r.BecomeMaster()
+		r.BecomeMaster(oldLease)
 		r.Debug(STATUS, "ViewChangeComplete!")
 
 		//send the StartView messages to all replicas
-		SVargs := StartViewArgs{r.Rstate.View, r.Phatlog, r.Rstate.OpNumber, r.Rstate.CommitNumber}
+		SVargs := StartViewArgs{r.Rstate.View, r.Phatlog.Copy(), r.Rstate.OpNumber, r.Rstate.CommitNumber}
 		go r.sendAndRecv(NREPLICAS-1, "RPCReplica.StartView", SVargs,
 			func() interface{} { return new(PrepareReply) },
 			func(reply interface{}) bool { return r.handlePrepareOK(reply.(*PrepareReply)) })
@@ -164,23 +204,28 @@ func (t *RPCReplica) DoViewChange(args *DoViewChangeArgs, reply *int) error {
 
 func (t *RPCReplica) StartView(args *DoViewChangeArgs, reply *PrepareReply) error {
 	r := t.R
+	r.StateLock.Lock()
+	defer r.StateLock.Unlock()
 	r.Debug(STATUS, "StartView")
 
-	// TODO: what if we get a StartView for an older view? (VR paper doesn't really mention this case)
+	// (a StartView can turn up after a later view change has started)
+	if args.View < r.Rstate.View {
+		return wrongView()
+	}
 
 	r.Phatlog = args.Log
 	r.Rstate.OpNumber = args.OpNumber
 	r.Rstate.View = args.View //TODO: Note to self (Marco), this addition is necessary, right?
 	r.doCommit(args.CommitNumber)
-	assert(r.Rstate.CommitNumber == args.CommitNumber)
+	// (we might have committed further already, if this StartView is a repeat)
+	assert(r.Rstate.CommitNumber >= args.CommitNumber)
 	r.Rstate.Status = Normal
 
 	r.resetVcstate()
 	r.Debug(STATUS, "ViewChangeComplete!")
 
 	// treat response like PrepareReply, so we can commit uncommitted operations, renew heartbeats, etc.
-	*reply = PrepareReply{r.Rstate.View, r.Rstate.OpNumber, r.Rstate.ReplicaNumber, time.Now().Add(LEASE)}
-	r.Rstate.ExtendLease(reply.Lease)
+	*reply = PrepareReply{r.Rstate.View, r.Rstate.OpNumber, r.Rstate.ReplicaNumber, r.grantLease()}
 
 	return nil
 }
@@ -199,7 +244,8 @@ func (r *Replica) calcMasterView() {
 		maxView = Max(maxView, DVCM.View)
 		maxCommit = Max(maxCommit, DVCM.CommitNumber)
 
-		r.Debug(DEBUG, "doviewchangemessage:  %+v", DVCM)
+		r.Debug(DEBUG, "doviewchangemessage from %d: view %d, normal view %d, op %d, commit %d",
+			DVCM.ReplicaNumber, DVCM.View, DVCM.NormalView, DVCM.OpNumber, DVCM.CommitNumber)
 
 		//choose replica with highest (NormalView, OpNumber) pair to determine log
 		if DVCM.NormalView > bestRep.NormalView || (DVCM.NormalView == bestRep.NormalView && DVCM.OpNumber > bestRep.OpNumber) {
@@ -217,3 +263,32 @@ func (r *Replica) calcMasterView() {
 	r.doCommit(maxCommit)
 	assert(r.Rstate.CommitNumber == maxCommit)
 }
+
+// calcOldLease returns when every lease a master before the new one might hold
+// has run out, going by our quorum of DoViewChange messages. Any master that has
+// held the lease has a majority of leases granted it, at least one of which is in
+// our quorum. A master that's in the quorum itself has given up its lease by
+// taking part in the view change, though, so we needn't wait out leases granted to it
+func (r *Replica) calcOldLease() time.Time {
+	handedOver := make(map[uint]bool)
+	for _, DVCM := range r.Vcstate.DoViewChangeMsgs {
+		if DVCM.View != 0 && DVCM.NormalView%NREPLICAS == DVCM.ReplicaNumber {
+			handedOver[DVCM.NormalView] = true
+		}
+	}
+	var oldLease time.Time
+	for _, DVCM := range r.Vcstate.DoViewChangeMsgs {
+		// (a master's own message is about leases from before its view, which it was waiting out)
+		if DVCM.View == 0 || (handedOver[DVCM.LeaseView] && DVCM.LeaseView%NREPLICAS != DVCM.ReplicaNumber) {
+			continue
+		}
+		if DVCM.Lease.After(oldLease) {
+			oldLease = DVCM.Lease
+		}
+	}
+	if oldLease.IsZero() {
+		return oldLease
+	}
+	// (the leases were granted by the other replicas' clocks)
+	return oldLease.Add(MAX_CLOCK_DRIFT)
+}
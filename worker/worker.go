@@ -1,12 +1,15 @@
 package worker
 
 import (
-	"encoding/gob"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/mgentili/goPhat/client"
 	queue "github.com/mgentili/goPhat/phatqueue"
 	"github.com/mgentili/goPhat/queueRPC"
 	"log"
+	"sync"
+	"time"
 )
 
 const (
@@ -17,7 +20,11 @@ const (
 
 type Worker struct {
 	Cli       *client.Client
+	SessionId string // identifies this worker's commands to the server
 	SeqNumber uint
+	SeqLock   sync.Mutex
+	// name of the queue that Push, Pop, etc. operate on (the default queue if empty)
+	Queue string
 }
 
 func (w *Worker) debug(level int, format string, args ...interface{}) {
@@ -27,29 +34,52 @@ func (w *Worker) debug(level int, format string, args ...interface{}) {
 // NewClient creates a new client connected to the server with given id
 // and attempts to connect to the master server
 func NewWorker(servers []string, id uint, uid string) (*Worker, error) {
+	return NewWorkerContext(context.Background(), servers, id, uid)
+}
+
+// NewWorkerContext is NewWorker, but gives up on connecting once ctx is done.
+// Each of the worker's calls has a ...Context variant too, which gives up (and
+// tells the server to stop waiting on its behalf, e.g. in PopWait) once the context is done
+func NewWorkerContext(ctx context.Context, servers []string, id uint, uid string) (*Worker, error) {
 	var err error
 	w := new(Worker)
 	w.SeqNumber = 0
-	w.Cli, err = client.NewClient(servers, id, uid)
+	// the uid alone isn't enough, since a restarted worker would reuse old sequence numbers
+	w.SessionId = fmt.Sprintf("%s.%d", uid, time.Now().UnixNano())
+	w.Cli, err = client.NewClientContext(ctx, servers, id, uid)
 	if err != nil {
 		return nil, err
 	}
 
-	// We need to register the DataNode and StatNode before we can use them in gob
-	gob.Register(queue.QCommand{})
-	gob.Register(queue.QMessage{})
+	// We need to register the command and reply types before we can use them in gob
+	queue.RegisterTypes()
 	return w, nil
 }
 
-func (w *Worker) processCall(cmd *queue.QCommand) (*queue.QResponse, error) {
-	args := &queueRPC.ClientCommand{w.Cli.Uid, w.SeqNumber, cmd}
-	response := &queue.QResponse{}
+// command builds a command for the worker's current queue
+func (w *Worker) command(name string, value interface{}) *queue.QCommand {
+	return &queue.QCommand{Command: name, Value: value, Queue: w.Queue}
+}
+
+// processCall sends a command, retrying (with the same sequence number, so it's
+// only applied once) if the master can't be reached
+func (w *Worker) processCall(ctx context.Context, cmd *queue.QCommand) (*queue.QResponse, error) {
+	return w.processCallWithWait(ctx, cmd, 0)
+}
+
+// processCallWithWait is processCall for commands the server may hold for up to wait
+func (w *Worker) processCallWithWait(ctx context.Context, cmd *queue.QCommand, wait time.Duration) (*queue.QResponse, error) {
+	deadline, _ := ctx.Deadline()
+	w.SeqLock.Lock()
+	args := &queueRPC.ClientCommand{Uid: w.SessionId, SeqNumber: w.SeqNumber, Command: cmd, Deadline: deadline}
 	w.SeqNumber++
+	w.SeqLock.Unlock()
+	response := &queue.QResponse{}
 	var err error
 	/*defer func() {
 		log.Printf("Errored in processCall %v", err)
 	}()*/
-	err = w.Cli.RpcClient.Call("Server.Send", args, response)
+	err = w.Cli.ProcessCallWithTimeoutContext(ctx, "Server.Send", args, response, client.DefaultTimeout+wait)
 	if err != nil {
 		return nil, err
 	}
@@ -62,14 +92,98 @@ func (w *Worker) processCall(cmd *queue.QCommand) (*queue.QResponse, error) {
 }
 
 func (w *Worker) Push(work string) error {
-	cmd := &queue.QCommand{"PUSH", work}
-	_, err := w.processCall(cmd)
+	return w.PushContext(context.Background(), work)
+}
+
+func (w *Worker) PushContext(ctx context.Context, work string) error {
+	cmd := w.command("PUSH", work)
+	_, err := w.processCall(ctx, cmd)
+	return err
+}
+
+// PushWithOptions pushes work that's popped ahead of lower priority messages,
+// and isn't handed out until delay after the master receives it
+func (w *Worker) PushWithOptions(work string, priority int, delay time.Duration) error {
+	return w.PushWithOptionsContext(context.Background(), work, priority, delay)
+}
+
+func (w *Worker) PushWithOptionsContext(ctx context.Context, work string, priority int, delay time.Duration) error {
+	cmd := w.command("PUSH", queue.QPush{Value: work, Priority: priority, Delay: delay})
+	_, err := w.processCall(ctx, cmd)
+	return err
+}
+
+// PushAt pushes work that isn't handed out before the given time
+func (w *Worker) PushAt(work string, priority int, notBefore time.Time) error {
+	return w.PushAtContext(context.Background(), work, priority, notBefore)
+}
+
+func (w *Worker) PushAtContext(ctx context.Context, work string, priority int, notBefore time.Time) error {
+	cmd := w.command("PUSH", queue.QPush{Value: work, Priority: priority, NotBefore: notBefore})
+	_, err := w.processCall(ctx, cmd)
+	return err
+}
+
+// PushBytes pushes binary work, tagged with an optional content type and headers
+// that are handed back with the message when it's popped
+func (w *Worker) PushBytes(work []byte, contentType string, headers map[string]string) error {
+	return w.PushBytesContext(context.Background(), work, contentType, headers)
+}
+
+func (w *Worker) PushBytesContext(ctx context.Context, work []byte, contentType string, headers map[string]string) error {
+	return w.PushMessageContext(ctx, queue.QPush{Value: work, ContentType: contentType, Headers: headers})
+}
+
+// PushMessage pushes a message with any combination of options. Its Value must be
+// a string or a []byte, otherwise the server rejects it
+func (w *Worker) PushMessage(msg queue.QPush) error {
+	return w.PushMessageContext(context.Background(), msg)
+}
+
+func (w *Worker) PushMessageContext(ctx context.Context, msg queue.QPush) error {
+	if !queue.ValidPayload(msg.Value) {
+		return errors.New("Unsupported PUSH value")
+	}
+	cmd := w.command("PUSH", msg)
+	_, err := w.processCall(ctx, cmd)
+	return err
+}
+
+// PushBatch pushes several messages in a single round trip (and a single log entry).
+// Either all of them are pushed or none are
+func (w *Worker) PushBatch(work []string) error {
+	return w.PushBatchContext(context.Background(), work)
+}
+
+func (w *Worker) PushBatchContext(ctx context.Context, work []string) error {
+	values := make([]queue.QPush, len(work))
+	for i, v := range work {
+		values[i] = queue.QPush{Value: v}
+	}
+	cmd := w.command("PUSH_BATCH", values)
+	_, err := w.processCall(ctx, cmd)
 	return err
 }
 
+// Pop takes the next message off the queue. It stays in progress for the
+// server's default visibility timeout, after which it's redelivered unless Done is called
 func (w *Worker) Pop() (*queue.QResponse, error) {
-	cmd := &queue.QCommand{"POP", ""}
-	res, err := w.processCall(cmd)
+	return w.PopContext(context.Background())
+}
+
+func (w *Worker) PopContext(ctx context.Context) (*queue.QResponse, error) {
+	return w.PopWithTimeoutContext(ctx, 0)
+}
+
+// PopWithTimeout is like Pop, but the message is redelivered if Done isn't
+// called within the given visibility timeout
+func (w *Worker) PopWithTimeout(timeout time.Duration) (*queue.QResponse, error) {
+	return w.PopWithTimeoutContext(context.Background(), timeout)
+}
+
+func (w *Worker) PopWithTimeoutContext(ctx context.Context, timeout time.Duration) (*queue.QResponse, error) {
+	cmd := w.command("POP", timeout)
+	res, err := w.processCall(ctx, cmd)
 	if err != nil {
 		log.Printf("Errored in pop %v", err)
 	}
@@ -77,8 +191,201 @@ func (w *Worker) Pop() (*queue.QResponse, error) {
 	return res, err
 }
 
-func (w *Worker) Done() error {
-	cmd := &queue.QCommand{"DONE", ""}
-	_, err := w.processCall(cmd)
+// PopBatch pops up to max messages in a single round trip, each of which is
+// redelivered if Done isn't called within the visibility timeout (0 for the default)
+func (w *Worker) PopBatch(max int, timeout time.Duration) ([]queue.QMessage, error) {
+	return w.PopBatchContext(context.Background(), max, timeout)
+}
+
+func (w *Worker) PopBatchContext(ctx context.Context, max int, timeout time.Duration) ([]queue.QMessage, error) {
+	return w.PopBatchWaitContext(ctx, max, timeout, 0)
+}
+
+// PopWait is like PopWithTimeout, but if nothing is ready the server holds the
+// request for up to wait, returning as soon as something is pushed
+func (w *Worker) PopWait(timeout time.Duration, wait time.Duration) (*queue.QResponse, error) {
+	return w.PopWaitContext(context.Background(), timeout, wait)
+}
+
+func (w *Worker) PopWaitContext(ctx context.Context, timeout time.Duration, wait time.Duration) (*queue.QResponse, error) {
+	cmd := w.command("POP", queue.QPop{Timeout: timeout, Wait: wait})
+	return w.processCallWithWait(ctx, cmd, wait)
+}
+
+// PopBatchWait is the long polling version of PopBatch (see PopWait)
+func (w *Worker) PopBatchWait(max int, timeout time.Duration, wait time.Duration) ([]queue.QMessage, error) {
+	return w.PopBatchWaitContext(context.Background(), max, timeout, wait)
+}
+
+func (w *Worker) PopBatchWaitContext(ctx context.Context, max int, timeout time.Duration, wait time.Duration) ([]queue.QMessage, error) {
+	cmd := w.command("POP_BATCH", queue.QPopBatch{Max: max, Timeout: timeout, Wait: wait})
+	res, err := w.processCallWithWait(ctx, cmd, wait)
+	if err != nil {
+		return nil, err
+	}
+	return res.Reply.([]queue.QMessage), nil
+}
+
+// Done acknowledges that the popped message with the given id has been
+// processed, so it won't be redelivered
+func (w *Worker) Done(mId string) error {
+	return w.DoneContext(context.Background(), mId)
+}
+
+func (w *Worker) DoneContext(ctx context.Context, mId string) error {
+	cmd := w.command("DONE", mId)
+	_, err := w.processCall(ctx, cmd)
+	return err
+}
+
+// Extend gives an in progress message another timeout (counted from now)
+// before it's redelivered, for tasks that take longer than expected
+func (w *Worker) Extend(mId string, timeout time.Duration) error {
+	return w.ExtendContext(context.Background(), mId, timeout)
+}
+
+func (w *Worker) ExtendContext(ctx context.Context, mId string, timeout time.Duration) error {
+	cmd := w.command("EXTEND", queue.QExtend{MessageID: mId, Timeout: timeout})
+	_, err := w.processCall(ctx, cmd)
 	return err
 }
+
+// Peek returns the message the next Pop would get, without popping it
+func (w *Worker) Peek() (*queue.QMessage, error) {
+	return w.PeekContext(context.Background())
+}
+
+func (w *Worker) PeekContext(ctx context.Context) (*queue.QMessage, error) {
+	cmd := w.command("PEEK", "")
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	msg := res.Reply.(queue.QMessage)
+	return &msg, nil
+}
+
+// List returns a page of the queue's messages, where which is one of queue.LIST_QUEUED,
+// queue.LIST_IN_PROGRESS or queue.LIST_DEAD_LETTER. The result's Total is how many there are
+// in all, so callers can keep increasing offset until they've seen them all
+func (w *Worker) List(which string, offset int, limit int) (*queue.QListResult, error) {
+	return w.ListContext(context.Background(), which, offset, limit)
+}
+
+func (w *Worker) ListContext(ctx context.Context, which string, offset int, limit int) (*queue.QListResult, error) {
+	cmd := w.command("LIST", queue.QList{Which: which, Offset: offset, Limit: limit})
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	list := res.Reply.(queue.QListResult)
+	return &list, nil
+}
+
+// Purge drops every queued and in progress message and returns how many there were
+func (w *Worker) Purge() (int, error) {
+	return w.PurgeContext(context.Background())
+}
+
+func (w *Worker) PurgeContext(ctx context.Context) (int, error) {
+	cmd := w.command("PURGE", "")
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return res.Reply.(int), nil
+}
+
+// DeadLetters lists the messages that were given up on after too many deliveries
+func (w *Worker) DeadLetters() ([]queue.QMessage, error) {
+	return w.DeadLettersContext(context.Background())
+}
+
+func (w *Worker) DeadLettersContext(ctx context.Context) ([]queue.QMessage, error) {
+	cmd := w.command("DLQ_LIST", "")
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return res.Reply.([]queue.QMessage), nil
+}
+
+// ReplayDeadLetter puts a dead letter back on the queue ("" replays all of them)
+// and returns how many messages were replayed
+func (w *Worker) ReplayDeadLetter(mId string) (int, error) {
+	return w.ReplayDeadLetterContext(context.Background(), mId)
+}
+
+func (w *Worker) ReplayDeadLetterContext(ctx context.Context, mId string) (int, error) {
+	cmd := w.command("DLQ_REPLAY", mId)
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return res.Reply.(int), nil
+}
+
+// PurgeDeadLetter drops a dead letter for good ("" purges all of them)
+// and returns how many messages were purged
+func (w *Worker) PurgeDeadLetter(mId string) (int, error) {
+	return w.PurgeDeadLetterContext(context.Background(), mId)
+}
+
+func (w *Worker) PurgeDeadLetterContext(ctx context.Context, mId string) (int, error) {
+	cmd := w.command("DLQ_PURGE", mId)
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return res.Reply.(int), nil
+}
+
+// CreateQueue creates a new named queue. It doesn't change which queue the worker uses
+func (w *Worker) CreateQueue(name string) error {
+	return w.CreateQueueContext(context.Background(), name)
+}
+
+func (w *Worker) CreateQueueContext(ctx context.Context, name string) error {
+	cmd := &queue.QCommand{Command: "CREATE_QUEUE", Queue: name}
+	_, err := w.processCall(ctx, cmd)
+	return err
+}
+
+// DeleteQueue deletes a named queue, along with all of its messages
+func (w *Worker) DeleteQueue(name string) error {
+	return w.DeleteQueueContext(context.Background(), name)
+}
+
+func (w *Worker) DeleteQueueContext(ctx context.Context, name string) error {
+	cmd := &queue.QCommand{Command: "DELETE_QUEUE", Queue: name}
+	_, err := w.processCall(ctx, cmd)
+	return err
+}
+
+func (w *Worker) ListQueues() ([]string, error) {
+	return w.ListQueuesContext(context.Background())
+}
+
+func (w *Worker) ListQueuesContext(ctx context.Context) ([]string, error) {
+	cmd := &queue.QCommand{Command: "LIST_QUEUES"}
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return res.Reply.([]string), nil
+}
+
+// Stats returns the statistics for the worker's current queue
+func (w *Worker) Stats() (*queue.QStats, error) {
+	return w.StatsContext(context.Background())
+}
+
+func (w *Worker) StatsContext(ctx context.Context) (*queue.QStats, error) {
+	cmd := w.command("STATS", "")
+	res, err := w.processCall(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	stats := res.Reply.(queue.QStats)
+	return &stats, nil
+}
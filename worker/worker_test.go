@@ -1,25 +1,87 @@
 package worker
 
 import (
+	"context"
 	"fmt"
 	queue "github.com/mgentili/goPhat/phatqueue"
 	"github.com/mgentili/goPhat/queueRPC"
 	"github.com/mgentili/goPhat/vr"
+	"io/ioutil"
 	"log"
+	"net"
+	"os"
 	"testing"
 	"time"
 )
 
-const BASE = 9000
+// freeAddresses returns n local addresses nothing is listening on
+func freeAddresses(t *testing.T, n int) []string {
+	addresses := make([]string, n)
+	for i := range addresses {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses[i] = l.Addr().String()
+		defer l.Close()
+	}
+	return addresses
+}
 
-var replica_config = []string{"127.0.0.1:9000", "127.0.0.1:9001", "127.0.0.1:9002"}
-var client_config = []string{"127.0.0.1:6000", "127.0.0.1:6001", "127.0.0.1:6002"}
+// startWorker starts three queue servers replicating with VR (shut down once the
+// test is over), and returns a worker connected to them
+func startWorker(t *testing.T) *Worker {
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := freeAddresses(t, 6)
+	replicaConfig, clientConfig := addresses[:3], addresses[3:]
+	replicas := make([]*vr.Replica, len(replicaConfig))
+	for i := range replicas {
+		replicas[i] = vr.RunAsReplicaInDir(uint(i), replicaConfig, dir)
+		if _, err := queueRPC.StartServer(clientConfig[i], replicas[i], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, r := range replicas {
+			r.Shutdown()
+		}
+		os.RemoveAll(dir)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w, err := NewWorkerContext(ctx, clientConfig, 1, "w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (the worker keeps retrying until there's a master)
+	if _, err := w.ListQueuesContext(ctx); err != nil {
+		t.Fatalf("No master: %s", err)
+	}
+	return w
+}
+
+// popValue pops a message and checks its value
+func popValue(t *testing.T, w *Worker, expected string) queue.QMessage {
+	t.Helper()
+	res, err := w.Pop()
+	if err != nil {
+		t.Fatalf("Expected to pop %s, got %s", expected, err)
+	}
+	msg := res.Reply.(queue.QMessage)
+	if msg.Value != expected {
+		t.Fatalf("Expected %s but received %v", expected, msg.Value)
+	}
+	return msg
+}
 
 /*
 func TestClientConnection(t *testing.T) {
 	for i := 0; i < 3; i = i + 1 {
 		newReplica := vr.RunAsReplica(uint(i), replica_config)
-		queueRPC.StartServer(client_config[i], newReplica)
+		queueRPC.StartServer(client_config[i], newReplica, true)
 	}
 	time.Sleep(time.Second)
 
@@ -56,33 +118,181 @@ func TestClientConnection(t *testing.T) {
 */
 
 func Test10k(b *testing.T) {
-	for i := 0; i < 3; i = i + 1 {
-		newReplica := vr.RunAsReplica(uint(i), replica_config)
-		queueRPC.StartServer(client_config[i], newReplica)
-	}
-	time.Sleep(3 * time.Second)
-	cli, err := NewWorker(client_config, 1, "w1")
-	if err != nil {
-		b.Errorf(err.Error())
+	if testing.Short() {
+		b.Skip("10k round trips")
 	}
+	cli := startWorker(b)
 	//
 	start := time.Now()
 	for n := 0; n < 10000; n++ {
 		testString := fmt.Sprintf("hello-%d", n)
-		err = cli.Push(testString)
+		err := cli.Push(testString)
 		if err != nil {
-			b.Errorf(err.Error())
+			b.Error(err)
 		}
 		//
 		res, err := cli.Pop()
 		if err != nil {
-			b.Errorf(err.Error())
+			b.Fatal(err)
+		}
+		msg := res.Reply.(queue.QMessage)
+		if testString != msg.Value.(string) {
+			b.Errorf("Expected %s but received %s", testString, msg.Value)
 		}
-		msg := res.Reply.(queue.QMessage).Value.(string)
-		if testString != msg {
-			b.Errorf("Expected %s but received %s", testString, msg)
+		// (otherwise it's redelivered once its visibility timeout runs out)
+		if err := cli.Done(msg.MessageID); err != nil {
+			b.Error(err)
 		}
 	}
 	elapsed := time.Since(start)
 	log.Printf("Test10k took %s", elapsed)
 }
+
+func TestDeadLetters(t *testing.T) {
+	w := startWorker(t)
+	for _, v := range []string{"replay me", "purge me"} {
+		if err := w.Push(v); err != nil {
+			t.Fatalf("Push fails with %s", err)
+		}
+	}
+	// pop both with a short visibility timeout, and never finish them, until they're given up on
+	for i := 0; i < 2*queue.DEFAULT_MAX_DELIVERIES; i++ {
+		if _, err := w.PopWait(time.Millisecond, 5*queueRPC.REQUEUE_INTERVAL); err != nil {
+			t.Fatalf("Delivery %d fails with %s", i+1, err)
+		}
+	}
+	var dead []queue.QMessage
+	for deadline := time.Now().Add(5 * queueRPC.REQUEUE_INTERVAL); len(dead) < 2; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 dead letters, got %v", dead)
+		}
+		var err error
+		if dead, err = w.DeadLetters(); err != nil {
+			t.Fatalf("DeadLetters fails with %s", err)
+		}
+	}
+	if _, err := w.Pop(); err == nil {
+		t.Errorf("Popped a message that should be a dead letter")
+	}
+
+	replay := dead[0].MessageID
+	if dead[1].Value == "replay me" {
+		replay = dead[1].MessageID
+	}
+	if n, err := w.ReplayDeadLetter(replay); err != nil || n != 1 {
+		t.Fatalf("ReplayDeadLetter replayed %d (err: %v), expected 1", n, err)
+	}
+	msg := popValue(t, w, "replay me")
+	if err := w.Done(msg.MessageID); err != nil {
+		t.Errorf("Done fails with %s", err)
+	}
+	if n, err := w.PurgeDeadLetter(""); err != nil || n != 1 {
+		t.Fatalf("PurgeDeadLetter purged %d (err: %v), expected 1", n, err)
+	}
+	if dead, err := w.DeadLetters(); err != nil || len(dead) != 0 {
+		t.Errorf("Expected no dead letters after purging, got %v (err: %v)", dead, err)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	w := startWorker(t)
+	if err := w.PushBatch([]string{"a", "b", "c"}); err != nil {
+		t.Fatalf("PushBatch fails with %s", err)
+	}
+	msgs, err := w.PopBatch(2, 0)
+	if err != nil || len(msgs) != 2 || msgs[0].Value != "a" || msgs[1].Value != "b" {
+		t.Fatalf("Expected to pop a and b, got %v (err: %v)", msgs, err)
+	}
+	// asking for more than there are gets the rest
+	rest, err := w.PopBatch(5, 0)
+	if err != nil || len(rest) != 1 || rest[0].Value != "c" {
+		t.Fatalf("Expected to pop c, got %v (err: %v)", rest, err)
+	}
+	for _, msg := range append(msgs, rest...) {
+		if err := w.Done(msg.MessageID); err != nil {
+			t.Errorf("Done fails with %s", err)
+		}
+	}
+	if msgs, err := w.PopBatch(5, 0); err == nil {
+		t.Errorf("Popped %v from an empty queue", msgs)
+	}
+	// a waiting batch pop returns once something is pushed
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w.PushBatch([]string{"d", "e"})
+	}()
+	start := time.Now()
+	msgs, err = w.PopBatchWait(5, 0, 5*time.Second)
+	if err != nil || len(msgs) != 2 || msgs[0].Value != "d" || msgs[1].Value != "e" {
+		t.Fatalf("Expected to pop d and e, got %v (err: %v)", msgs, err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("PopBatchWait took %v to notice the push", waited)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	w := startWorker(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if err := w.Push(v); err != nil {
+			t.Fatalf("Push fails with %s", err)
+		}
+	}
+	if msg, err := w.Peek(); err != nil || msg.Value != "a" {
+		t.Errorf("Expected to peek a, got %v (err: %v)", msg, err)
+	}
+	// peeking doesn't pop it
+	popValue(t, w, "a")
+
+	list, err := w.List(queue.LIST_QUEUED, 1, 10)
+	if err != nil || list.Total != 2 || len(list.Messages) != 1 || list.Messages[0].Value != "c" {
+		t.Errorf("Expected to list c of 2 queued messages, got %v (err: %v)", list, err)
+	}
+	list, err = w.List(queue.LIST_IN_PROGRESS, 0, 10)
+	if err != nil || list.Total != 1 || list.Messages[0].Value != "a" || list.Messages[0].Owner == "" {
+		t.Errorf("Expected to list a as in progress, got %v (err: %v)", list, err)
+	}
+	stats, err := w.Stats()
+	if err != nil || stats.Len != 2 || stats.InProgress != 1 || stats.Pushed != 3 || stats.Delivered != 1 {
+		t.Errorf("Expected 2 queued and 1 in progress of 3 pushed, got %+v (err: %v)", stats, err)
+	}
+
+	if n, err := w.Purge(); err != nil || n != 3 {
+		t.Errorf("Purge dropped %d (err: %v), expected 3", n, err)
+	}
+	if stats, err := w.Stats(); err != nil || stats.Len != 0 || stats.InProgress != 0 {
+		t.Errorf("Expected an empty queue after purging, got %+v (err: %v)", stats, err)
+	}
+	if msg, err := w.Peek(); err == nil {
+		t.Errorf("Peeked %v in an empty queue", msg)
+	}
+}
+
+func TestContext(t *testing.T) {
+	w := startWorker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.PushContext(ctx, "a"); err != nil {
+		t.Fatalf("PushContext fails with %s", err)
+	}
+	if msg, err := w.PeekContext(ctx); err != nil || msg.Value != "a" {
+		t.Errorf("Expected to peek a, got %v (err: %v)", msg, err)
+	}
+	if stats, err := w.StatsContext(ctx); err != nil || stats.Len != 1 {
+		t.Errorf("Expected 1 queued message, got %+v (err: %v)", stats, err)
+	}
+	if msgs, err := w.PopBatchContext(ctx, 5, 0); err != nil || len(msgs) != 1 || msgs[0].Value != "a" {
+		t.Errorf("Expected to pop a, got %v (err: %v)", msgs, err)
+	}
+
+	// a waiting pop gives up once its context is done, rather than once the wait is over
+	short, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if res, err := w.PopWaitContext(short, 0, 10*time.Second); err == nil {
+		t.Errorf("Popped %v from an empty queue", res.Reply)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("PopWaitContext took %v to give up", waited)
+	}
+}